@@ -4,8 +4,12 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
 
 	"cse224/tritonhttp"
 )
@@ -22,17 +26,87 @@ func main() {
 	var port = flag.Int("port", 8080, "the localhost port to listen on")
 	var vh_config_path = flag.String("vh_config", default_vh_config_path, "path to the virtual hosting config file")
 	var docroot_dirs_path = flag.String("docroot", default_docroot, "path to the directory that contains all docroot dirs")
+	var dotfiles = flag.String("dotfiles", "hide", "how to answer requests for dotfiles: hide (404), deny (403) or allow")
+	var decode_slashes = flag.Bool("decode_slashes", false, "decode %2F in request paths instead of rejecting the request")
+	var proxy_mode = flag.Bool("proxy", false, "accept CONNECT requests and tunnel them (forward proxy mode)")
+	var reload_interval = flag.Duration("reload_interval", 0, "how often to poll the virtual hosting config file for changes (0 reloads on SIGHUP only)")
+	var access_log = flag.String("access_log", "", "file to write the access log to (\"-\" for stdout, empty to only log virtual hosts with their own accessLog)")
+	var access_log_format = flag.String("access_log_format", "common", "access log format: common, combined or json")
+	var admin_addr = flag.String("admin_addr", "", "address of the admin listener serving Prometheus metrics on /metrics, e.g. localhost:9090 (empty disables it)")
+	var read_header_timeout = flag.Duration("read_header_timeout", 0, "how long to wait for the rest of a partially received request (0 uses the config file or the default)")
+	var idle_timeout = flag.Duration("idle_timeout", 0, "how long a keep-alive connection may wait for its next request (0 uses the config file or the default)")
+	var write_timeout = flag.Duration("write_timeout", 0, "how long writing a response may take (0 uses the config file or the default)")
+	var min_write_rate = flag.Int("min_write_rate", 0, "minimum bytes per second a client must read a response at once write_timeout has passed (0 uses the config file or disables it)")
+	var min_read_rate = flag.Int("min_read_rate", 0, "minimum bytes per second a client must send a request body at once read_header_timeout has passed (0 uses the config file or disables it)")
+	var max_requests_per_conn = flag.Int("max_requests_per_conn", 0, "close connections after this many requests (0 uses the config file or no limit)")
+	var max_header_bytes = flag.Int("max_header_bytes", 0, "largest request line plus headers accepted, larger requests get 431 (0 uses the config file or the default)")
+	var max_conns = flag.Int("max_conns", 0, "connections served at once, more get 503 (0 uses the config file or no limit)")
+	var max_conns_per_ip = flag.Int("max_conns_per_ip", 0, "connections served at once per client IP, more get 503 (0 uses the config file or no limit)")
+	var trusted_proxies = flag.String("trusted_proxies", "", "comma-separated CIDR ranges of proxies whose X-Forwarded-For header is trusted (empty uses the config file)")
+	var check_config = flag.Bool("check-config", false, "validate the virtual hosting config file and exit")
+	var test_rewrite = flag.String("test-rewrite", "", "show how the rewrite rules treat a request for host/path?query, e.g. website1/old/page, and exit")
 	flag.Parse()
 
+	if len(*test_rewrite) > 0 {
+		config, err := tritonhttp.LoadConfig(*vh_config_path, *docroot_dirs_path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		host, target := *test_rewrite, "/"
+		if i := strings.IndexAny(host, "/?"); i != -1 {
+			host, target = host[:i], "/"+strings.TrimPrefix(host[i:], "/")
+		}
+		lines, err := config.DryRunRewrites(host, target)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println(strings.Join(lines, "\n"))
+		os.Exit(0)
+	}
+
+	if *check_config {
+		if _, err := tritonhttp.LoadConfig(*vh_config_path, *docroot_dirs_path); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Printf("%s: config ok\n", *vh_config_path)
+		os.Exit(0)
+	}
+
+	dotfilePolicy, err := tritonhttp.ParseDotfilePolicy(*dotfiles)
+	if err != nil {
+		log.Fatalf("Invalid -dotfiles flag: %v", err)
+	}
+	accessLogFormat, err := tritonhttp.ParseAccessLogFormat(*access_log_format)
+	if err != nil {
+		log.Fatalf("Invalid -access_log_format flag: %v", err)
+	}
+
 	// Log server configs
 	fmt.Println()
 	log.Print("Server configs:")
 	log.Printf("  port: %v", *port)
 	log.Printf("  path to virtual hosts config file: %v", *vh_config_path)
 	log.Printf("  path to docroot directories: %v", *docroot_dirs_path)
+	log.Printf("  dotfiles: %v", *dotfiles)
+	log.Printf("  decode encoded slashes: %v", *decode_slashes)
+	log.Printf("  proxy mode: %v", *proxy_mode)
+	log.Printf("  config reload interval: %v", *reload_interval)
+	log.Printf("  access log: %v (%v)", *access_log, *access_log_format)
+	log.Printf("  admin listener: %v", *admin_addr)
 	fmt.Println()
 
-	virtualHosts := tritonhttp.ParseVHConfigFile("../../virtual_hosts.yaml", "../../docroot_dirs")
+	config, err := tritonhttp.LoadConfig(*vh_config_path, *docroot_dirs_path)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	encodedSlashes := tritonhttp.EncodedSlashesReject
+	if *decode_slashes {
+		encodedSlashes = tritonhttp.EncodedSlashesDecode
+	}
 
 	// Start server
 	addr := fmt.Sprintf(":%v", *port)
@@ -40,8 +114,68 @@ func main() {
 	log.Printf("Starting TritonHTTP server")
 	log.Printf("You can browse the website at http://localhost:%v/", *port)
 	s := &tritonhttp.Server{
-		Addr:         addr,
-		VirtualHosts: virtualHosts,
+		Addr:           addr,
+		Dotfiles:       dotfilePolicy,
+		EncodedSlashes: encodedSlashes,
+		ProxyMode:      *proxy_mode,
+		AccessLog: &tritonhttp.AccessLog{
+			Format: accessLogFormat,
+			Path:   *access_log,
+		},
+	}
+	// Server settings are taken from the config file unless given as flags
+	config.Server.Apply(s)
+	flags := tritonhttp.ServerConfig{
+		ReadHeaderTimeout:  *read_header_timeout,
+		IdleTimeout:        *idle_timeout,
+		WriteTimeout:       *write_timeout,
+		MinWriteRate:       *min_write_rate,
+		MinReadRate:        *min_read_rate,
+		MaxRequestsPerConn: *max_requests_per_conn,
+		MaxHeaderBytes:     *max_header_bytes,
+		MaxConns:           *max_conns,
+		MaxConnsPerIP:      *max_conns_per_ip,
+	}
+	if len(*trusted_proxies) > 0 {
+		flags.TrustedProxies = strings.Split(*trusted_proxies, ",")
+		if _, err := tritonhttp.ParseCIDRs(flags.TrustedProxies); err != nil {
+			log.Fatalf("Invalid -trusted_proxies flag: %v", err)
+		}
+	}
+	flags.Apply(s)
+	if err := s.ApplyConfig(config); err != nil {
+		log.Fatal(err)
 	}
+	log.Printf("  read header timeout: %v, idle timeout: %v, write timeout: %v", s.ReadHeaderTimeout, s.IdleTimeout, s.WriteTimeout)
+	log.Printf("  min write rate: %v bytes/s, min read rate: %v bytes/s", s.MinWriteRate, s.MinReadRate)
+	log.Printf("  max requests per connection: %v, max header bytes: %v", s.MaxRequestsPerConn, s.MaxHeaderBytes)
+	log.Printf("  max connections: %v, per client IP: %v", s.MaxConns, s.MaxConnsPerIP)
+	log.Printf("  trusted proxies: %v", s.TrustedProxies)
+
+	if len(*admin_addr) > 0 {
+		s.Metrics = tritonhttp.NewMetrics()
+		admin := http.NewServeMux()
+		admin.Handle("/metrics", s.Metrics)
+		go func() {
+			log.Fatal(http.ListenAndServe(*admin_addr, admin))
+		}()
+	}
+
+	// Reload the virtual hosts on SIGHUP and, if enabled, on file changes
+	reloadSignals := make(chan os.Signal, 1)
+	signal.Notify(reloadSignals, syscall.SIGHUP)
+	go s.ReloadOnChange(*vh_config_path, *docroot_dirs_path, reloadSignals, *reload_interval)
+
+	// Reopen the access logs on SIGUSR1, e.g. after logrotate moved them
+	reopenSignals := make(chan os.Signal, 1)
+	signal.Notify(reopenSignals, syscall.SIGUSR1)
+	go func() {
+		for range reopenSignals {
+			if err := s.AccessLog.Reopen(); err != nil {
+				log.Printf("Could not reopen access logs: %v", err)
+			}
+		}
+	}()
+
 	log.Fatal(s.ListenAndServe())
 }
@@ -7,14 +7,17 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"mime"
+	"net"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
 type ResponseChecker struct {
@@ -75,12 +78,29 @@ func launchtritonhttpd(t *testing.T) {
 	}
 	log.Println(cwd)
 	t.Log(cwd)
-	virtualHosts := tritonhttp.ParseVHConfigFile("../../virtual_hosts.yaml", "../../docroot_dirs")
+	virtualHosts, err := tritonhttp.ParseVHConfigFile("../../virtual_hosts.yaml", "../../docroot_dirs")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
 	s := &tritonhttp.Server{
 		Addr:         ":8080",
 		VirtualHosts: virtualHosts,
 	}
 	go s.ListenAndServe()
+	waitforhttpd(t, "8080")
+}
+
+// waitforhttpd blocks until a server accepts connections on the given port
+func waitforhttpd(t *testing.T, port string) {
+	for i := 0; i < 50; i++ {
+		conn, err := net.Dial("tcp", "localhost:"+port)
+		if err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Server did not start listening on port %v\n", port)
 }
 
 func TestGoFetch1(t *testing.T) {
@@ -213,20 +233,28 @@ func TestGoFetch3(t *testing.T) {
 func TestAllFilesInHtdocs(t *testing.T) {
 	launchhttpd(t)
 
-	virtualHosts := tritonhttp.ParseVHConfigFile("../../virtual_hosts.yaml", "../../docroot_dirs")
+	virtualHosts, err := tritonhttp.ParseVHConfigFile("../../virtual_hosts.yaml", "../../docroot_dirs")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
 
 	for hostname, docRoot := range virtualHosts {
 
-		err := filepath.Walk(docRoot, func(path string, info os.FileInfo, err error) error {
+		err := fs.WalkDir(docRoot, ".", func(path string, d fs.DirEntry, err error) error {
 			if err != nil {
 				t.Fatal(err.Error())
 			}
 
-			if info.IsDir() {
+			if d.IsDir() {
 				return nil
 			}
 
-			testfile := strings.TrimPrefix(path, docRoot)
+			info, err := d.Info()
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+
+			testfile := "/" + path
 
 			t.Run(testfile, func(t *testing.T) {
 				defer func() {
@@ -273,14 +301,14 @@ func TestAllFilesInHtdocs(t *testing.T) {
 				if !strings.HasPrefix(origmimetype, respcontenttype) {
 					t.Fatalf("Expected Content-Type of %v but got %v instead\n", origmimetype, respcontenttype)
 				}
-				
+
 				// Check the Content-Length
 				if resp.ContentLength != info.Size() {
 					t.Fatalf("Expected Content-Length of %v but got %v\n", info.Size(), resp.ContentLength)
 				}
 
 				// Verify the response body and the original file match
-				origcontents, err := os.ReadFile(path)
+				origcontents, err := fs.ReadFile(docRoot, path)
 				if err != nil {
 					t.Fatalf("Error reading input file: %v\n", err.Error())
 				}
@@ -2,4 +2,10 @@ module cse224
 
 go 1.19
 
-require gopkg.in/yaml.v2 v2.4.0 // indirect
+require (
+	golang.org/x/crypto v0.14.0
+	golang.org/x/net v0.17.0
+	gopkg.in/yaml.v2 v2.4.0
+)
+
+require golang.org/x/text v0.13.0 // indirect
@@ -0,0 +1,235 @@
+package tritonhttp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AccessLogFormat selects how access log entries are written
+type AccessLogFormat int
+
+const (
+	// LogFormatCommon is the Common Log Format, with the authenticated user
+	// in the third field:
+	// 127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET / HTTP/1.1" 200 377
+	LogFormatCommon AccessLogFormat = iota
+	// LogFormatCombined is the Common Log Format followed by the quoted
+	// Referer and User-Agent
+	LogFormatCombined
+	// LogFormatJSON writes one JSON object per line with every field of
+	// AccessLogEntry
+	LogFormatJSON
+)
+
+// ParseAccessLogFormat converts "common", "combined" or "json" into an
+// AccessLogFormat
+func ParseAccessLogFormat(s string) (AccessLogFormat, error) {
+	switch s {
+	case "common":
+		return LogFormatCommon, nil
+	case "combined":
+		return LogFormatCombined, nil
+	case "json":
+		return LogFormatJSON, nil
+	}
+	return LogFormatCommon, fmt.Errorf("unknown access log format %q", s)
+}
+
+// AccessLogEntry records a single response sent by the server. Bytes is
+// the size of its body as sent, without the status line and headers.
+type AccessLogEntry struct {
+	Time        time.Time     `json:"time"`
+	RemoteAddr  string        `json:"remote_addr"`
+	VirtualHost string        `json:"vhost,omitempty"`
+	Method      string        `json:"method"`
+	Target      string        `json:"target"`
+	Proto       string        `json:"proto"`
+	User        string        `json:"user,omitempty"`
+	StatusCode  int           `json:"status"`
+	Bytes       int64         `json:"bytes"`
+	Duration    time.Duration `json:"duration_ns"`
+	Referer     string        `json:"referer,omitempty"`
+	UserAgent   string        `json:"user_agent,omitempty"`
+}
+
+// AccessLog writes an entry for every response to a log file. Virtual
+// hosts can have log files of their own, in which case their entries are
+// written there instead of Path.
+type AccessLog struct {
+	Format AccessLogFormat
+
+	// Path is the file entries are appended to. "-" writes to stdout and
+	// "" drops entries of virtual hosts without a log file of their own.
+	Path string
+
+	mu sync.Mutex
+	// virtualHostPaths maps VirtualHosts entries to their own log file
+	virtualHostPaths map[string]string
+	// files holds every log file opened so far, by path
+	files map[string]io.WriteCloser
+}
+
+// SetVirtualHostPaths sets the log files of individual virtual hosts,
+// keyed by VirtualHosts entry
+func (l *AccessLog) SetVirtualHostPaths(paths map[string]string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.virtualHostPaths = paths
+}
+
+// Log formats and writes entry. Failures to open or write the log file
+// are reported through the standard logger.
+func (l *AccessLog) Log(entry *AccessLogEntry) {
+	line, err := l.format(entry)
+	if err != nil {
+		log.Printf("Could not format access log entry: %v", err)
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	path := l.Path
+	if vhostPath, exists := l.virtualHostPaths[entry.VirtualHost]; exists && len(entry.VirtualHost) > 0 {
+		path = vhostPath
+	}
+	if len(path) == 0 {
+		return
+	}
+	f, err := l.open(path)
+	if err != nil {
+		log.Printf("Could not open access log %v: %v", path, err)
+		return
+	}
+	if _, err := f.Write(line); err != nil {
+		log.Printf("Could not write access log %v: %v", path, err)
+	}
+}
+
+// Reopen closes every log file, which are then opened again on the next
+// entry. Call it after logrotate moved the files away.
+func (l *AccessLog) Reopen() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.closeFiles()
+}
+
+// Close closes every log file
+func (l *AccessLog) Close() error {
+	return l.Reopen()
+}
+
+// Method which returns the already opened log file at path or opens it.
+// Must be called with l.mu held.
+func (l *AccessLog) open(path string) (io.Writer, error) {
+	if f, exists := l.files[path]; exists {
+		return f, nil
+	}
+	var f io.WriteCloser
+	if path == "-" {
+		f = nopCloser{os.Stdout}
+	} else {
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		f = file
+	}
+	if l.files == nil {
+		l.files = make(map[string]io.WriteCloser)
+	}
+	l.files[path] = f
+	return f, nil
+}
+
+// Method which closes all open log files. Must be called with l.mu held.
+func (l *AccessLog) closeFiles() error {
+	var firstErr error
+	for path, f := range l.files {
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(l.files, path)
+	}
+	return firstErr
+}
+
+// Method which renders entry as a single line in the configured format
+func (l *AccessLog) format(entry *AccessLogEntry) ([]byte, error) {
+	if l.Format == LogFormatJSON {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return nil, err
+		}
+		return append(line, '\n'), nil
+	}
+	requestLine := "-"
+	if len(entry.Method) > 0 {
+		requestLine = strings.TrimSpace(entry.Method + " " + entry.Target + " " + entry.Proto)
+	}
+	// %b logs responses without a body as "-"
+	bytes := "-"
+	if entry.Bytes > 0 {
+		bytes = strconv.FormatInt(entry.Bytes, 10)
+	}
+	line := fmt.Sprintf("%s - %s [%s] %q %d %s",
+		entry.RemoteAddr, orDash(entry.User), entry.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		requestLine, entry.StatusCode, bytes)
+	if l.Format == LogFormatCombined {
+		line += fmt.Sprintf(" %q %q", orDash(entry.Referer), orDash(entry.UserAgent))
+	}
+	return []byte(line + "\n"), nil
+}
+
+func orDash(s string) string {
+	if len(s) == 0 {
+		return "-"
+	}
+	return s
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// Method which records res, sent on conn in answer to req, in the access
+// log if there is one. req may be nil when no request could be parsed.
+func (s *Server) logResponse(conn net.Conn, req *Request, res *Response, start time.Time) {
+	if s.AccessLog != nil {
+		s.AccessLog.Log(newAccessLogEntry(conn, req, res, start))
+	}
+}
+
+func newAccessLogEntry(conn net.Conn, req *Request, res *Response, start time.Time) *AccessLogEntry {
+	entry := &AccessLogEntry{
+		Time:       start,
+		RemoteAddr: conn.RemoteAddr().String(),
+		StatusCode: res.StatusCode,
+		Bytes:      res.bodyBytes,
+		Duration:   time.Since(start),
+	}
+	if host, _, err := net.SplitHostPort(entry.RemoteAddr); err == nil {
+		entry.RemoteAddr = host
+	}
+	if req != nil {
+		entry.VirtualHost = req.VirtualHost
+		entry.Method = req.Method
+		entry.Target = req.URL
+		entry.Proto = req.Proto
+		entry.User = req.User
+		entry.Referer = req.Headers["Referer"]
+		entry.UserAgent = req.Headers["User-Agent"]
+	}
+	return entry
+}
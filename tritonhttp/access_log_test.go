@@ -0,0 +1,94 @@
+package tritonhttp
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestAccessLog(t *testing.T) {
+	tmp := t.TempDir()
+	mainlog := filepath.Join(tmp, "access.log")
+	site2log := filepath.Join(tmp, "site2.log")
+	config := &Config{
+		DocRootDir: "../docroot_dirs",
+		VirtualHosts: []VirtualHostConfig{
+			{HostName: "website1", DocRoot: "htdocs1"},
+			{HostName: "website2", Aliases: []string{"www.website2"}, DocRoot: "htdocs2", AccessLog: site2log},
+		},
+	}
+	s := &Server{
+		AccessLog: &AccessLog{Format: LogFormatCombined, Path: mainlog},
+	}
+	if err := s.ApplyConfig(config); err != nil {
+		t.Fatal(err.Error())
+	}
+	port := launchserver(t, s)
+
+	readlog := func(path string) []string {
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Error reading access log: %v\n", err.Error())
+		}
+		return strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n")
+	}
+
+	fetchresponse(t, port, "GET /kitten.jpg?size=big HTTP/1.1\r\nHost: website1\r\nReferer: http://website1/\r\nUser-Agent: gotest\r\nConnection: close\r\n\r\n")
+	fetchresponse(t, port, "GET /notfound.html HTTP/1.1\r\nHost: www.website2\r\nConnection: close\r\n\r\n")
+	fetchresponse(t, port, "foobar\r\nConnection: close\r\n\r\n")
+
+	info, err := os.Stat("../docroot_dirs/htdocs1/kitten.jpg")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	lines := readlog(mainlog)
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 entries in the main access log but got %q\n", lines)
+	}
+	expected := regexp.MustCompile(`^127\.0\.0\.1 - - \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] ` +
+		`"GET /kitten.jpg\?size=big HTTP/1.1" 200 (\d+) "http://website1/" "gotest"$`)
+	match := expected.FindStringSubmatch(lines[0])
+	if match == nil {
+		t.Fatalf("Unexpected access log entry %q\n", lines[0])
+	}
+	// Only the body counts
+	if bytes, _ := strconv.ParseInt(match[1], 10, 64); bytes != info.Size() {
+		t.Fatalf("Expected %v bytes sent but got %v\n", info.Size(), bytes)
+	}
+	// Responses without a body log "-"
+	if !regexp.MustCompile(`\] "-" 400 - "-" "-"$`).MatchString(lines[1]) {
+		t.Fatalf("Unexpected access log entry %q\n", lines[1])
+	}
+
+	// Entries of website2 went to its own log, even when requested through an alias
+	lines = readlog(site2log)
+	if len(lines) != 1 || !strings.Contains(lines[0], `"GET /notfound.html HTTP/1.1" 404`) {
+		t.Fatalf("Unexpected website2 access log %q\n", lines)
+	}
+
+	// Reopen after the log was moved away, as logrotate would
+	if err := os.Rename(mainlog, mainlog+".1"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := s.AccessLog.Reopen(); err != nil {
+		t.Fatal(err.Error())
+	}
+	s.AccessLog.Format = LogFormatJSON
+	fetchresponse(t, port, "GET / HTTP/1.1\r\nHost: website1\r\nUser-Agent: gotest\r\nConnection: close\r\n\r\n")
+	lines = readlog(mainlog)
+	if len(lines) != 1 {
+		t.Fatalf("Expected the reopened log to have 1 entry but got %q\n", lines)
+	}
+	var entry AccessLogEntry
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatalf("Error parsing JSON access log entry %q: %v\n", lines[0], err)
+	}
+	if entry.VirtualHost != "website1" || entry.Method != "GET" || entry.Target != "/" ||
+		entry.StatusCode != 200 || entry.UserAgent != "gotest" || entry.RemoteAddr != "127.0.0.1" || entry.Duration <= 0 {
+		t.Fatalf("Unexpected JSON access log entry %+v\n", entry)
+	}
+}
@@ -0,0 +1,92 @@
+package tritonhttp
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strings"
+)
+
+// AccessRuleConfig is an entry of the access list of a virtual host. It
+// allows or denies the clients in the CIDR ranges of Allow or Deny, of
+// which exactly one is set, for requests under Path ("/" if empty).
+type AccessRuleConfig struct {
+	Path  string   `yaml:"path"`
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+}
+
+// accessRule is the parsed form of an AccessRuleConfig
+type accessRule struct {
+	path  string
+	allow bool
+	nets  []*net.IPNet
+}
+
+// Method which checks the rule and parses it
+func (rc *AccessRuleConfig) parse() (*accessRule, error) {
+	rule := &accessRule{path: rc.Path}
+	if len(rule.path) == 0 {
+		rule.path = "/"
+	}
+	if !strings.HasPrefix(rule.path, "/") {
+		return nil, fmt.Errorf("path %q must start with /", rc.Path)
+	}
+	cidrs := rc.Deny
+	if len(rc.Allow) > 0 {
+		rule.allow, cidrs = true, rc.Allow
+	}
+	if (len(rc.Allow) > 0) == (len(rc.Deny) > 0) {
+		return nil, fmt.Errorf("rule for %s needs either allow or deny", rule.path)
+	}
+	nets, err := ParseCIDRs(cidrs)
+	if err != nil {
+		return nil, err
+	}
+	rule.nets = nets
+	return rule, nil
+}
+
+// Method which cleans reqPath the way it is served, see path.Clean, but
+// keeps a trailing slash, so that "//hidden/" and "/x/..//hidden/" are
+// checked as "/hidden/"
+func cleanPath(reqPath string) string {
+	cleaned := path.Clean("/" + reqPath)
+	if strings.HasSuffix(reqPath, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// Method which reports whether reqPath is prefix or below it. "/hidden"
+// and "/hidden/" both cover "/hidden" and everything below it, but not
+// "/hiddenfile".
+func pathHasPrefix(reqPath string, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return len(prefix) == 0 || reqPath == prefix || strings.HasPrefix(reqPath, prefix+"/")
+}
+
+// Method which evaluates the access rules in options in order. The first
+// rule matching both the path and the client IP of req decides; requests
+// no rule matches are allowed. Clients whose IP can't be determined are
+// denied wherever a rule covers the path.
+func (s *Server) accessAllowed(options *virtualHostOptions, req *Request) bool {
+	rules := options.accessRules
+	if len(rules) == 0 {
+		return true
+	}
+	ip := net.ParseIP(s.clientIP(req))
+	reqPath := cleanPath(req.Path)
+	for _, rule := range rules {
+		if !pathHasPrefix(reqPath, rule.path) {
+			continue
+		}
+		if ip == nil {
+			return false
+		}
+		if containsIP(rule.nets, ip) {
+			return rule.allow
+		}
+	}
+	return true
+}
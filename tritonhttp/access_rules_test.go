@@ -0,0 +1,144 @@
+package tritonhttp
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAccessRules(t *testing.T) {
+	tmp := t.TempDir()
+	for _, file := range []string{"index.html", "hidden/index.html", "hiddenfile.html"} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(tmp, file)), 0755); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := os.WriteFile(filepath.Join(tmp, file), []byte(file), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	config := filepath.Join(tmp, "virtual_hosts.yaml")
+	if err := os.WriteFile(config, []byte(`server:
+  trustedProxies: ["127.0.0.4"]
+virtual_hosts:
+  - hostName: "public"
+    docRoot: "."
+    access:
+      - path: "/hidden"
+        allow: ["127.0.0.1", "10.0.0.0/8"]
+      - path: "/hidden"
+        deny: ["all"]
+  - hostName: "staging"
+    docRoot: "."
+    access:
+      - deny: ["127.0.0.3"]
+      - allow: ["127.0.0.0/24"]
+      - deny: ["all"]
+`), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	c, err := LoadConfig(config, tmp)
+	if err != nil {
+		t.Fatalf("Expected config to be valid but got %v\n", err)
+	}
+	s := &Server{}
+	c.Server.Apply(s)
+	if err := s.ApplyConfig(c); err != nil {
+		t.Fatal(err.Error())
+	}
+	port := launchserver(t, s)
+
+	tests := []struct {
+		ip           string
+		host         string
+		path         string
+		forwardedFor string
+		statusCode   int
+	}{
+		{"127.0.0.1", "public", "/hidden/", "", 200},
+		{"127.0.0.2", "public", "/", "", 200},
+		{"127.0.0.2", "public", "/hidden/", "", 403},
+		{"127.0.0.2", "public", "/hidden", "", 403},
+		// Denied before the docroot is looked at, so nothing is revealed
+		{"127.0.0.2", "public", "/hidden/missing.html", "", 403},
+		{"127.0.0.2", "public", "/subdir/../hidden/index.html", "", 403},
+		{"127.0.0.2", "public", "//hidden/index.html", "", 403},
+		{"127.0.0.2", "public", "/x/..//hidden/index.html", "", 403},
+		{"127.0.0.2", "public", "/%2e%2e//hidden/index.html", "", 403},
+		{"127.0.0.2", "public", "/hiddenfile.html", "", 200},
+		// Behind a trusted proxy the forwarded client is checked
+		{"127.0.0.4", "public", "/hidden/", "10.1.2.3", 200},
+		{"127.0.0.4", "public", "/hidden/", "192.0.2.1", 403},
+		// The first matching rule wins
+		{"127.0.0.2", "staging", "/", "", 200},
+		{"127.0.0.3", "staging", "/", "", 403},
+		{"127.0.0.4", "staging", "/", "192.0.2.1", 403},
+	}
+	for _, tt := range tests {
+		req := "GET " + tt.path + " HTTP/1.1\r\nHost: " + tt.host + "\r\nConnection: close\r\n"
+		if len(tt.forwardedFor) > 0 {
+			req += "X-Forwarded-For: " + tt.forwardedFor + "\r\n"
+		}
+		resp := requestfrom(t, tt.ip, port, req+"\r\n")
+		if resp.StatusCode != tt.statusCode {
+			t.Fatalf("%v (%v) %v%v: expected response code of %v but got %v\n", tt.ip, tt.forwardedFor, tt.host, tt.path, tt.statusCode, resp.StatusCode)
+		}
+	}
+
+	// Rules need exactly one of allow and deny, with valid ranges
+	if err := os.WriteFile(config, []byte(`virtual_hosts:
+  - hostName: "public"
+    docRoot: "."
+    access:
+      - path: "/hidden"
+      - allow: ["10.0.0.0/8"]
+        deny: ["all"]
+      - deny: ["10.0.0.0/33"]
+      - path: "hidden"
+        deny: ["all"]
+`), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = LoadConfig(config, tmp)
+	configErr, ok := err.(*ConfigError)
+	if !ok || len(configErr.Errors) != 4 {
+		t.Fatalf("Expected four invalid rules to be reported but got %v\n", err)
+	}
+}
+
+func TestAccessRulesCleanPath(t *testing.T) {
+	rule, err := (&AccessRuleConfig{Path: "/hidden/", Deny: []string{"all"}}).parse()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	s := &Server{}
+	options := &virtualHostOptions{accessRules: []*accessRule{rule}}
+	// Paths that didn't go through ParseTarget, e.g. set by a rewrite, are
+	// checked as they would be served
+	for _, reqPath := range []string{"/hidden", "//hidden/empty.html", "/x/..//hidden/empty.html", "/hidden/./"} {
+		if s.accessAllowed(options, &Request{Path: reqPath, RemoteAddr: "203.0.113.5:1234"}) {
+			t.Fatalf("Expected %v to be denied\n", reqPath)
+		}
+	}
+	if !s.accessAllowed(options, &Request{Path: "//hiddenfile.html", RemoteAddr: "203.0.113.5:1234"}) {
+		t.Fatal("Expected //hiddenfile.html to be allowed")
+	}
+}
+
+func TestAccessRulesUnknownClient(t *testing.T) {
+	rule, err := (&AccessRuleConfig{Path: "/hidden/", Allow: []string{"all"}}).parse()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	s := &Server{}
+	options := &virtualHostOptions{accessRules: []*accessRule{rule}}
+	// A client IP that can't be parsed fails closed where rules apply
+	if s.accessAllowed(options, &Request{Path: "/hidden/", RemoteAddr: "not-an-ip"}) {
+		t.Fatal("Expected a client without an IP to be denied")
+	}
+	if !s.accessAllowed(options, &Request{Path: "/public/", RemoteAddr: "not-an-ip"}) {
+		t.Fatal("Expected paths without rules to be allowed")
+	}
+	if !s.accessAllowed(options, &Request{Path: "/hidden/", RemoteAddr: "203.0.113.5:1234"}) {
+		t.Fatal("Expected 203.0.113.5 to be allowed")
+	}
+}
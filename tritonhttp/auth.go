@@ -0,0 +1,340 @@
+package tritonhttp
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	AUTH_BASIC  = "basic"
+	AUTH_DIGEST = "digest"
+	// How long a Digest nonce stays valid. Clients get a new one, marked
+	// stale, when they use an expired nonce.
+	DIGEST_NONCE_LIFETIME time.Duration = 5 * time.Minute
+)
+
+// AuthConfig protects the requests under Path with a password. Users and
+// their password hashes are read from the htpasswd-style file Htpasswd,
+// relative to the docroot directory.
+//
+// The Basic scheme accepts "user:hash" lines with bcrypt ($2y$, as written
+// by htpasswd -B) or SHA-1 ({SHA}, htpasswd -s) hashes. Since Digest needs
+// the MD5 of user, realm and password, the Digest scheme uses
+// "user:realm:hash" lines as written by htdigest. Both kinds of lines may
+// be mixed in one file.
+//
+// The credentials are checked by the server, so the Authorization header
+// isn't forwarded to the upstream of a proxy virtual host unless
+// ForwardAuthorization is set.
+type AuthConfig struct {
+	Path                 string `yaml:"path"`
+	Realm                string `yaml:"realm"`
+	Scheme               string `yaml:"scheme"`
+	Htpasswd             string `yaml:"htpasswd"`
+	ForwardAuthorization bool   `yaml:"forwardAuthorization"`
+}
+
+// authRealm is the loaded form of an AuthConfig
+type authRealm struct {
+	path   string
+	name   string
+	scheme string
+	// hashes maps users to their htpasswd hash and digests maps
+	// "user:realm" to the htdigest hash
+	hashes  map[string]string
+	digests map[string]string
+	// forwardAuthorization passes the Authorization header on to upstreams
+	forwardAuthorization bool
+}
+
+// Key used to sign Digest nonces, so the server doesn't have to remember
+// the nonces it handed out
+var digestSecret = func() []byte {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return secret
+}()
+
+// Method which checks the config and reads the password file, relative to
+// docrootDir. realm defaults to the name of the virtual host.
+func (ac *AuthConfig) load(docrootDir string, defaultRealm string) (*authRealm, error) {
+	realm := &authRealm{path: ac.Path, name: ac.Realm, scheme: strings.ToLower(ac.Scheme), forwardAuthorization: ac.ForwardAuthorization}
+	if len(realm.path) == 0 {
+		realm.path = "/"
+	}
+	if !strings.HasPrefix(realm.path, "/") {
+		return nil, fmt.Errorf("path %q must start with /", ac.Path)
+	}
+	if len(realm.name) == 0 {
+		realm.name = defaultRealm
+	}
+	if strings.ContainsAny(realm.name, "\"\\\r\n") {
+		return nil, fmt.Errorf("realm %q may not contain quotes, backslashes or line breaks", realm.name)
+	}
+	if len(realm.scheme) == 0 {
+		realm.scheme = AUTH_BASIC
+	}
+	if realm.scheme != AUTH_BASIC && realm.scheme != AUTH_DIGEST {
+		return nil, fmt.Errorf("unknown scheme %q for %s", ac.Scheme, realm.path)
+	}
+	if len(ac.Htpasswd) == 0 {
+		return nil, fmt.Errorf("htpasswd is empty for %s", realm.path)
+	}
+	htpasswdPath := ac.Htpasswd
+	if !strings.HasPrefix(htpasswdPath, "/") {
+		htpasswdPath = docrootDir + "/" + htpasswdPath
+	}
+	hashes, digests, err := readHtpasswd(htpasswdPath)
+	if err != nil {
+		return nil, err
+	}
+	realm.hashes, realm.digests = hashes, digests
+	return realm, nil
+}
+
+// Method which reads an htpasswd file that may also contain htdigest lines
+func readHtpasswd(path string) (map[string]string, map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read htpasswd file %s : %w", path, err)
+	}
+	defer f.Close()
+	hashes := make(map[string]string)
+	digests := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		switch {
+		case len(fields) == 2 && isSupportedHash(fields[1]):
+			hashes[fields[0]] = fields[1]
+		case len(fields) == 3 && len(fields[2]) == 2*md5.Size:
+			digests[fields[0]+":"+fields[1]] = strings.ToLower(fields[2])
+		default:
+			return nil, nil, fmt.Errorf("%s:%d: expected user:hash with a bcrypt or {SHA} hash, or user:realm:hash", path, lineNumber)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, fmt.Errorf("could not read htpasswd file %s : %w", path, err)
+	}
+	return hashes, digests, nil
+}
+
+func isSupportedHash(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") ||
+		strings.HasPrefix(hash, "$2y$") || strings.HasPrefix(hash, "{SHA}")
+}
+
+// Method which reports whether password matches the htpasswd hash
+func checkPassword(hash string, password string) bool {
+	if strings.HasPrefix(hash, "{SHA}") {
+		sum := sha1.Sum([]byte(password))
+		expected := base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(hash[len("{SHA}"):]), []byte(expected)) == 1
+	}
+	// htpasswd writes $2y$, which bcrypt knows as $2a$
+	if strings.HasPrefix(hash, "$2y$") {
+		hash = "$2a$" + hash[len("$2y$"):]
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// Method which finds the realm protecting req.Path, the one with the
+// longest path if several match, and checks the credentials of req
+// against it. It returns the authenticated user, or false and the
+// WWW-Authenticate challenge to answer with. Credentials that were checked
+// are marked to be kept from upstreams unless the realm forwards them.
+func (s *Server) authenticate(options *virtualHostOptions, req *Request) (string, string, bool) {
+	var realm *authRealm
+	reqPath := cleanPath(req.Path)
+	for _, r := range options.authRealms {
+		if pathHasPrefix(reqPath, r.path) && (realm == nil || len(r.path) > len(realm.path)) {
+			realm = r
+		}
+	}
+	if realm == nil {
+		return "", "", true
+	}
+	scheme, credentials, _ := strings.Cut(req.Headers["Authorization"], " ")
+	scheme = strings.ToLower(scheme)
+	if realm.scheme == AUTH_BASIC {
+		if user, ok := realm.checkBasic(scheme, credentials); ok {
+			req.stripAuthorization = !realm.forwardAuthorization
+			return user, "", true
+		}
+		return "", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", realm.name), false
+	}
+	user, ok, stale := realm.checkDigest(scheme, credentials, req)
+	if ok {
+		req.stripAuthorization = !realm.forwardAuthorization
+		return user, "", true
+	}
+	return "", realm.digestChallenge(stale), false
+}
+
+// Method which checks Basic credentials
+func (realm *authRealm) checkBasic(scheme string, credentials string) (string, bool) {
+	if scheme != AUTH_BASIC {
+		return "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(credentials))
+	if err != nil {
+		return "", false
+	}
+	user, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return "", false
+	}
+	hash, exists := realm.hashes[user]
+	if !exists || !checkPassword(hash, password) {
+		return "", false
+	}
+	return user, true
+}
+
+// Method which checks Digest credentials as described in RFC 7616 with
+// the MD5 algorithm. stale tells whether they were only rejected because
+// the nonce expired.
+func (realm *authRealm) checkDigest(scheme string, credentials string, req *Request) (user string, ok bool, stale bool) {
+	if scheme != AUTH_DIGEST {
+		return "", false, false
+	}
+	params := parseAuthParams(credentials)
+	user = params["username"]
+	if params["realm"] != realm.name || params["uri"] != req.URL {
+		return "", false, false
+	}
+	if algorithm, exists := params["algorithm"]; exists && !strings.EqualFold(algorithm, "MD5") {
+		return "", false, false
+	}
+	valid, expired := checkNonce(params["nonce"], realm.name)
+	if !valid {
+		return "", false, false
+	}
+	ha1, exists := realm.digests[user+":"+realm.name]
+	if !exists {
+		return "", false, false
+	}
+	ha2 := md5Hex(req.Method + ":" + params["uri"])
+	var expected string
+	switch qop := params["qop"]; qop {
+	case "auth":
+		if len(params["nc"]) == 0 || len(params["cnonce"]) == 0 {
+			return "", false, false
+		}
+		expected = md5Hex(strings.Join([]string{ha1, params["nonce"], params["nc"], params["cnonce"], qop, ha2}, ":"))
+	case "":
+		expected = md5Hex(ha1 + ":" + params["nonce"] + ":" + ha2)
+	default:
+		return "", false, false
+	}
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(strings.ToLower(params["response"]))) != 1 {
+		return "", false, false
+	}
+	if expired {
+		return "", false, true
+	}
+	return user, true, false
+}
+
+// Method which returns a Digest challenge with a fresh nonce
+func (realm *authRealm) digestChallenge(stale bool) string {
+	challenge := fmt.Sprintf("Digest realm=%q, qop=\"auth\", algorithm=MD5, nonce=%q", realm.name, newNonce(realm.name, time.Now()))
+	if stale {
+		challenge += ", stale=true"
+	}
+	return challenge
+}
+
+// Method which returns a nonce that carries its creation time, signed
+// together with the realm
+func newNonce(realm string, now time.Time) string {
+	stamp := make([]byte, 8)
+	binary.BigEndian.PutUint64(stamp, uint64(now.UnixNano()))
+	return base64.RawURLEncoding.EncodeToString(append(stamp, nonceMAC(stamp, realm)...))
+}
+
+// Method which reports whether nonce was handed out for realm, and
+// whether it is older than DIGEST_NONCE_LIFETIME
+func checkNonce(nonce string, realm string) (valid bool, expired bool) {
+	raw, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil || len(raw) != 8+sha256.Size {
+		return false, false
+	}
+	stamp := raw[:8]
+	if !hmac.Equal(raw[8:], nonceMAC(stamp, realm)) {
+		return false, false
+	}
+	created := time.Unix(0, int64(binary.BigEndian.Uint64(stamp)))
+	return true, time.Since(created) > DIGEST_NONCE_LIFETIME
+}
+
+func nonceMAC(stamp []byte, realm string) []byte {
+	mac := hmac.New(sha256.New, digestSecret)
+	mac.Write(stamp)
+	mac.Write([]byte(realm))
+	return mac.Sum(nil)
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// Method which parses the comma-separated key=value pairs of Digest
+// credentials, where values may be quoted strings
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+	for len(s) > 0 {
+		s = strings.TrimLeft(s, " \t,")
+		key, rest, found := strings.Cut(s, "=")
+		if !found {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		rest = strings.TrimLeft(rest, " \t")
+		var value strings.Builder
+		if strings.HasPrefix(rest, "\"") {
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				value.WriteByte(rest[i])
+			}
+			// Skip the closing quote, if there is one
+			if i < len(rest) {
+				i++
+			}
+			s = rest[i:]
+		} else {
+			end := strings.IndexByte(rest, ',')
+			if end < 0 {
+				end = len(rest)
+			}
+			value.WriteString(strings.TrimSpace(rest[:end]))
+			s = rest[end:]
+		}
+		params[key] = value.String()
+	}
+	return params
+}
@@ -0,0 +1,206 @@
+package tritonhttp
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// digestauthorization answers a Digest challenge for the request GET uri
+func digestauthorization(challenge string, user string, realm string, password string, uri string) string {
+	nonce := regexp.MustCompile(`nonce="([^"]*)"`).FindStringSubmatch(challenge)[1]
+	md5hex := func(s string) string {
+		return fmt.Sprintf("%x", md5.Sum([]byte(s)))
+	}
+	ha1 := md5hex(user + ":" + realm + ":" + password)
+	ha2 := md5hex("GET:" + uri)
+	response := md5hex(ha1 + ":" + nonce + ":00000001:0a4f113b:auth:" + ha2)
+	return fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", qop=auth, nc=00000001, cnonce="0a4f113b", response="%s"`,
+		user, realm, nonce, uri, response)
+}
+
+func TestAuth(t *testing.T) {
+	tmp := t.TempDir()
+	for _, file := range []string{"site/index.html", "site/private/index.html", "site/digest/index.html"} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(tmp, file)), 0755); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := os.WriteFile(filepath.Join(tmp, file), []byte(file), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("alicepw"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// htpasswd -B writes $2y$ hashes
+	apacheHash := "$2y$" + strings.TrimPrefix(string(bcryptHash), "$2a$")
+	sha := sha1.Sum([]byte("bobpw"))
+	htpasswd := "# users\n" +
+		"alice:" + apacheHash + "\n" +
+		"bob:{SHA}" + base64.StdEncoding.EncodeToString(sha[:]) + "\n" +
+		fmt.Sprintf("carol:Digest Area:%x\n", md5.Sum([]byte("carol:Digest Area:carolpw")))
+	if err := os.WriteFile(filepath.Join(tmp, "htpasswd"), []byte(htpasswd), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	config := filepath.Join(tmp, "virtual_hosts.yaml")
+	if err := os.WriteFile(config, []byte(`virtual_hosts:
+  - hostName: "site"
+    docRoot: "site"
+    auth:
+      - path: "/private"
+        realm: "Private"
+        htpasswd: "htpasswd"
+      - path: "/digest/"
+        realm: "Digest Area"
+        scheme: "digest"
+        htpasswd: "htpasswd"
+`), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	c, err := LoadConfig(config, tmp)
+	if err != nil {
+		t.Fatalf("Expected config to be valid but got %v\n", err)
+	}
+	accessLog := filepath.Join(tmp, "access.log")
+	s := &Server{AccessLog: &AccessLog{Path: accessLog}}
+	if err := s.ApplyConfig(c); err != nil {
+		t.Fatal(err.Error())
+	}
+	port := launchserver(t, s)
+
+	get := func(path string, authorization string) *http.Response {
+		req := "GET " + path + " HTTP/1.1\r\nHost: site\r\nConnection: close\r\n"
+		if len(authorization) > 0 {
+			req += "Authorization: " + authorization + "\r\n"
+		}
+		return fetchresponse(t, port, req+"\r\n")
+	}
+	basic := func(user string, password string) string {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+	}
+	tests := []struct {
+		path          string
+		authorization string
+		statusCode    int
+	}{
+		{"/", "", 200},
+		{"/private/", "", 401},
+		{"//private/", "", 401},
+		{"/x/..//private/index.html", "", 401},
+		{"/private/", basic("alice", "wrong"), 401},
+		{"/private/", basic("nobody", "alicepw"), 401},
+		{"/private/", basic("alice", "alicepw"), 200},
+		{"/private/index.html", basic("bob", "bobpw"), 200},
+		// Digest users can't log in with Basic
+		{"/private/", basic("carol", "carolpw"), 401},
+		{"/private/", "Bearer token", 401},
+	}
+	for _, tt := range tests {
+		resp := get(tt.path, tt.authorization)
+		if resp.StatusCode != tt.statusCode {
+			t.Fatalf("%v with %q: expected response code of %v but got %v\n", tt.path, tt.authorization, tt.statusCode, resp.StatusCode)
+		}
+		if tt.statusCode == 401 {
+			if challenge := resp.Header.Get("WWW-Authenticate"); challenge != `Basic realm="Private", charset="UTF-8"` {
+				t.Fatalf("Unexpected challenge %q\n", challenge)
+			}
+		}
+	}
+
+	resp := get("/digest/", "")
+	challenge := resp.Header.Get("WWW-Authenticate")
+	if resp.StatusCode != 401 || !strings.HasPrefix(challenge, `Digest realm="Digest Area", qop="auth", algorithm=MD5, nonce="`) {
+		t.Fatalf("Expected a Digest challenge but got %v %q\n", resp.StatusCode, challenge)
+	}
+	if resp := get("/digest/", digestauthorization(challenge, "carol", "Digest Area", "carolpw", "/digest/")); resp.StatusCode != 200 {
+		t.Fatalf("Expected Digest authentication to succeed but got %v\n", resp.StatusCode)
+	}
+	failures := []string{
+		digestauthorization(challenge, "carol", "Digest Area", "wrong", "/digest/"),
+		// The uri has to be the one requested
+		digestauthorization(challenge, "carol", "Digest Area", "carolpw", "/digest/index.html"),
+		digestauthorization(strings.Replace(challenge, `nonce="`, `nonce="forged`, 1), "carol", "Digest Area", "carolpw", "/digest/"),
+		digestauthorization(challenge, "alice", "Digest Area", "alicepw", "/digest/"),
+		basic("carol", "carolpw"),
+	}
+	for _, authorization := range failures {
+		if resp := get("/digest/", authorization); resp.StatusCode != 401 {
+			t.Fatalf("Expected %q to be rejected but got %v\n", authorization, resp.StatusCode)
+		}
+	}
+
+	// The access log names the authenticated user
+	s.AccessLog.Close()
+	logged, err := os.ReadFile(accessLog)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, expected := range []string{` - alice [`, ` - bob [`, ` - carol [`, `"GET /private/ HTTP/1.1" 401`} {
+		if !strings.Contains(string(logged), expected) {
+			t.Fatalf("Expected %q in the access log:\n%s", expected, logged)
+		}
+	}
+
+	// Problems with realms are reported by LoadConfig
+	if err := os.WriteFile(filepath.Join(tmp, "broken"), []byte("dave:$apr1$abc$def\n"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := os.WriteFile(config, []byte(`virtual_hosts:
+  - hostName: "site"
+    docRoot: "site"
+    auth:
+      - path: "/a"
+        scheme: "ntlm"
+        htpasswd: "htpasswd"
+      - path: "/b"
+        htpasswd: "missing"
+      - path: "/c"
+        htpasswd: "broken"
+      - path: "/d"
+`), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = LoadConfig(config, tmp)
+	configErr, ok := err.(*ConfigError)
+	if !ok || len(configErr.Errors) != 4 {
+		t.Fatalf("Expected four invalid realms to be reported but got %v\n", err)
+	}
+}
+
+func TestPathPrefixesCleanPath(t *testing.T) {
+	s := &Server{}
+	realm := &authRealm{path: "/private", name: "site", scheme: AUTH_BASIC}
+	route := &fastCGIRoute{path: "/php/"}
+	options := &virtualHostOptions{authRealms: []*authRealm{realm}, fastCGI: []*fastCGIRoute{route}}
+	// Paths that didn't go through ParseTarget are matched as they would
+	// be served
+	for _, reqPath := range []string{"//private/", "/x/..//private/index.html", "/private/./"} {
+		if _, _, ok := s.authenticate(options, &Request{Path: reqPath, Headers: map[string]string{}}); ok {
+			t.Fatalf("Expected %v to need credentials\n", reqPath)
+		}
+	}
+	if s.fastCGIRoute(options, &Request{Path: "//php/index.php"}) != route {
+		t.Fatal("Expected //php/index.php to be sent to FastCGI")
+	}
+	rule, err := (&RewriteConfig{Prefix: "/old", To: "/new"}).parse()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if target, matches := rule.apply("//old/a.html"); !matches || target != "/new/a.html" {
+		t.Fatalf("Expected //old/a.html to be rewritten to /new/a.html but got %q\n", target)
+	}
+	h := &cgiHandler{prefix: "/cgi-bin", dir: t.TempDir()}
+	if _, _, _, found, _ := h.lookup("//cgi-bin/missing.sh"); !found {
+		t.Fatal("Expected //cgi-bin/missing.sh to be looked up in the CGI directory")
+	}
+}
@@ -0,0 +1,295 @@
+package tritonhttp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Load balancing policies of a virtual host with several upstreams
+const (
+	BALANCE_ROUND_ROBIN = "round-robin"
+	BALANCE_LEAST_CONN  = "least-conn"
+	BALANCE_IP_HASH     = "ip-hash"
+	BALANCE_PATH_HASH   = "path-hash"
+)
+
+const (
+	// DEFAULT_MAX_FAILS is how many consecutive failures eject an upstream
+	// when maxFails isn't set
+	DEFAULT_MAX_FAILS = 3
+	// DEFAULT_FAIL_TIMEOUT is how long an ejected upstream is left alone
+	// when failTimeout isn't set
+	DEFAULT_FAIL_TIMEOUT time.Duration = 10 * time.Second
+	// DEFAULT_HEALTH_CHECK_INTERVAL is how often upstreams are checked when
+	// the health check has no interval
+	DEFAULT_HEALTH_CHECK_INTERVAL time.Duration = 10 * time.Second
+	// How many points every upstream gets on the consistent hash ring
+	hashRingReplicas = 100
+)
+
+// Method which reports whether policy is a known load balancing policy.
+// The empty policy is round-robin.
+func isBalancingPolicy(policy string) bool {
+	switch policy {
+	case "", BALANCE_ROUND_ROBIN, BALANCE_LEAST_CONN, BALANCE_IP_HASH, BALANCE_PATH_HASH:
+		return true
+	}
+	return false
+}
+
+// upstreamHealth tracks whether an upstream should get requests: it is
+// ejected for a while after failing too often in a row, and taken out
+// while its health check fails. active counts the requests it is serving.
+type upstreamHealth struct {
+	healthMu     sync.Mutex
+	fails        int
+	ejectedUntil time.Time
+	unhealthy    bool
+	active       int
+}
+
+// Method which reports whether the upstream can take requests at now
+func (h *upstreamHealth) available(now time.Time) bool {
+	h.healthMu.Lock()
+	defer h.healthMu.Unlock()
+	return !h.unhealthy && !now.Before(h.ejectedUntil)
+}
+
+// Method which returns the number of requests the upstream is serving
+func (h *upstreamHealth) load() int {
+	h.healthMu.Lock()
+	defer h.healthMu.Unlock()
+	return h.active
+}
+
+// Method which records that a request picked the upstream
+func (h *upstreamHealth) acquire() {
+	h.healthMu.Lock()
+	defer h.healthMu.Unlock()
+	h.active++
+}
+
+// Method which records that a request is done with the upstream
+func (h *upstreamHealth) release() {
+	h.healthMu.Lock()
+	defer h.healthMu.Unlock()
+	h.active--
+}
+
+// balancer spreads requests over upstreams
+type balancer struct {
+	upstreams []*upstream
+	policy    string
+
+	// maxFails consecutive failures eject an upstream for failTimeout
+	maxFails    int
+	failTimeout time.Duration
+
+	// healthCheck, if set, is requested from every upstream each
+	// healthInterval. Upstreams that don't answer with 2xx or 3xx get no
+	// requests until they do.
+	healthCheck    string
+	healthInterval time.Duration
+	stopCheck      chan struct{}
+
+	// next is the round-robin position
+	next atomic.Uint64
+	// ring holds the points of the upstreams on the consistent hash ring,
+	// sorted by hash
+	ring []ringPoint
+}
+
+type ringPoint struct {
+	hash     uint32
+	upstream *upstream
+}
+
+// Method which sets the upstreams and places them on the hash ring
+func (b *balancer) setUpstreams(upstreams []*upstream) {
+	b.upstreams = upstreams
+	b.ring = b.ring[:0]
+	for _, u := range upstreams {
+		for i := 0; i < hashRingReplicas; i++ {
+			b.ring = append(b.ring, ringPoint{crc32.ChecksumIEEE([]byte(u.addr + "#" + strconv.Itoa(i))), u})
+		}
+	}
+	sort.Slice(b.ring, func(i, j int) bool { return b.ring[i].hash < b.ring[j].hash })
+}
+
+// Method which picks the upstream serving req and counts the request
+// against it. It returns nil if no upstream is available.
+func (b *balancer) pick(req *Request, clientIP string) *upstream {
+	var u *upstream
+	switch b.policy {
+	case BALANCE_LEAST_CONN:
+		u = b.leastConn()
+	case BALANCE_IP_HASH:
+		u = b.hashed(clientIP)
+	case BALANCE_PATH_HASH:
+		u = b.hashed(req.Path)
+	default:
+		u = b.roundRobin()
+	}
+	if u != nil {
+		u.acquire()
+	}
+	return u
+}
+
+// Method which returns the next available upstream in turn
+func (b *balancer) roundRobin() *upstream {
+	now := time.Now()
+	start := b.next.Add(1)
+	for i := range b.upstreams {
+		u := b.upstreams[(start+uint64(i))%uint64(len(b.upstreams))]
+		if u.available(now) {
+			return u
+		}
+	}
+	return nil
+}
+
+// Method which returns the available upstream serving the fewest
+// requests. Ties are broken in round-robin order.
+func (b *balancer) leastConn() *upstream {
+	now := time.Now()
+	start := b.next.Add(1)
+	var best *upstream
+	bestLoad := 0
+	for i := range b.upstreams {
+		u := b.upstreams[(start+uint64(i))%uint64(len(b.upstreams))]
+		if !u.available(now) {
+			continue
+		}
+		if load := u.load(); best == nil || load < bestLoad {
+			best, bestLoad = u, load
+		}
+	}
+	return best
+}
+
+// Method which returns the upstream owning key on the hash ring. When it
+// isn't available the next one along the ring takes over, so only the keys
+// of an unavailable upstream move.
+func (b *balancer) hashed(key string) *upstream {
+	if len(b.ring) == 0 {
+		return nil
+	}
+	now := time.Now()
+	hash := crc32.ChecksumIEEE([]byte(key))
+	start := sort.Search(len(b.ring), func(i int) bool { return b.ring[i].hash >= hash })
+	for i := range b.ring {
+		if u := b.ring[(start+i)%len(b.ring)].upstream; u.available(now) {
+			return u
+		}
+	}
+	return nil
+}
+
+// Method which counts a failed request against u, ejecting it after
+// maxFails in a row
+func (b *balancer) failed(u *upstream) {
+	u.healthMu.Lock()
+	defer u.healthMu.Unlock()
+	u.fails++
+	if u.fails >= b.maxFails {
+		u.fails = 0
+		u.ejectedUntil = time.Now().Add(b.failTimeout)
+		log.Printf("Upstream %v failed %v times in a row, ejecting it for %v", u.addr, b.maxFails, b.failTimeout)
+	}
+}
+
+// Method which records a successful request to u
+func (b *balancer) succeeded(u *upstream) {
+	u.healthMu.Lock()
+	defer u.healthMu.Unlock()
+	u.fails = 0
+}
+
+// Method which starts the health checks, if any. Without health checks
+// every upstream counts as healthy.
+func (b *balancer) start() {
+	if len(b.healthCheck) == 0 {
+		for _, u := range b.upstreams {
+			b.setHealthy(u, true)
+		}
+		return
+	}
+	b.stopCheck = make(chan struct{})
+	go b.checkHealth(b.stopCheck)
+}
+
+// Method which stops the health checks started by start
+func (b *balancer) stop() {
+	if b.stopCheck != nil {
+		close(b.stopCheck)
+	}
+}
+
+// Method which checks every upstream right away and then each
+// healthInterval, until stop is closed
+func (b *balancer) checkHealth(stop chan struct{}) {
+	ticker := time.NewTicker(b.healthInterval)
+	defer ticker.Stop()
+	for {
+		for _, u := range b.upstreams {
+			b.setHealthy(u, b.probe(u))
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Method which requests the health check path from u and reports whether
+// it answered with 2xx or 3xx
+func (b *balancer) probe(u *upstream) bool {
+	host, port, err := net.SplitHostPort(u.addr)
+	if err != nil {
+		return false
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	req := fmt.Sprintf("GET %s HTTP/1.1\r\nHost: %s\r\nUser-Agent: %s\r\nConnection: close\r\n\r\n", b.healthCheck, u.addr, viaName)
+	respBytes, _, err := Fetch(host, port, []byte(req))
+	if err != nil {
+		return false
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respBytes)), nil)
+	if err != nil {
+		return false
+	}
+	return resp.StatusCode >= 200 && resp.StatusCode < 400
+}
+
+// Method which records the result of a health check of u, logging changes
+func (b *balancer) setHealthy(u *upstream, healthy bool) {
+	u.healthMu.Lock()
+	defer u.healthMu.Unlock()
+	if u.unhealthy == !healthy {
+		return
+	}
+	u.unhealthy = !healthy
+	if len(b.healthCheck) == 0 {
+		return
+	}
+	if healthy {
+		log.Printf("Upstream %v passed its health check", u.addr)
+	} else {
+		log.Printf("Upstream %v failed its health check", u.addr)
+	}
+}
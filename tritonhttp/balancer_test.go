@@ -0,0 +1,209 @@
+package tritonhttp
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// launchbackends starts n stand-in upstreams that answer with their index.
+// "/hold" requests announce themselves on holding and wait until release
+// is closed, and "/health" answers 503 while the backend's sick flag is
+// set.
+func launchbackends(t *testing.T, n int, holding chan int, release chan struct{}) ([]string, []*atomic.Bool) {
+	addrs := make([]string, n)
+	sick := make([]*atomic.Bool, n)
+	for i := 0; i < n; i++ {
+		i := i
+		sick[i] = &atomic.Bool{}
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/hold":
+				holding <- i
+				<-release
+			case "/health":
+				if sick[i].Load() {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+			}
+			fmt.Fprint(w, i)
+		}))
+		t.Cleanup(backend.Close)
+		addrs[i] = backend.Listener.Addr().String()
+	}
+	return addrs, sick
+}
+
+func TestLoadBalancing(t *testing.T) {
+	holding := make(chan int)
+	release := make(chan struct{})
+	defer close(release)
+	addrs, sick := launchbackends(t, 3, holding, release)
+	dead, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	dead.Close()
+	list := func(addrs ...string) string {
+		return `["` + strings.Join(addrs, `", "`) + `"]`
+	}
+	tmp := t.TempDir()
+	config := filepath.Join(tmp, "virtual_hosts.yaml")
+	if err := os.WriteFile(config, []byte(`virtual_hosts:
+  - hostName: "rr"
+    upstreams: `+list(addrs...)+`
+  - hostName: "least"
+    upstreams: `+list(addrs[0], addrs[1])+`
+    loadBalancing: "least-conn"
+  - hostName: "iphash"
+    upstreams: `+list(addrs...)+`
+    loadBalancing: "ip-hash"
+  - hostName: "pathhash"
+    upstreams: `+list(addrs...)+`
+    loadBalancing: "path-hash"
+  - hostName: "eject"
+    upstreams: `+list(dead.Addr().String(), addrs[0])+`
+    maxFails: 2
+    failTimeout: 1m
+  - hostName: "checked"
+    upstreams: `+list(addrs[1], addrs[2])+`
+    healthCheck:
+      path: "/health"
+      interval: 20ms
+`), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	c, err := LoadConfig(config, tmp)
+	if err != nil {
+		t.Fatalf("Expected config to be valid but got %v\n", err)
+	}
+	s := &Server{}
+	if err := s.ApplyConfig(c); err != nil {
+		t.Fatal(err.Error())
+	}
+	port := launchserver(t, s)
+
+	// backend returns which backend answered, or the status code on failure
+	backend := func(ip string, host string, path string) string {
+		t.Helper()
+		resp := requestfrom(t, ip, port, "GET "+path+" HTTP/1.1\r\nHost: "+host+"\r\nConnection: close\r\n\r\n")
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != 200 {
+			return strconv.Itoa(resp.StatusCode)
+		}
+		return string(body)
+	}
+	// backends returns the backends answering n requests in a row
+	backends := func(n int, ip string, host string, path string) map[string]int {
+		t.Helper()
+		counts := make(map[string]int)
+		for i := 0; i < n; i++ {
+			counts[backend(ip, host, path)]++
+		}
+		return counts
+	}
+
+	// Round-robin takes turns
+	if counts := backends(6, "127.0.0.1", "rr", "/"); counts["0"] != 2 || counts["1"] != 2 || counts["2"] != 2 {
+		t.Fatalf("Expected round-robin to spread requests evenly but got %v\n", counts)
+	}
+
+	// Least-conn avoids the backend still serving a request
+	conn := dialfrom(t, "127.0.0.1", port)
+	if _, err := conn.Write([]byte("GET /hold HTTP/1.1\r\nHost: least\r\n\r\n")); err != nil {
+		t.Fatal(err.Error())
+	}
+	busy := strconv.Itoa(<-holding)
+	if counts := backends(4, "127.0.0.1", "least", "/"); counts[busy] != 0 || len(counts) != 1 {
+		t.Fatalf("Expected least-conn to avoid busy backend %v but got %v\n", busy, counts)
+	}
+
+	// Hashing sends every client, or every path, to the same backend
+	for _, ip := range []string{"127.0.0.1", "127.0.0.2", "127.0.0.3"} {
+		if counts := backends(3, ip, "iphash", "/"+ip); len(counts) != 1 || counts["502"] != 0 {
+			t.Fatalf("Expected ip-hash to stick to one backend for %v but got %v\n", ip, counts)
+		}
+	}
+	for _, path := range []string{"/a", "/b", "/c"} {
+		ip := 0
+		counts := make(map[string]int)
+		for ; ip < 3; ip++ {
+			counts[backend("127.0.0."+strconv.Itoa(ip+1), "pathhash", path)]++
+		}
+		if len(counts) != 1 || counts["502"] != 0 {
+			t.Fatalf("Expected path-hash to stick to one backend for %v but got %v\n", path, counts)
+		}
+	}
+
+	// A backend failing maxFails times in a row is ejected
+	if counts := backends(4, "127.0.0.1", "eject", "/"); counts["502"] != 2 || counts["0"] != 2 {
+		t.Fatalf("Expected two failures before the dead backend is ejected but got %v\n", counts)
+	}
+	if counts := backends(4, "127.0.0.1", "eject", "/"); counts["0"] != 4 {
+		t.Fatalf("Expected the dead backend to stay ejected but got %v\n", counts)
+	}
+
+	// Backends failing their health check get no requests until it passes
+	waitforbackends := func(expected string) {
+		t.Helper()
+		var counts map[string]int
+		for i := 0; i < 100; i++ {
+			if counts = backends(4, "127.0.0.1", "checked", "/"); counts[expected] == 4 {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		t.Fatalf("Expected only backend %v to get requests but got %v\n", expected, counts)
+	}
+	sick[1].Store(true)
+	waitforbackends("2")
+	sick[1].Store(false)
+	sick[2].Store(true)
+	waitforbackends("1")
+	sick[2].Store(false)
+}
+
+func TestProbeClosesConnection(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer l.Close()
+	closed := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			closed <- err
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 4096)
+		if _, err := conn.Read(buf); err != nil {
+			closed <- err
+			return
+		}
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		// Only the probe can end the connection now
+		conn.(*net.TCPConn).CloseWrite()
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, err = conn.Read(buf)
+		closed <- err
+	}()
+	b := &balancer{healthCheck: "/health"}
+	if !b.probe(&upstream{addr: l.Addr().String()}) {
+		t.Fatal("Expected the probe to succeed")
+	}
+	if err := <-closed; err != io.EOF {
+		t.Fatalf("Expected the probe to close its connection but got %v\n", err)
+	}
+}
@@ -0,0 +1,278 @@
+package tritonhttp
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	// How much of a request body the handler didn't read is skipped to
+	// keep the connection open. Longer bodies close the connection.
+	MAX_DISCARD_BYTES = 256 * 1024
+	// Longest chunk size or trailer line accepted in a chunked body
+	maxChunkLineBytes = 4096
+	// How much is read from the connection at once
+	readBufferSize = 4096
+)
+
+// Method which reports whether remaining holds a complete request line and
+// headers
+func hasFullRequest(remaining string) bool {
+	return strings.Contains(remaining, doubleCarriageReturnNewLine)
+}
+
+// Method which counts the complete request heads in remaining. Bodies
+// aren't told apart from requests, so it is only an estimate of how many
+// requests were pipelined.
+func countFullRequests(remaining string) int {
+	return strings.Count(remaining, doubleCarriageReturnNewLine)
+}
+
+// Method which removes the first request line and headers from remaining
+// and splits them into lines. The body, if any, stays in remaining.
+func nextRequest(remaining *string) ([]string, bool) {
+	delimiterIndex := strings.Index(*remaining, doubleCarriageReturnNewLine)
+	if delimiterIndex == -1 {
+		return nil, false
+	}
+	requestLines := splitFullRequestIntoLines((*remaining)[:delimiterIndex])
+	*remaining = (*remaining)[delimiterIndex+len(doubleCarriageReturnNewLine):]
+	return requestLines, true
+}
+
+// Method which reads once from conn and appends the data to remaining
+func readMore(conn net.Conn, remaining *string) error {
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	*remaining += string(buf[:n])
+	return err
+}
+
+// connReader reads the data already received into remaining before
+// reading more from conn. Whatever it reads from conn beyond what its
+// caller asked for is kept in remaining, so the next request on the
+// connection isn't lost.
+type connReader struct {
+	conn      net.Conn
+	remaining *string
+	deadline  transferDeadline
+}
+
+// Method which reads more data into remaining
+func (cr *connReader) fill() error {
+	buf := make([]byte, cr.deadline.chunk(readBufferSize))
+	if err := cr.conn.SetReadDeadline(cr.deadline.next(len(buf))); err != nil {
+		return err
+	}
+	n, err := cr.conn.Read(buf)
+	cr.deadline.done += int64(n)
+	*cr.remaining += string(buf[:n])
+	if n > 0 {
+		return nil
+	}
+	if err == nil {
+		err = io.ErrNoProgress
+	}
+	return err
+}
+
+func (cr *connReader) Read(p []byte) (int, error) {
+	if len(*cr.remaining) == 0 {
+		if err := cr.fill(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, *cr.remaining)
+	*cr.remaining = (*cr.remaining)[n:]
+	return n, nil
+}
+
+// Method which reads a line ending in CRLF, without the CRLF
+func (cr *connReader) readLine() (string, error) {
+	for {
+		if i := strings.Index(*cr.remaining, carriageReturnNewLine); i != -1 {
+			line := (*cr.remaining)[:i]
+			*cr.remaining = (*cr.remaining)[i+len(carriageReturnNewLine):]
+			return line, nil
+		}
+		if len(*cr.remaining) > maxChunkLineBytes {
+			return "", fmt.Errorf("line too long in chunked body")
+		}
+		if err := cr.fill(); err != nil {
+			return "", err
+		}
+	}
+}
+
+// bodyReader reads a request body framed by Content-Length or the chunked
+// transfer coding, stopping at its end
+type bodyReader struct {
+	src *connReader
+	// left is what is left of a Content-Length body, or of the current
+	// chunk of a chunked body
+	left    int64
+	chunked bool
+	eof     bool
+	err     error
+	// sendContinue, if set, writes "100 Continue" before the body is read
+	sendContinue func() error
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	if b.eof {
+		return 0, io.EOF
+	}
+	if b.sendContinue != nil {
+		if err := b.sendContinue(); err != nil {
+			b.err = err
+			return 0, err
+		}
+		b.sendContinue = nil
+	}
+	if b.chunked && b.left == 0 {
+		if err := b.nextChunk(); err != nil {
+			b.err = err
+			return 0, err
+		}
+		if b.eof {
+			return 0, io.EOF
+		}
+	}
+	if int64(len(p)) > b.left {
+		p = p[:b.left]
+	}
+	n, err := b.src.Read(p)
+	b.left -= int64(n)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		b.err = err
+		return n, err
+	}
+	if b.left == 0 {
+		if b.chunked {
+			if line, err := b.src.readLine(); err != nil || len(line) > 0 {
+				b.err = fmt.Errorf("malformed chunked body")
+				return n, b.err
+			}
+		} else {
+			b.eof = true
+		}
+	}
+	return n, nil
+}
+
+// Method which reads the size line of the next chunk, and the trailer
+// after the last one
+func (b *bodyReader) nextChunk() error {
+	line, err := b.src.readLine()
+	if err != nil {
+		return err
+	}
+	// Chunk extensions are ignored
+	if i := strings.IndexByte(line, ';'); i != -1 {
+		line = line[:i]
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(line), 16, 64)
+	if err != nil || size < 0 {
+		return fmt.Errorf("malformed chunk size %q", line)
+	}
+	if size > 0 {
+		b.left = size
+		return nil
+	}
+	// Trailer fields are dropped
+	for {
+		line, err := b.src.readLine()
+		if err != nil {
+			return err
+		}
+		if len(line) == 0 {
+			b.eof = true
+			return nil
+		}
+	}
+}
+
+// Method which skips up to limit bytes of what is left of the body and
+// reports whether the end of the body was reached. A client still waiting
+// for "100 Continue" hasn't sent its body, so there's nothing to skip but
+// the connection can't be reused either.
+func (b *bodyReader) discard(limit int64) bool {
+	if b.sendContinue != nil {
+		return false
+	}
+	n, err := io.CopyN(io.Discard, b, limit+1)
+	return err == io.EOF && n <= limit
+}
+
+// Method which reports whether req announces a body
+func declaresBody(req *Request) bool {
+	length := strings.TrimSpace(req.Headers["Content-Length"])
+	return len(req.Headers["Transfer-Encoding"]) > 0 || (len(length) > 0 && length != "0")
+}
+
+// Method which sets req.Body and req.ContentLength from the framing
+// headers of req, reading the body from remaining and then conn. Requests
+// with both Transfer-Encoding and Content-Length, or with framing that
+// can't be understood, are rejected since the end of their body can't be
+// found reliably.
+func (s *Server) setupBody(conn net.Conn, remaining *string, req *Request) error {
+	transferEncoding, chunked := req.Headers["Transfer-Encoding"]
+	contentLength, hasLength := req.Headers["Content-Length"]
+	var length int64
+	switch {
+	case chunked && hasLength:
+		return fmt.Errorf("both Transfer-Encoding and Content-Length are set")
+	case chunked:
+		if !strings.EqualFold(strings.TrimSpace(transferEncoding), "chunked") {
+			return fmt.Errorf("unsupported transfer coding %q", transferEncoding)
+		}
+		length = -1
+	case hasLength:
+		// Repeated Content-Length headers were joined, they must agree
+		values := strings.Split(contentLength, ",")
+		for _, value := range values {
+			if strings.TrimSpace(value) != strings.TrimSpace(values[0]) {
+				return fmt.Errorf("conflicting Content-Length headers")
+			}
+		}
+		value := strings.TrimSpace(values[0])
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 0 || strings.TrimLeft(value, "0123456789") != "" {
+			return fmt.Errorf("invalid Content-Length %q", contentLength)
+		}
+		length = n
+	}
+	req.ContentLength = length
+	if length == 0 {
+		return nil
+	}
+	body := &bodyReader{
+		src: &connReader{conn: conn, remaining: remaining, deadline: transferDeadline{
+			grace:     durationOr(s.ReadHeaderTimeout, RECIEVE_TIMEOUT),
+			minRate:   s.MinReadRate,
+			streaming: s.MinReadRate == 0,
+		}},
+		left:    length,
+		chunked: length == -1,
+	}
+	if length == -1 {
+		body.left = 0
+	}
+	if req.ProtoAtLeast(1, 1) && strings.EqualFold(req.Headers["Expect"], "100-continue") {
+		body.sendContinue = func() error {
+			_, err := io.WriteString(conn, responseProto+" 100 Continue\r\n\r\n")
+			return err
+		}
+	}
+	req.Body = body
+	return nil
+}
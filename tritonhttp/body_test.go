@@ -0,0 +1,44 @@
+package tritonhttp
+
+import (
+	"io/fs"
+	"regexp"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestRequestBody(t *testing.T) {
+	s := &Server{
+		VirtualHosts: map[string]fs.FS{
+			"site": fstest.MapFS{"index.html": {Data: []byte("index")}},
+		},
+	}
+	port := launchserver(t, s)
+
+	// Static virtual hosts only serve GET, but the body of other requests
+	// is skipped and the connection kept
+	conn := dialfrom(t, "127.0.0.1", port)
+	if _, err := conn.Write([]byte("POST / HTTP/1.1\r\nHost: site\r\nContent-Length: 11\r\n\r\nGET / HTTP/" +
+		"DELETE / HTTP/1.1\r\nHost: site\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n" +
+		"GET / HTTP/1.1\r\nHost: site\r\nConnection: close\r\n\r\n")); err != nil {
+		t.Fatal(err.Error())
+	}
+	// Error responses have no Content-Length, so look at the status lines
+	statusLines := regexp.MustCompile(`HTTP/1\.1 (\d+)`).FindAllStringSubmatch(string(readuntilclosed(t, conn, 5*time.Second)), -1)
+	if len(statusLines) != 3 || statusLines[0][1] != "400" || statusLines[1][1] != "400" || statusLines[2][1] != "200" {
+		t.Fatalf("Expected 400, 400 and 200 but got %v\n", statusLines)
+	}
+
+	// Bodies whose end can't be found close the connection
+	for _, req := range []string{
+		"POST / HTTP/1.1\r\nHost: site\r\nContent-Length: 1\r\nTransfer-Encoding: chunked\r\n\r\n",
+		"POST / HTTP/1.1\r\nHost: site\r\nContent-Length: -1\r\n\r\n",
+		"POST / HTTP/1.1\r\nHost: site\r\nTransfer-Encoding: gzip\r\n\r\n",
+	} {
+		resp := requestfrom(t, "127.0.0.1", port, req)
+		if resp.StatusCode != 400 || !resp.Close {
+			t.Fatalf("Expected 400 and a closed connection for %q but got %v\n", req, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package tritonhttp
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CacheRuleConfig sets the caching headers of the static files it matches.
+// Path is a glob matched against the file name, e.g. "*.png", or, if it
+// contains a slash, against the whole path, e.g. "/assets/*/*.js"; a Path
+// ending in a slash covers everything below it. Type matches the MIME
+// type, e.g. "text/html" or "image/*". A rule with both needs both to
+// match.
+//
+// CacheControl is sent as the Cache-Control header, and Expires follows
+// from its max-age, or is set to the response date for "no-cache" and
+// "no-store". Vary lists request headers the response depends on, e.g.
+// when a CDN in front compresses it.
+type CacheRuleConfig struct {
+	Path         string   `yaml:"path"`
+	Type         string   `yaml:"type"`
+	CacheControl string   `yaml:"cacheControl"`
+	Vary         []string `yaml:"vary"`
+}
+
+// cacheRule is the parsed form of a CacheRuleConfig
+type cacheRule struct {
+	path         string
+	mimeType     string
+	cacheControl string
+	vary         []string
+	// maxAge is the max-age of cacheControl in seconds, or -1 without one
+	maxAge int64
+	// expired is set when cacheControl forbids using a stored copy
+	// without checking back first
+	expired bool
+}
+
+// Method which checks cc and builds its rule
+func (cc *CacheRuleConfig) parse() (*cacheRule, error) {
+	rule := &cacheRule{path: cc.Path, mimeType: strings.ToLower(cc.Type), cacheControl: cc.CacheControl, maxAge: -1}
+	if len(cc.Path) == 0 && len(cc.Type) == 0 {
+		return nil, fmt.Errorf("rule needs a path or a type")
+	}
+	if _, err := path.Match(cc.Path, ""); err != nil {
+		return nil, fmt.Errorf("invalid path pattern %q", cc.Path)
+	}
+	if major, minor, ok := strings.Cut(rule.mimeType, "/"); len(cc.Type) > 0 && (!ok || len(major) == 0 || len(minor) == 0) {
+		return nil, fmt.Errorf("type %q is not a MIME type such as text/html or image/*", cc.Type)
+	}
+	if len(cc.CacheControl) == 0 && len(cc.Vary) == 0 {
+		return nil, fmt.Errorf("rule sets neither cacheControl nor vary")
+	}
+	if strings.ContainsAny(cc.CacheControl, "\r\n") {
+		return nil, fmt.Errorf("cacheControl may not contain line breaks")
+	}
+	for _, directive := range strings.Split(cc.CacheControl, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "max-age":
+			maxAge, err := strconv.ParseInt(strings.Trim(value, `"`), 10, 64)
+			if err != nil || maxAge < 0 {
+				return nil, fmt.Errorf("invalid max-age in %q", cc.CacheControl)
+			}
+			rule.maxAge = maxAge
+		case "no-cache", "no-store":
+			rule.expired = true
+		}
+	}
+	for _, header := range cc.Vary {
+		if len(header) == 0 || strings.ContainsAny(header, " ,:\r\n") {
+			return nil, fmt.Errorf("invalid vary header %q", header)
+		}
+		rule.vary = append(rule.vary, CanonicalHeaderKey(header))
+	}
+	return rule, nil
+}
+
+// Method which reports whether rule covers the file filePath, rooted at
+// the docroot, served as contentType
+func (rule *cacheRule) matches(filePath string, contentType string) bool {
+	if len(rule.path) > 0 {
+		switch {
+		case strings.HasSuffix(rule.path, "/"):
+			if !strings.HasPrefix(filePath, rule.path) {
+				return false
+			}
+		case strings.Contains(rule.path, "/"):
+			if matched, _ := path.Match(rule.path, filePath); !matched {
+				return false
+			}
+		default:
+			if matched, _ := path.Match(rule.path, path.Base(filePath)); !matched {
+				return false
+			}
+		}
+	}
+	if len(rule.mimeType) > 0 {
+		mimeType, _, _ := strings.Cut(contentType, ";")
+		mimeType = strings.ToLower(strings.TrimSpace(mimeType))
+		if major, minor, _ := strings.Cut(rule.mimeType, "/"); minor == "*" {
+			return strings.HasPrefix(mimeType, major+"/")
+		}
+		return mimeType == rule.mimeType
+	}
+	return true
+}
+
+// Method which sets the caching headers of the static file response res
+// from the first cache rule in options matching it
+func (s *Server) applyCacheRules(options *virtualHostOptions, res *Response) {
+	filePath := "/" + res.FilePath
+	for _, rule := range options.cacheRules {
+		if !rule.matches(filePath, res.Headers["Content-Type"]) {
+			continue
+		}
+		if len(rule.cacheControl) > 0 {
+			res.Headers["Cache-Control"] = rule.cacheControl
+			date, err := time.Parse(time.RFC1123, res.Headers["Date"])
+			if err != nil {
+				date = time.Now()
+			}
+			switch {
+			case rule.maxAge >= 0:
+				res.Headers["Expires"] = FormatTime(date.Add(time.Duration(rule.maxAge) * time.Second))
+			case rule.expired:
+				res.Headers["Expires"] = FormatTime(date)
+			default:
+				delete(res.Headers, "Expires")
+			}
+		}
+		for _, header := range rule.vary {
+			if !hasToken(res.Headers["Vary"], header) {
+				res.Headers["Vary"] = appendList(res.Headers["Vary"], header)
+			}
+		}
+		return
+	}
+}
@@ -0,0 +1,135 @@
+package tritonhttp
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCacheRules(t *testing.T) {
+	tmp := t.TempDir()
+	for name, data := range map[string]string{
+		"site/index.html":         "index",
+		"site/logo.png":           "png",
+		"site/photo.jpg":          "jpg",
+		"site/assets/v1/app.js":   "js",
+		"site/downloads/file.txt": "txt",
+		"site/notes.txt":          "notes",
+		"site/style.css":          "css",
+		"app/index.html":          "<app>",
+	} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(tmp, name)), 0755); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := os.WriteFile(filepath.Join(tmp, name), []byte(data), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	config := filepath.Join(tmp, "virtual_hosts.yaml")
+	write := func(yaml string) {
+		if err := os.WriteFile(config, []byte(yaml), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	write(`virtual_hosts:
+  - hostName: "site"
+    docRoot: "site"
+    cache:
+      - path: "*.png"
+        cacheControl: "public, max-age=31536000, immutable"
+      - path: "*.html"
+        cacheControl: "no-cache"
+      - path: "/assets/*/*.js"
+        cacheControl: "public, max-age=600"
+        vary: ["accept-encoding"]
+      - path: "/downloads/"
+        cacheControl: "private"
+      - type: "image/*"
+        cacheControl: "max-age=60"
+      - type: "text/css"
+        vary: ["Accept-Encoding"]
+  - hostName: "app"
+    docRoot: "app"
+    spaFallback: true
+    cache:
+      - path: "/index.html"
+        cacheControl: "no-store"
+`)
+	c, err := LoadConfig(config, tmp)
+	if err != nil {
+		t.Fatalf("Expected config to be valid but got %v\n", err)
+	}
+	s := &Server{}
+	if err := s.ApplyConfig(c); err != nil {
+		t.Fatal(err.Error())
+	}
+	port := launchserver(t, s)
+
+	tests := []struct {
+		host         string
+		target       string
+		cacheControl string
+		// maxAge is how far Expires is ahead of Date, or -1 without Expires
+		maxAge time.Duration
+		vary   string
+	}{
+		{"site", "/logo.png", "public, max-age=31536000, immutable", 31536000 * time.Second, ""},
+		{"site", "/", "no-cache", 0, ""},
+		{"site", "/index.html", "no-cache", 0, ""},
+		{"site", "/assets/v1/app.js", "public, max-age=600", 600 * time.Second, "Accept-Encoding"},
+		{"site", "/downloads/file.txt", "private", -1, ""},
+		{"site", "/photo.jpg", "max-age=60", time.Minute, ""},
+		{"site", "/style.css", "", -1, "Accept-Encoding"},
+		{"site", "/notes.txt", "", -1, ""},
+		// Rules override the default of single-page applications, for
+		// files and the fallback alike
+		{"app", "/", "no-store", 0, ""},
+		{"app", "/users/42", "no-store", 0, ""},
+	}
+	for _, tt := range tests {
+		resp := requestfrom(t, "127.0.0.1", port, "GET "+tt.target+" HTTP/1.1\r\nHost: "+tt.host+"\r\nConnection: close\r\n\r\n")
+		if resp.StatusCode != 200 || resp.Header.Get("Cache-Control") != tt.cacheControl || resp.Header.Get("Vary") != tt.vary {
+			t.Fatalf("Expected 200 with Cache-Control %q and Vary %q for %v%v but got %v %v\n",
+				tt.cacheControl, tt.vary, tt.host, tt.target, resp.StatusCode, resp.Header)
+		}
+		if tt.maxAge < 0 {
+			if len(resp.Header.Values("Expires")) > 0 {
+				t.Fatalf("Expected no Expires for %v%v but got %v\n", tt.host, tt.target, resp.Header)
+			}
+			continue
+		}
+		date, err := http.ParseTime(resp.Header.Get("Date"))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		expires, err := http.ParseTime(resp.Header.Get("Expires"))
+		if err != nil || expires.Sub(date) != tt.maxAge {
+			t.Fatalf("Expected Expires %v after Date for %v%v but got %v\n", tt.maxAge, tt.host, tt.target, resp.Header)
+		}
+	}
+
+	write(`virtual_hosts:
+  - hostName: "site"
+    docRoot: "site"
+    cache:
+      - cacheControl: "no-cache"
+      - path: "[.png"
+        cacheControl: "no-cache"
+      - type: "image"
+        cacheControl: "no-cache"
+      - path: "*.js"
+        cacheControl: "max-age=soon"
+      - path: "*.css"
+  - hostName: "proxied"
+    upstream: "127.0.0.1:1"
+    cache:
+      - path: "*.png"
+        cacheControl: "no-cache"
+`)
+	_, err = LoadConfig(config, tmp)
+	if configErr, ok := err.(*ConfigError); !ok || len(configErr.Errors) != 6 {
+		t.Fatalf("Expected six invalid cache rules to be reported but got %v\n", err)
+	}
+}
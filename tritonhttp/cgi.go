@@ -0,0 +1,396 @@
+package tritonhttp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// DEFAULT_CGI_TIMEOUT is how long a CGI script may run when cgiTimeout
+	// isn't set
+	DEFAULT_CGI_TIMEOUT time.Duration = 30 * time.Second
+	// MAX_CGI_BODY_BYTES limits the request body passed to a CGI script,
+	// which is read in full first so that CONTENT_LENGTH is always known
+	MAX_CGI_BODY_BYTES = 10 << 20
+	// MAX_CGI_REDIRECTS limits how often local redirects of CGI scripts
+	// are followed for a single request
+	MAX_CGI_REDIRECTS = 10
+	// Largest header section accepted from a CGI script
+	maxCGIHeaderBytes = 64 * 1024
+	serverSoftware    = "tritonhttpd"
+)
+
+// cgiHandler runs the scripts in the CGI directory of a virtual host as
+// described by RFC 3875
+type cgiHandler struct {
+	// prefix is the URL path of the CGI directory, e.g. "/cgi-bin"
+	prefix string
+	// dir is the CGI directory and docRoot the docroot it is in
+	dir     string
+	docRoot string
+	timeout time.Duration
+}
+
+// Method which finds the script serving reqPath, if reqPath is inside the
+// CGI directory. The script is the first existing file along reqPath and
+// the rest of reqPath is the PATH_INFO. found is false when reqPath isn't
+// in the CGI directory at all.
+func (h *cgiHandler) lookup(reqPath string) (script string, scriptName string, pathInfo string, found bool, err error) {
+	reqPath = cleanPath(reqPath)
+	if !pathHasPrefix(reqPath, h.prefix) {
+		return "", "", "", false, nil
+	}
+	rest := strings.TrimPrefix(reqPath, strings.TrimSuffix(h.prefix, "/"))
+	segments := strings.Split(strings.TrimPrefix(rest, "/"), "/")
+	script = h.dir
+	scriptName = strings.TrimSuffix(h.prefix, "/")
+	for i, segment := range segments {
+		if len(segment) == 0 {
+			break
+		}
+		script = filepath.Join(script, segment)
+		scriptName += "/" + segment
+		// Symlinks aren't followed so scripts can't come from outside the
+		// CGI directory
+		info, err := os.Lstat(script)
+		if err != nil {
+			return "", "", "", true, os.ErrNotExist
+		}
+		if info.IsDir() {
+			continue
+		}
+		if !info.Mode().IsRegular() {
+			return "", "", "", true, os.ErrNotExist
+		}
+		if info.Mode()&0111 == 0 {
+			return "", "", "", true, os.ErrPermission
+		}
+		if len(segments) > i+1 {
+			pathInfo = "/" + strings.Join(segments[i+1:], "/")
+		}
+		return script, scriptName, pathInfo, true, nil
+	}
+	// Directories aren't scripts
+	return "", "", "", true, os.ErrNotExist
+}
+
+// Method which runs the script serving req if req is for the CGI directory
+// in options. It returns nil for other requests.
+func (s *Server) serveCGI(options *virtualHostOptions, req *Request) *Response {
+	h := options.cgi
+	if h == nil {
+		return nil
+	}
+	script, scriptName, pathInfo, found, err := h.lookup(req.Path)
+	if !found {
+		return nil
+	}
+	res := &Response{}
+	switch {
+	case err == nil && isDotfile(strings.TrimPrefix(scriptName, "/")):
+		res.HandleStatusNotFound()
+	case err == os.ErrPermission:
+		res.HandleForbidden()
+	case err != nil:
+		res.HandleStatusNotFound()
+	default:
+		return s.runCGI(h, req, script, scriptName, pathInfo)
+	}
+	if req.Close {
+		res.Headers[CONNECTION] = CLOSE
+	}
+	return res
+}
+
+// Method which runs script for req and turns its output into the
+// response. Scripts that fail before writing their headers answer 500,
+// and ones that time out 504.
+func (s *Server) runCGI(h *cgiHandler, req *Request, script string, scriptName string, pathInfo string) *Response {
+	res := &Response{}
+	fail := func(handle func()) *Response {
+		handle()
+		if req.Close {
+			res.Headers[CONNECTION] = CLOSE
+		}
+		return res
+	}
+
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(io.LimitReader(req.Body, MAX_CGI_BODY_BYTES+1))
+		if err != nil {
+			req.Close = true
+			return fail(res.HandleBadRequest)
+		}
+		if len(body) > MAX_CGI_BODY_BYTES {
+			req.Close = true
+			return fail(res.HandleRequestEntityTooLarge)
+		}
+	}
+
+	cmd := exec.Command(script)
+	cmd.Dir = filepath.Dir(script)
+	cmd.Env = append(cgiEnviron(req, h.docRoot, scriptName, script, pathInfo, int64(len(body))), "PATH="+os.Getenv("PATH"))
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Stderr = &cgiLogger{script: script}
+	// The script runs in a process group of its own, so that the processes
+	// it started are killed with it and don't keep its output open
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fail(res.HandleInternalServerError)
+	}
+	if err := cmd.Start(); err != nil {
+		log.Printf("Could not start CGI script %v: %v", script, err)
+		return fail(res.HandleInternalServerError)
+	}
+	kill := func() {
+		_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	go func() {
+		<-ctx.Done()
+		if ctx.Err() == context.DeadlineExceeded {
+			kill()
+		}
+	}()
+	finish := func() {
+		_ = cmd.Wait()
+		cancel()
+	}
+
+	br := bufio.NewReader(io.LimitReader(stdout, maxCGIHeaderBytes))
+	headers, err := readCGIHeaders(br)
+	if err != nil {
+		timedOut := ctx.Err() != nil
+		kill()
+		finish()
+		if timedOut {
+			log.Printf("CGI script %v timed out after %v", script, h.timeout)
+			return fail(res.HandleGatewayTimeout)
+		}
+		log.Printf("Malformed headers from CGI script %v: %v", script, err)
+		return fail(res.HandleInternalServerError)
+	}
+
+	// A local redirect is served as if the new URL had been requested
+	if location := headers["Location"]; strings.HasPrefix(location, "/") && len(headers["Status"]) == 0 {
+		kill()
+		finish()
+		return s.redirectCGI(req, location)
+	}
+
+	if err := fillCGIResponse(res, req, headers); err != nil {
+		kill()
+		finish()
+		log.Printf("Invalid response from CGI script %v: %v", script, err)
+		return fail(res.HandleInternalServerError)
+	}
+
+	// The body is whatever the script writes after its headers, which is
+	// no longer limited in size
+	out := io.MultiReader(br, stdout)
+	if !hasResponseBody(req.Method, res.StatusCode) {
+		_, _ = io.Copy(io.Discard, out)
+		finish()
+	} else {
+		res.Body = out
+		res.done = func(err error) {
+			if err != nil {
+				kill()
+			}
+			finish()
+		}
+	}
+	return res
+}
+
+// Method which turns the headers of a CGI response into res: the Status
+// header sets the status, a Location without Status redirects with 302 and
+// the other headers are passed on. Bodies without a Content-Length are
+// chunked for HTTP/1.1 clients and delimited by closing the connection for
+// HTTP/1.0 ones.
+func fillCGIResponse(res *Response, req *Request, headers map[string]string) error {
+	res.AddProto(responseProto)
+	res.StatusCode = statusOK
+	if status, ok := headers["Status"]; ok {
+		code, text, _ := strings.Cut(strings.TrimSpace(status), " ")
+		statusCode, err := strconv.Atoi(code)
+		if err != nil || statusCode < 100 || statusCode > 999 {
+			return fmt.Errorf("invalid Status %q", status)
+		}
+		res.StatusCode = statusCode
+		res.StatusText = strings.TrimSpace(text)
+		delete(headers, "Status")
+	} else if _, ok := headers["Location"]; ok {
+		res.StatusCode = statusFound
+	}
+	res.Headers = headers
+	removeHopByHopHeaders(res.Headers)
+	if len(res.Headers["Date"]) == 0 {
+		res.Headers["Date"] = FormatTime(time.Now())
+	}
+	if hasResponseBody(req.Method, res.StatusCode) {
+		if _, err := strconv.ParseInt(res.Headers["Content-Length"], 10, 64); err != nil {
+			delete(res.Headers, "Content-Length")
+			if req.ProtoAtLeast(1, 1) {
+				res.Headers["Transfer-Encoding"] = "chunked"
+			} else {
+				req.Close = true
+			}
+		}
+	}
+	if req.Close {
+		res.Headers[CONNECTION] = CLOSE
+	}
+	return nil
+}
+
+// Method which serves location instead of req, as asked for by a local
+// redirect of a CGI script
+func (s *Server) redirectCGI(req *Request, location string) *Response {
+	res := &Response{}
+	redirected := *req
+	redirected.Method = GET
+	redirected.URL = location
+	redirected.Path, redirected.RawQuery, redirected.Fragment = "", "", ""
+	redirected.Body = nil
+	redirected.ContentLength = 0
+	redirected.rewritten = false
+	redirected.cgiRedirects++
+	if redirected.cgiRedirects > MAX_CGI_REDIRECTS {
+		log.Printf("Too many local redirects from CGI scripts for %v", req.URL)
+		res.HandleInternalServerError()
+	} else if err := redirected.ParseTarget(s.EncodedSlashes); err != nil {
+		log.Printf("Invalid local redirect %q from CGI script: %v", location, err)
+		res.HandleInternalServerError()
+	} else {
+		res = s.HandleGoodRequest(&redirected)
+		req.Close = redirected.Close
+		return res
+	}
+	if req.Close {
+		res.Headers[CONNECTION] = CLOSE
+	}
+	return res
+}
+
+// Method which returns the environment of a CGI script run for req,
+// whose body is contentLength bytes long
+func cgiEnviron(req *Request, docRoot string, scriptName string, scriptFilename string, pathInfo string, contentLength int64) []string {
+	env := []string{
+		"GATEWAY_INTERFACE=CGI/1.1",
+		"SERVER_SOFTWARE=" + serverSoftware,
+		"SERVER_PROTOCOL=" + req.Proto,
+		"REQUEST_METHOD=" + req.Method,
+		"REQUEST_URI=" + req.URL,
+		"QUERY_STRING=" + req.RawQuery,
+		"SCRIPT_NAME=" + scriptName,
+		"SCRIPT_FILENAME=" + scriptFilename,
+		"PATH_INFO=" + pathInfo,
+		"DOCUMENT_ROOT=" + docRoot,
+	}
+	if len(pathInfo) > 0 {
+		env = append(env, "PATH_TRANSLATED="+filepath.Join(docRoot, filepath.FromSlash(path.Clean(pathInfo))))
+	}
+	serverName, serverPort := NormalizeHost(req.Host), ""
+	if _, port, err := net.SplitHostPort(req.LocalAddr); err == nil {
+		serverPort = port
+	}
+	if len(serverName) == 0 {
+		serverName, _, _ = net.SplitHostPort(req.LocalAddr)
+	}
+	env = append(env, "SERVER_NAME="+serverName, "SERVER_PORT="+serverPort)
+	if host, port, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		env = append(env, "REMOTE_ADDR="+host, "REMOTE_HOST="+host, "REMOTE_PORT="+port)
+	}
+	if len(req.User) > 0 {
+		scheme, _, _ := strings.Cut(req.Headers["Authorization"], " ")
+		env = append(env, "AUTH_TYPE="+scheme, "REMOTE_USER="+req.User)
+	}
+	if req.Body != nil {
+		env = append(env, "CONTENT_LENGTH="+strconv.FormatInt(contentLength, 10))
+	}
+	for key, value := range req.Headers {
+		switch key {
+		case "Content-Type":
+			env = append(env, "CONTENT_TYPE="+value)
+		case "Content-Length", "Authorization", "Proxy-Authorization", CONNECTION:
+			// Passed as CONTENT_LENGTH, kept from the script, or hop-by-hop
+		case "Proxy":
+			// HTTP_PROXY would send the script's own requests through a
+			// proxy of the client's choosing (httpoxy, CVE-2016-5385)
+		default:
+			// "X_Foo" would otherwise end up in the same variable as "X-Foo"
+			if strings.Contains(key, "_") {
+				continue
+			}
+			env = append(env, "HTTP_"+strings.ToUpper(strings.ReplaceAll(key, "-", "_"))+"="+value)
+		}
+	}
+	return env
+}
+
+// Method which reads the header section of a CGI script's output. Lines
+// may end in LF or CRLF. Repeated headers are combined, with Set-Cookie
+// kept one per line.
+func readCGIHeaders(br *bufio.Reader) (map[string]string, error) {
+	headers := make(map[string]string)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("end of output before the end of the headers: %w", err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if len(line) == 0 {
+			break
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok || len(key) == 0 || strings.ContainsAny(key, " \t") {
+			return nil, fmt.Errorf("malformed header line %q", line)
+		}
+		key, value = CanonicalHeaderKey(key), strings.TrimSpace(value)
+		if existing, exists := headers[key]; exists {
+			separator := ", "
+			if key == "Set-Cookie" {
+				separator = "\n"
+			}
+			value = existing + separator + value
+		}
+		headers[key] = value
+	}
+	if _, hasType := headers["Content-Type"]; !hasType {
+		if _, hasLocation := headers["Location"]; !hasLocation {
+			if _, hasStatus := headers["Status"]; !hasStatus {
+				return nil, fmt.Errorf("no Content-Type, Location or Status header")
+			}
+		}
+	}
+	return headers, nil
+}
+
+// cgiLogger writes what a CGI script prints on stderr to the log
+type cgiLogger struct {
+	script string
+}
+
+func (l *cgiLogger) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		log.Printf("CGI %v: %s", l.script, line)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,132 @@
+package tritonhttp
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCGI(t *testing.T) {
+	tmp := t.TempDir()
+	scripts := map[string]string{
+		"env.sh": `#!/bin/sh
+printf 'Content-Type: text/plain\r\nX-Script: env\r\n\r\n'
+for name in GATEWAY_INTERFACE REQUEST_METHOD QUERY_STRING SCRIPT_NAME PATH_INFO CONTENT_LENGTH CONTENT_TYPE REMOTE_ADDR SERVER_NAME SERVER_PROTOCOL HTTP_X_CUSTOM HTTP_AUTHORIZATION HTTP_PROXY HTTP_X_FOO; do
+  eval "echo $name=\$$name"
+done
+echo "BODY=$(cat)"
+`,
+		"status.sh":   "#!/bin/sh\nprintf 'Status: 418 Short and Stout\\nContent-Type: text/plain\\nSet-Cookie: a=1\\nSet-Cookie: b=2\\n\\nteapot'\n",
+		"redirect.sh": "#!/bin/sh\nprintf 'Location: http://example.com/moved\\n\\n'\n",
+		"local.sh":    "#!/bin/sh\nprintf 'Location: /index.html\\n\\n'\n",
+		"loop.sh":     "#!/bin/sh\nprintf 'Location: /cgi-bin/loop.sh\\n\\n'\n",
+		"broken.sh":   "#!/bin/sh\necho 'no headers here'\n",
+		"slow.sh":     "#!/bin/sh\nsleep 5\n",
+	}
+	if err := os.MkdirAll(filepath.Join(tmp, "site", "cgi-bin"), 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+	for name, script := range scripts {
+		if err := os.WriteFile(filepath.Join(tmp, "site", "cgi-bin", name), []byte(script), 0755); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	for name, data := range map[string]string{"index.html": "index", "cgi-bin/plain.sh": "#!/bin/sh\n"} {
+		if err := os.WriteFile(filepath.Join(tmp, "site", name), []byte(data), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	config := filepath.Join(tmp, "virtual_hosts.yaml")
+	if err := os.WriteFile(config, []byte(`virtual_hosts:
+  - hostName: "site"
+    docRoot: "site"
+    cgiDir: "cgi-bin"
+    cgiTimeout: 300ms
+`), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	c, err := LoadConfig(config, tmp)
+	if err != nil {
+		t.Fatalf("Expected config to be valid but got %v\n", err)
+	}
+	s := &Server{}
+	if err := s.ApplyConfig(c); err != nil {
+		t.Fatal(err.Error())
+	}
+	port := launchserver(t, s)
+	request := func(req string) (*http.Response, string) {
+		t.Helper()
+		resp := requestfrom(t, "127.0.0.1", port, req)
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	// The script gets the standard environment and the body on stdin
+	resp, body := request("POST /cgi-bin/env.sh/extra/path?q=1&r=2 HTTP/1.1\r\nHost: site\r\nConnection: close\r\n" +
+		"X-Custom: yes\r\nAuthorization: Basic secret\r\nProxy: http://evil.example:8080\r\nX-Foo: dash\r\nX_Foo: underscore\r\nContent-Type: text/plain\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"5\r\nhello\r\n0\r\n\r\n")
+	if resp.StatusCode != 200 || resp.Header.Get("X-Script") != "env" || resp.Header.Get("Content-Type") != "text/plain" {
+		t.Fatalf("Expected the script's headers but got %v %v\n", resp.StatusCode, resp.Header)
+	}
+	for _, line := range []string{
+		"GATEWAY_INTERFACE=CGI/1.1",
+		"REQUEST_METHOD=POST",
+		"QUERY_STRING=q=1&r=2",
+		"SCRIPT_NAME=/cgi-bin/env.sh",
+		"PATH_INFO=/extra/path",
+		"CONTENT_LENGTH=5",
+		"CONTENT_TYPE=text/plain",
+		"REMOTE_ADDR=127.0.0.1",
+		"SERVER_NAME=site",
+		"SERVER_PROTOCOL=HTTP/1.1",
+		"HTTP_X_CUSTOM=yes",
+		"HTTP_AUTHORIZATION=\n",
+		// No httpoxy, and underscores can't stand in for dashes
+		"HTTP_PROXY=\n",
+		"HTTP_X_FOO=dash\n",
+		"BODY=hello",
+	} {
+		if !strings.Contains(body, line) {
+			t.Fatalf("Expected %q in the script output but got:\n%v\n", line, body)
+		}
+	}
+
+	// Status and repeated headers are taken from the script
+	resp, body = request("GET /cgi-bin/status.sh HTTP/1.1\r\nHost: site\r\nConnection: close\r\n\r\n")
+	if resp.Status != "418 Short and Stout" || body != "teapot" || len(resp.Header.Values("Set-Cookie")) != 2 {
+		t.Fatalf("Expected the script's status and cookies but got %v %q %v\n", resp.Status, body, resp.Header)
+	}
+
+	// Redirects: absolute ones go to the client, local ones are served
+	resp, _ = request("GET /cgi-bin/redirect.sh HTTP/1.1\r\nHost: site\r\nConnection: close\r\n\r\n")
+	if resp.StatusCode != 302 || resp.Header.Get("Location") != "http://example.com/moved" {
+		t.Fatalf("Expected a 302 redirect but got %v %v\n", resp.StatusCode, resp.Header)
+	}
+	resp, body = request("GET /cgi-bin/local.sh HTTP/1.1\r\nHost: site\r\nConnection: close\r\n\r\n")
+	if resp.StatusCode != 200 || body != "index" {
+		t.Fatalf("Expected the local redirect to serve index.html but got %v %q\n", resp.StatusCode, body)
+	}
+
+	tests := []struct {
+		path       string
+		statusCode int
+	}{
+		{"/cgi-bin/loop.sh", 500},
+		{"/cgi-bin/broken.sh", 500},
+		{"/cgi-bin/slow.sh", 504},
+		{"/cgi-bin/plain.sh", 403},
+		{"/cgi-bin/missing.sh", 404},
+		{"/cgi-bin/", 404},
+		// Outside the CGI directory files are served as usual
+		{"/index.html", 200},
+	}
+	for _, tt := range tests {
+		resp, _ := request("GET " + tt.path + " HTTP/1.1\r\nHost: site\r\nConnection: close\r\n\r\n")
+		if resp.StatusCode != tt.statusCode {
+			t.Fatalf("Expected response code of %v for %v but got %v\n", tt.statusCode, tt.path, resp.StatusCode)
+		}
+	}
+}
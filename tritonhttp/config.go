@@ -0,0 +1,571 @@
+package tritonhttp
+
+import (
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the typed form of the virtual hosting config file
+type Config struct {
+	VirtualHosts []VirtualHostConfig `yaml:"virtual_hosts"`
+
+	// Server holds server-wide settings. They are only read at startup,
+	// reloading the config doesn't change them.
+	Server ServerConfig `yaml:"server"`
+
+	// DocRootDir is the directory docRoot paths are relative to
+	DocRootDir string `yaml:"-"`
+}
+
+// VirtualHostConfig is a single entry of the virtual_hosts list
+type VirtualHostConfig struct {
+	HostName       string   `yaml:"hostName"`
+	Aliases        []string `yaml:"aliases"`
+	Default        bool     `yaml:"default"`
+	DocRoot        string   `yaml:"docRoot"`
+	FollowSymlinks bool     `yaml:"followSymlinks"`
+
+	// SPAFallback answers requests for missing paths without a file
+	// extension with the index.html of DocRoot, for single-page
+	// applications that route on the client
+	SPAFallback bool `yaml:"spaFallback"`
+
+	// Cache sets the caching headers of the files served from DocRoot,
+	// from the first rule matching each
+	Cache []CacheRuleConfig `yaml:"cache"`
+
+	// Upstream is the "host:port" of a server requests are forwarded to,
+	// instead of serving them from DocRoot. UpstreamTimeout limits how
+	// long it may take to answer, and to send each part of the body.
+	Upstream        string        `yaml:"upstream"`
+	UpstreamTimeout time.Duration `yaml:"upstreamTimeout"`
+
+	// Upstreams lists several servers to spread requests over instead of
+	// a single Upstream, according to LoadBalancing: "round-robin" (the
+	// default), "least-conn", "ip-hash" or "path-hash". An upstream failing
+	// MaxFails requests in a row is ejected for FailTimeout.
+	Upstreams     []string           `yaml:"upstreams"`
+	LoadBalancing string             `yaml:"loadBalancing"`
+	MaxFails      int                `yaml:"maxFails"`
+	FailTimeout   time.Duration      `yaml:"failTimeout"`
+	HealthCheck   *HealthCheckConfig `yaml:"healthCheck"`
+
+	// CGIDir is a directory inside DocRoot, e.g. "cgi-bin", whose
+	// executable files are run as CGI scripts rather than served. A script
+	// running longer than CGITimeout is killed.
+	CGIDir     string        `yaml:"cgiDir"`
+	CGITimeout time.Duration `yaml:"cgiTimeout"`
+
+	// FastCGI lists the paths whose requests are sent to FastCGI backends
+	// rather than served from DocRoot
+	FastCGI []FastCGIConfig `yaml:"fastcgi"`
+
+	// AccessLog is the file this virtual host's access log entries are
+	// written to instead of the server-wide access log
+	AccessLog string `yaml:"accessLog"`
+
+	// RateLimit, if set, limits how many requests a single client may
+	// send to this virtual host
+	RateLimit *RateLimitConfig `yaml:"rateLimit"`
+
+	// Access lists allow and deny rules for client IPs, evaluated in
+	// order before anything is looked up in the docroot
+	Access []AccessRuleConfig `yaml:"access"`
+
+	// Auth lists the paths that need a user name and password
+	Auth []AuthConfig `yaml:"auth"`
+
+	// Rewrites lists rules redirecting or internally rewriting request
+	// paths, evaluated in order before anything else
+	Rewrites []RewriteConfig `yaml:"rewrites"`
+}
+
+// HealthCheckConfig makes the server request Path from every upstream
+// each Interval. Upstreams that don't answer with 2xx or 3xx get no
+// requests until they do.
+type HealthCheckConfig struct {
+	Path     string        `yaml:"path"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+// RateLimitConfig configures the token bucket of every client of a
+// virtual host: it holds up to Burst requests and refills at
+// RequestsPerSecond. Burst defaults to one request.
+type RateLimitConfig struct {
+	RequestsPerSecond float64 `yaml:"requestsPerSecond"`
+	Burst             int     `yaml:"burst"`
+}
+
+// ServerConfig is the server section of the config file. Zero values keep
+// the server's defaults.
+type ServerConfig struct {
+	ReadHeaderTimeout  time.Duration `yaml:"readHeaderTimeout"`
+	IdleTimeout        time.Duration `yaml:"idleTimeout"`
+	WriteTimeout       time.Duration `yaml:"writeTimeout"`
+	MinWriteRate       int           `yaml:"minWriteRate"`
+	MinReadRate        int           `yaml:"minReadRate"`
+	MaxRequestsPerConn int           `yaml:"maxRequestsPerConn"`
+	MaxHeaderBytes     int           `yaml:"maxHeaderBytes"`
+	MaxConns           int           `yaml:"maxConns"`
+	MaxConnsPerIP      int           `yaml:"maxConnsPerIP"`
+	RetryAfter         time.Duration `yaml:"retryAfter"`
+
+	// TrustedProxies lists the CIDR ranges of proxies whose
+	// X-Forwarded-For header is trusted
+	TrustedProxies []string `yaml:"trustedProxies"`
+}
+
+// Apply copies the settings that are set onto s
+func (sc *ServerConfig) Apply(s *Server) {
+	if sc.ReadHeaderTimeout > 0 {
+		s.ReadHeaderTimeout = sc.ReadHeaderTimeout
+	}
+	if sc.IdleTimeout > 0 {
+		s.IdleTimeout = sc.IdleTimeout
+	}
+	if sc.WriteTimeout > 0 {
+		s.WriteTimeout = sc.WriteTimeout
+	}
+	if sc.MinWriteRate > 0 {
+		s.MinWriteRate = sc.MinWriteRate
+	}
+	if sc.MinReadRate > 0 {
+		s.MinReadRate = sc.MinReadRate
+	}
+	if sc.MaxRequestsPerConn > 0 {
+		s.MaxRequestsPerConn = sc.MaxRequestsPerConn
+	}
+	if sc.MaxHeaderBytes > 0 {
+		s.MaxHeaderBytes = sc.MaxHeaderBytes
+	}
+	if sc.MaxConns > 0 {
+		s.MaxConns = sc.MaxConns
+	}
+	if sc.MaxConnsPerIP > 0 {
+		s.MaxConnsPerIP = sc.MaxConnsPerIP
+	}
+	if sc.RetryAfter > 0 {
+		s.RetryAfter = sc.RetryAfter
+	}
+	// Invalid ranges have been reported by Validate
+	if trusted, err := ParseCIDRs(sc.TrustedProxies); err == nil && len(trusted) > 0 {
+		s.TrustedProxies = trusted
+	}
+}
+
+// Method which reports negative settings
+func (sc *ServerConfig) validate() []error {
+	errs := make([]error, 0)
+	durations := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"readHeaderTimeout", sc.ReadHeaderTimeout},
+		{"idleTimeout", sc.IdleTimeout},
+		{"writeTimeout", sc.WriteTimeout},
+		{"retryAfter", sc.RetryAfter},
+	}
+	for _, d := range durations {
+		if d.value < 0 {
+			errs = append(errs, fmt.Errorf("server: %s must not be negative", d.name))
+		}
+	}
+	if sc.MinWriteRate < 0 {
+		errs = append(errs, fmt.Errorf("server: minWriteRate must not be negative"))
+	}
+	if sc.MinReadRate < 0 {
+		errs = append(errs, fmt.Errorf("server: minReadRate must not be negative"))
+	}
+	if sc.MaxRequestsPerConn < 0 {
+		errs = append(errs, fmt.Errorf("server: maxRequestsPerConn must not be negative"))
+	}
+	if sc.MaxHeaderBytes < 0 {
+		errs = append(errs, fmt.Errorf("server: maxHeaderBytes must not be negative"))
+	}
+	if sc.MaxConns < 0 {
+		errs = append(errs, fmt.Errorf("server: maxConns must not be negative"))
+	}
+	if sc.MaxConnsPerIP < 0 {
+		errs = append(errs, fmt.Errorf("server: maxConnsPerIP must not be negative"))
+	}
+	if _, err := ParseCIDRs(sc.TrustedProxies); err != nil {
+		errs = append(errs, fmt.Errorf("server: trustedProxies: %v", err))
+	}
+	return errs
+}
+
+// ConfigError lists every problem found in a config file
+type ConfigError struct {
+	Path   string
+	Errors []error
+}
+
+func (e *ConfigError) Error() string {
+	if len(e.Errors) == 1 {
+		return fmt.Sprintf("%s: %v", e.Path, e.Errors[0])
+	}
+	lines := make([]string, 0)
+	lines = append(lines, fmt.Sprintf("%s: %d problems:", e.Path, len(e.Errors)))
+	for _, err := range e.Errors {
+		lines = append(lines, fmt.Sprintf("  - %v", err))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Unwrap returns the individual problems
+func (e *ConfigError) Unwrap() []error {
+	return e.Errors
+}
+
+// LoadConfig reads and validates the virtual hosting config file at path.
+// Docroots are looked up relative to docrootDir. Keys the config schema
+// doesn't know about are rejected, and every problem found is reported
+// together in a *ConfigError.
+func LoadConfig(path string, docrootDir string) (*Config, error) {
+	f, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config file %s : %w", path, err)
+	}
+
+	config := &Config{DocRootDir: docrootDir}
+	if err := yaml.UnmarshalStrict(f, config); err != nil {
+		configErr := &ConfigError{Path: path}
+		if typeErr, ok := err.(*yaml.TypeError); ok {
+			for _, problem := range typeErr.Errors {
+				configErr.Errors = append(configErr.Errors, fmt.Errorf("%s", problem))
+			}
+		} else {
+			configErr.Errors = append(configErr.Errors, err)
+		}
+		return nil, configErr
+	}
+	if errs := config.Validate(); len(errs) > 0 {
+		return nil, &ConfigError{Path: path, Errors: errs}
+	}
+	return config, nil
+}
+
+// Validate checks the config for empty or duplicate host names, missing
+// docroots, more than one default virtual host and negative server
+// settings
+func (c *Config) Validate() []error {
+	errs := c.Server.validate()
+	if len(c.VirtualHosts) == 0 {
+		errs = append(errs, fmt.Errorf("no virtual hosts defined"))
+	}
+	// Maps every normalized host name to the virtual host defining it
+	seen := make(map[string]string)
+	defaultHost := ""
+	for i, vhost := range c.VirtualHosts {
+		name := vhost.HostName
+		if len(strings.TrimSpace(name)) == 0 {
+			errs = append(errs, fmt.Errorf("virtual host #%d: hostName is empty", i+1))
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		for _, host := range append([]string{vhost.HostName}, vhost.Aliases...) {
+			normalized := NormalizeHost(host)
+			if len(normalized) == 0 {
+				if host != vhost.HostName {
+					errs = append(errs, fmt.Errorf("virtual host %s: alias is empty", name))
+				}
+				continue
+			}
+			if other, exists := seen[normalized]; exists {
+				errs = append(errs, fmt.Errorf("virtual host %s: host name %q is already used by %s", name, host, other))
+				continue
+			}
+			seen[normalized] = name
+		}
+		if vhost.Default {
+			if len(defaultHost) > 0 {
+				errs = append(errs, fmt.Errorf("virtual host %s: %s is already the default", name, defaultHost))
+			}
+			defaultHost = name
+		}
+		if vhost.RateLimit != nil {
+			if vhost.RateLimit.RequestsPerSecond <= 0 {
+				errs = append(errs, fmt.Errorf("virtual host %s: rateLimit.requestsPerSecond must be positive", name))
+			}
+			if vhost.RateLimit.Burst < 0 {
+				errs = append(errs, fmt.Errorf("virtual host %s: rateLimit.burst must not be negative", name))
+			}
+		}
+		for _, rule := range vhost.Access {
+			if _, err := rule.parse(); err != nil {
+				errs = append(errs, fmt.Errorf("virtual host %s: access: %v", name, err))
+			}
+		}
+		for _, ac := range vhost.Auth {
+			if _, err := ac.load(c.DocRootDir, vhost.HostName); err != nil {
+				errs = append(errs, fmt.Errorf("virtual host %s: auth: %v", name, err))
+			}
+		}
+		for i, rc := range vhost.Rewrites {
+			if _, err := rc.parse(); err != nil {
+				errs = append(errs, fmt.Errorf("virtual host %s: rewrite rule %d: %v", name, i+1, err))
+			}
+		}
+		for i, cc := range vhost.Cache {
+			if _, err := cc.parse(); err != nil {
+				errs = append(errs, fmt.Errorf("virtual host %s: cache rule %d: %v", name, i+1, err))
+			}
+		}
+		if upstreamErrs := vhost.validateUpstreams(); len(vhost.upstreamAddrs()) > 0 || len(upstreamErrs) > 0 {
+			for _, err := range upstreamErrs {
+				errs = append(errs, fmt.Errorf("virtual host %s: %v", name, err))
+			}
+			if len(vhost.DocRoot) > 0 {
+				errs = append(errs, fmt.Errorf("virtual host %s: docRoot and upstream can't both be set", name))
+			}
+			if vhost.SPAFallback {
+				errs = append(errs, fmt.Errorf("virtual host %s: spaFallback needs a docRoot", name))
+			}
+			if len(vhost.Cache) > 0 {
+				errs = append(errs, fmt.Errorf("virtual host %s: cache rules need a docRoot", name))
+			}
+			continue
+		}
+		if len(vhost.DocRoot) == 0 {
+			errs = append(errs, fmt.Errorf("virtual host %s: docRoot is empty", name))
+			continue
+		}
+		docroot_path := filepath.Join(c.DocRootDir, vhost.DocRoot)
+		if _, err := os.Stat(docroot_path); err != nil {
+			errs = append(errs, fmt.Errorf("virtual host %s: path to docroot %s doesn't exist", name, docroot_path))
+		}
+		if vhost.SPAFallback {
+			if info, err := os.Stat(filepath.Join(docroot_path, "index.html")); err != nil || info.IsDir() {
+				errs = append(errs, fmt.Errorf("virtual host %s: spaFallback needs %s", name, filepath.Join(docroot_path, "index.html")))
+			}
+		}
+		if vhost.CGITimeout < 0 {
+			errs = append(errs, fmt.Errorf("virtual host %s: cgiTimeout must not be negative", name))
+		}
+		if len(vhost.CGIDir) > 0 {
+			cgiDir := path.Clean(filepath.ToSlash(vhost.CGIDir))
+			if !fs.ValidPath(cgiDir) || cgiDir == "." {
+				errs = append(errs, fmt.Errorf("virtual host %s: cgiDir %q must be a directory inside the docroot", name, vhost.CGIDir))
+			} else if info, err := os.Stat(filepath.Join(docroot_path, cgiDir)); err != nil || !info.IsDir() {
+				errs = append(errs, fmt.Errorf("virtual host %s: cgiDir %s is not a directory", name, filepath.Join(docroot_path, cgiDir)))
+			}
+		}
+		for _, fc := range vhost.FastCGI {
+			if _, err := fc.parse(docroot_path, nil); err != nil {
+				errs = append(errs, fmt.Errorf("virtual host %s: fastcgi: %v", name, err))
+			}
+		}
+	}
+	return errs
+}
+
+// BuildVirtualHosts opens the docroot of every virtual host and returns
+// the mapping from host name to docroot a Server serves. Aliases map to the
+// same docroot, and the default virtual host is also registered as
+// DefaultVirtualHost. Proxy virtual hosts map to a nil docroot.
+func (c *Config) BuildVirtualHosts() (map[string]fs.FS, error) {
+	vh_map := make(map[string]fs.FS)
+	for _, vhost := range c.VirtualHosts {
+		// Proxy virtual hosts have no docroot
+		if len(vhost.upstreamAddrs()) > 0 {
+			for _, name := range vhost.registeredNames() {
+				vh_map[name] = nil
+			}
+			continue
+		}
+		docroot_path := filepath.Join(c.DocRootDir, vhost.DocRoot)
+		docroot, err := OpenDocRoot(docroot_path)
+		if err != nil {
+			return nil, fmt.Errorf("could not open docroot %s : %w", docroot_path, err)
+		}
+		if dir, ok := docroot.(*DirFS); ok {
+			dir.FollowSymlinks = vhost.FollowSymlinks
+		}
+		for _, name := range vhost.registeredNames() {
+			vh_map[name] = docroot
+		}
+	}
+	return vh_map, nil
+}
+
+// Method which returns the upstreams of a proxy virtual host, or nothing
+// for a static one
+func (vhost *VirtualHostConfig) upstreamAddrs() []string {
+	if len(vhost.Upstream) > 0 {
+		return append([]string{vhost.Upstream}, vhost.Upstreams...)
+	}
+	return vhost.Upstreams
+}
+
+// Method which reports problems with the proxy settings of a virtual host
+func (vhost *VirtualHostConfig) validateUpstreams() []error {
+	errs := make([]error, 0)
+	if len(vhost.Upstream) > 0 && len(vhost.Upstreams) > 0 {
+		errs = append(errs, fmt.Errorf("upstream and upstreams can't both be set"))
+	}
+	seen := make(map[string]bool)
+	for _, addr := range vhost.upstreamAddrs() {
+		if host, port, err := net.SplitHostPort(addr); err != nil || len(host) == 0 || len(port) == 0 {
+			errs = append(errs, fmt.Errorf("upstream %q is not host:port", addr))
+		} else if seen[addr] {
+			errs = append(errs, fmt.Errorf("upstream %q is listed twice", addr))
+		}
+		seen[addr] = true
+	}
+	if vhost.UpstreamTimeout < 0 {
+		errs = append(errs, fmt.Errorf("upstreamTimeout must not be negative"))
+	}
+	if !isBalancingPolicy(vhost.LoadBalancing) {
+		errs = append(errs, fmt.Errorf("unknown loadBalancing %q", vhost.LoadBalancing))
+	}
+	if vhost.MaxFails < 0 {
+		errs = append(errs, fmt.Errorf("maxFails must not be negative"))
+	}
+	if vhost.FailTimeout < 0 {
+		errs = append(errs, fmt.Errorf("failTimeout must not be negative"))
+	}
+	if check := vhost.HealthCheck; check != nil {
+		if !strings.HasPrefix(check.Path, "/") {
+			errs = append(errs, fmt.Errorf("healthCheck.path must start with /"))
+		}
+		if check.Interval < 0 {
+			errs = append(errs, fmt.Errorf("healthCheck.interval must not be negative"))
+		}
+	}
+	return errs
+}
+
+// Method which builds the proxy of a virtual host forwarding to addrs.
+// Upstreams that previous already forwarded to are taken over with their
+// idle connections and health.
+func (vhost *VirtualHostConfig) newReverseProxy(addrs []string, previous *reverseProxy) *reverseProxy {
+	proxy := &reverseProxy{timeout: durationOr(vhost.UpstreamTimeout, DEFAULT_UPSTREAM_TIMEOUT)}
+	proxy.policy = vhost.LoadBalancing
+	proxy.maxFails = vhost.MaxFails
+	if proxy.maxFails == 0 {
+		proxy.maxFails = DEFAULT_MAX_FAILS
+	}
+	proxy.failTimeout = durationOr(vhost.FailTimeout, DEFAULT_FAIL_TIMEOUT)
+	if check := vhost.HealthCheck; check != nil {
+		proxy.healthCheck = check.Path
+		proxy.healthInterval = durationOr(check.Interval, DEFAULT_HEALTH_CHECK_INTERVAL)
+	}
+	upstreams := make([]*upstream, 0)
+	for _, addr := range addrs {
+		u := &upstream{addr: addr}
+		if previous != nil {
+			for _, old := range previous.upstreams {
+				if old.addr == addr {
+					u = old
+				}
+			}
+		}
+		upstreams = append(upstreams, u)
+	}
+	proxy.setUpstreams(upstreams)
+	return proxy
+}
+
+// Method which returns the names a virtual host is registered under in
+// the VirtualHosts map
+func (vhost *VirtualHostConfig) registeredNames() []string {
+	names := []string{NormalizeHost(vhost.HostName)}
+	for _, alias := range vhost.Aliases {
+		names = append(names, NormalizeHost(alias))
+	}
+	if vhost.Default {
+		names = append(names, DefaultVirtualHost)
+	}
+	return names
+}
+
+// AccessLogPaths returns the access log files of the virtual hosts that
+// have their own, keyed by VirtualHosts entry
+func (c *Config) AccessLogPaths() map[string]string {
+	paths := make(map[string]string)
+	for _, vhost := range c.VirtualHosts {
+		if len(vhost.AccessLog) == 0 {
+			continue
+		}
+		for _, name := range vhost.registeredNames() {
+			paths[name] = vhost.AccessLog
+		}
+	}
+	return paths
+}
+
+// Method which builds the options of every VirtualHosts entry, reading
+// the password files of auth realms. previous returns the options
+// currently in use, so that rate limiters whose settings didn't change
+// keep their buckets across a reload, upstreams their connections and
+// health, and FastCGI backends their connections.
+func (c *Config) buildVirtualHostOptions(previous func(name string) *virtualHostOptions) (map[string]*virtualHostOptions, error) {
+	options := make(map[string]*virtualHostOptions)
+	for _, vhost := range c.VirtualHosts {
+		names := vhost.registeredNames()
+		vhostOptions := &virtualHostOptions{spaFallback: vhost.SPAFallback}
+		if limit := vhost.RateLimit; limit != nil {
+			vhostOptions.rateLimiter = NewRateLimiter(limit.RequestsPerSecond, limit.Burst)
+			if old := previous(names[0]).rateLimiter; old != nil &&
+				old.Rate == vhostOptions.rateLimiter.Rate && old.Burst == vhostOptions.rateLimiter.Burst {
+				vhostOptions.rateLimiter = old
+			}
+		}
+		for _, rc := range vhost.Access {
+			// Invalid rules have been reported by Validate
+			if rule, err := rc.parse(); err == nil {
+				vhostOptions.accessRules = append(vhostOptions.accessRules, rule)
+			}
+		}
+		for _, rc := range vhost.Rewrites {
+			// Invalid rules have been reported by Validate
+			if rule, err := rc.parse(); err == nil {
+				vhostOptions.rewriteRules = append(vhostOptions.rewriteRules, rule)
+			}
+		}
+		for _, cc := range vhost.Cache {
+			// Invalid rules have been reported by Validate
+			if rule, err := cc.parse(); err == nil {
+				vhostOptions.cacheRules = append(vhostOptions.cacheRules, rule)
+			}
+		}
+		for _, ac := range vhost.Auth {
+			realm, err := ac.load(c.DocRootDir, vhost.HostName)
+			if err != nil {
+				return nil, fmt.Errorf("virtual host %s: auth: %w", vhost.HostName, err)
+			}
+			vhostOptions.authRealms = append(vhostOptions.authRealms, realm)
+		}
+		if addrs := vhost.upstreamAddrs(); len(addrs) > 0 {
+			vhostOptions.proxy = vhost.newReverseProxy(addrs, previous(names[0]).proxy)
+		}
+		if len(vhost.CGIDir) > 0 {
+			docRoot := filepath.Join(c.DocRootDir, vhost.DocRoot)
+			cgiDir := path.Clean(filepath.ToSlash(vhost.CGIDir))
+			vhostOptions.cgi = &cgiHandler{
+				prefix:  "/" + cgiDir,
+				dir:     filepath.Join(docRoot, filepath.FromSlash(cgiDir)),
+				docRoot: docRoot,
+				timeout: durationOr(vhost.CGITimeout, DEFAULT_CGI_TIMEOUT),
+			}
+		}
+		for _, fc := range vhost.FastCGI {
+			// Invalid routes have been reported by Validate
+			if route, err := fc.parse(filepath.Join(c.DocRootDir, vhost.DocRoot), previous(names[0]).fastCGI); err == nil {
+				vhostOptions.fastCGI = append(vhostOptions.fastCGI, route)
+			}
+		}
+		for _, name := range names {
+			options[name] = vhostOptions
+		}
+	}
+	return options, nil
+}
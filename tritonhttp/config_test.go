@@ -0,0 +1,148 @@
+package tritonhttp
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigErrors(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "virtual_hosts.yaml")
+	write := func(contents string) {
+		if err := os.WriteFile(config, []byte(contents), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	write(`virtual_hosts:
+  - hostName: "website1"
+    docRoot: "htdocs1"
+  - hostName: "WEBSITE1"
+    docRoot: "htdocs2"
+  - hostName: ""
+    docRoot: "missing"
+    default: true
+  - hostName: "website3"
+    aliases: ["website2"]
+    docRoot: "htdocs3"
+    default: true
+  - hostName: "website2"
+    docRoot: "htdocs2"
+`)
+	_, err := LoadConfig(config, "../docroot_dirs")
+	configErr, ok := err.(*ConfigError)
+	if !ok {
+		t.Fatalf("Expected a *ConfigError but got %v\n", err)
+	}
+	expected := []string{
+		`host name "WEBSITE1" is already used by website1`,
+		"hostName is empty",
+		"docroot_dirs/missing doesn't exist",
+		"is already the default",
+		`host name "website2" is already used by website3`,
+	}
+	if len(configErr.Errors) != len(expected) {
+		t.Fatalf("Expected %v problems but got: %v\n", len(expected), err)
+	}
+	for i, problem := range expected {
+		if !strings.Contains(configErr.Errors[i].Error(), problem) {
+			t.Fatalf("Expected problem %q but got %q\n", problem, configErr.Errors[i])
+		}
+	}
+
+	// Strict decoding reports typos in keys
+	write(`virtual_hosts:
+  - hostname: "website1"
+    docRoot: "htdocs1"
+    folowSymlinks: true
+`)
+	_, err = LoadConfig(config, "../docroot_dirs")
+	configErr, ok = err.(*ConfigError)
+	if !ok || len(configErr.Errors) != 2 {
+		t.Fatalf("Expected two unknown keys to be reported but got %v\n", err)
+	}
+
+	// Proxy settings
+	write(`virtual_hosts:
+  - hostName: "app"
+    docRoot: "htdocs1"
+    upstream: "localhost:3000"
+  - hostName: "pool"
+    upstreams: ["localhost:3001", "localhost", "localhost:3001"]
+    loadBalancing: "random"
+    healthCheck:
+      path: "health"
+`)
+	_, err = LoadConfig(config, "../docroot_dirs")
+	configErr, ok = err.(*ConfigError)
+	if !ok {
+		t.Fatalf("Expected a *ConfigError but got %v\n", err)
+	}
+	expected = []string{
+		"docRoot and upstream can't both be set",
+		`upstream "localhost" is not host:port`,
+		`upstream "localhost:3001" is listed twice`,
+		`unknown loadBalancing "random"`,
+		"healthCheck.path must start with /",
+	}
+	if len(configErr.Errors) != len(expected) {
+		t.Fatalf("Expected %v problems but got: %v\n", len(expected), err)
+	}
+	for i, problem := range expected {
+		if !strings.Contains(configErr.Errors[i].Error(), problem) {
+			t.Fatalf("Expected problem %q but got %q\n", problem, configErr.Errors[i])
+		}
+	}
+
+	if _, err := LoadConfig("../virtual_hosts.yaml", "../docroot_dirs"); err != nil {
+		t.Fatalf("Expected the shipped config to be valid but got %v\n", err)
+	}
+}
+
+func TestServerConfig(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "virtual_hosts.yaml")
+	write := func(contents string) {
+		if err := os.WriteFile(config, []byte(contents), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	write(`server:
+  readHeaderTimeout: 2s
+  idleTimeout: 1m
+  writeTimeout: 500ms
+  maxRequestsPerConn: 100
+  maxHeaderBytes: 8192
+virtual_hosts:
+  - hostName: "website1"
+    docRoot: "htdocs1"
+`)
+	c, err := LoadConfig(config, "../docroot_dirs")
+	if err != nil {
+		t.Fatalf("Expected config to be valid but got %v\n", err)
+	}
+	s := &Server{IdleTimeout: time.Second}
+	c.Server.Apply(s)
+	if s.ReadHeaderTimeout != 2*time.Second || s.IdleTimeout != time.Minute || s.WriteTimeout != 500*time.Millisecond ||
+		s.MaxRequestsPerConn != 100 || s.MaxHeaderBytes != 8192 {
+		t.Fatalf("Unexpected server settings %+v\n", s)
+	}
+
+	write(`server:
+  idleTimeout: -1s
+  maxHeaderBytes: -1
+  trustedProxies: ["10.0.0.0/8", "proxy.example"]
+virtual_hosts:
+  - hostName: "website1"
+    docRoot: "htdocs1"
+    rateLimit:
+      requestsPerSecond: 0
+`)
+	_, err = LoadConfig(config, "../docroot_dirs")
+	configErr, ok := err.(*ConfigError)
+	if !ok || len(configErr.Errors) != 4 {
+		t.Fatalf("Expected four invalid settings to be reported but got %v\n", err)
+	}
+}
@@ -0,0 +1,83 @@
+package tritonhttp
+
+import (
+	"net"
+	"time"
+)
+
+// rateChunkSize is how much is transferred between two updates of the
+// deadline when a minimum rate is enforced
+const rateChunkSize = 16 * 1024
+
+// transferDeadline computes the deadlines of the reads or writes making up
+// a transfer. By default the whole transfer has to finish within grace of
+// its first operation. With a minRate the deadline moves forward as fast
+// as minRate allows: the n-th byte must be transferred within
+// grace + n/minRate of the first operation. Streaming transfers, whose
+// data is produced while they run, instead give every operation grace
+// (plus its size at minRate) from the moment it starts.
+type transferDeadline struct {
+	start     time.Time
+	grace     time.Duration
+	minRate   int
+	streaming bool
+	done      int64
+}
+
+// Method which returns by when the next n bytes have to be transferred
+func (td *transferDeadline) next(n int) time.Time {
+	now := time.Now()
+	if td.start.IsZero() {
+		td.start = now
+	}
+	var atRate time.Duration
+	if td.minRate > 0 {
+		atRate = time.Duration(int64(n)) * time.Second / time.Duration(td.minRate)
+	}
+	if td.streaming {
+		return now.Add(td.grace + atRate)
+	}
+	if td.minRate > 0 {
+		atRate = time.Duration(td.done+int64(n)) * time.Second / time.Duration(td.minRate)
+	}
+	return td.start.Add(td.grace + atRate)
+}
+
+// Method which returns the size of the next operation, so that a minimum
+// rate is checked at least every rateChunkSize bytes
+func (td *transferDeadline) chunk(n int) int {
+	if td.minRate > 0 && n > rateChunkSize {
+		return rateChunkSize
+	}
+	return n
+}
+
+// deadlineWriter writes to conn under a transferDeadline. A client that
+// stops reading, or reads too slowly, runs into the deadline and the write
+// fails.
+type deadlineWriter struct {
+	conn net.Conn
+	transferDeadline
+}
+
+func newDeadlineWriter(conn net.Conn, grace time.Duration, minRate int, streaming bool) *deadlineWriter {
+	return &deadlineWriter{conn: conn, transferDeadline: transferDeadline{grace: grace, minRate: minRate, streaming: streaming}}
+}
+
+func (dw *deadlineWriter) Write(p []byte) (int, error) {
+	total := 0
+	for len(p) > 0 {
+		chunk := p[:dw.chunk(len(p))]
+		if err := dw.conn.SetWriteDeadline(dw.next(len(chunk))); err != nil {
+			return total, err
+		}
+		n, err := dw.conn.Write(chunk)
+		total += n
+		dw.done += int64(n)
+		if err != nil {
+			return total, err
+		}
+		p = p[n:]
+	}
+	return total, nil
+}
@@ -0,0 +1,232 @@
+package tritonhttp
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestIdleTimeout(t *testing.T) {
+	s := &Server{
+		VirtualHosts: map[string]fs.FS{
+			"site": fstest.MapFS{"index.html": {Data: []byte("index")}},
+		},
+		IdleTimeout: 100 * time.Millisecond,
+		Metrics:     NewMetrics(),
+	}
+	port := launchserver(t, s)
+
+	// A connection that never sends anything
+	conn, err := net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v\n", err.Error())
+	}
+	defer conn.Close()
+	if data := readuntilclosed(t, conn, 2*time.Second); len(data) > 0 {
+		t.Fatalf("Expected no response on an idle connection but got %q\n", data)
+	}
+
+	// A keep-alive connection is closed once idle after its response
+	conn, err = net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v\n", err.Error())
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: site\r\n\r\n")); err != nil {
+		t.Fatal(err.Error())
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(readuntilclosed(t, conn, 2*time.Second))), nil)
+	if err != nil {
+		t.Fatalf("Error parsing response: %v\n", err.Error())
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("Expected response code of 200 but got %v\n", resp.StatusCode)
+	}
+
+	var metrics bytes.Buffer
+	if _, err := s.Metrics.WriteTo(&metrics); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !strings.Contains(metrics.String(), `tritonhttp_timeouts_total{partial="false"} 2`) {
+		t.Fatalf("Expected two idle timeouts to be counted:\n%s", metrics.String())
+	}
+}
+
+func TestReadHeaderTimeout(t *testing.T) {
+	s := &Server{
+		VirtualHosts: map[string]fs.FS{
+			"site": fstest.MapFS{"index.html": {Data: []byte("index")}},
+		},
+		ReadHeaderTimeout: 100 * time.Millisecond,
+		IdleTimeout:       time.Minute,
+	}
+	port := launchserver(t, s)
+
+	conn, err := net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v\n", err.Error())
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: site\r\n")); err != nil {
+		t.Fatal(err.Error())
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(readuntilclosed(t, conn, 2*time.Second))), nil)
+	if err != nil {
+		t.Fatalf("Error parsing response: %v\n", err.Error())
+	}
+	if resp.StatusCode != 400 {
+		t.Fatalf("Expected response code of 400 but got %v\n", resp.StatusCode)
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	// Large enough to fill the socket buffers of both ends
+	large := bytes.Repeat([]byte("x"), 64<<20)
+	s := &Server{
+		VirtualHosts: map[string]fs.FS{
+			"site": fstest.MapFS{"large.txt": {Data: large}},
+		},
+		WriteTimeout: 200 * time.Millisecond,
+	}
+	port := launchserver(t, s)
+
+	conn, err := net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v\n", err.Error())
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("GET /large.txt HTTP/1.1\r\nHost: site\r\n\r\n")); err != nil {
+		t.Fatal(err.Error())
+	}
+	// Don't read until the server gave up writing
+	time.Sleep(time.Second)
+	data := readuntilclosed(t, conn, 5*time.Second)
+	if len(data) >= len(large) {
+		t.Fatalf("Expected the response to be cut off but got %v bytes\n", len(data))
+	}
+}
+
+// slowclient simulates clients that send their request or read their
+// response a few bytes at a time
+type slowclient struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+func dialslowclient(t *testing.T, port string) *slowclient {
+	conn, err := net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v\n", err.Error())
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &slowclient{t: t, conn: conn}
+}
+
+// trickle sends data one byte every interval in the background, stopping
+// at the first write error
+func (c *slowclient) trickle(data string, every time.Duration) {
+	go func() {
+		for i := 0; i < len(data); i++ {
+			if _, err := c.conn.Write([]byte{data[i]}); err != nil {
+				return
+			}
+			time.Sleep(every)
+		}
+	}()
+}
+
+// readslowly reads up to chunk bytes every interval for the given duration
+// and returns how many bytes it got
+func (c *slowclient) readslowly(chunk int, every time.Duration, duration time.Duration) int {
+	buf := make([]byte, chunk)
+	total := 0
+	for end := time.Now().Add(duration); time.Now().Before(end); {
+		if err := c.conn.SetReadDeadline(time.Now().Add(every)); err != nil {
+			c.t.Fatal(err.Error())
+		}
+		n, err := io.ReadFull(c.conn, buf)
+		total += n
+		if ne, ok := err.(net.Error); err != nil && !(ok && ne.Timeout()) {
+			return total
+		}
+		time.Sleep(every)
+	}
+	return total
+}
+
+func TestSlowloris(t *testing.T) {
+	s := &Server{
+		VirtualHosts: map[string]fs.FS{
+			"site": fstest.MapFS{"index.html": {Data: []byte("index")}},
+		},
+		ReadHeaderTimeout: 300 * time.Millisecond,
+		IdleTimeout:       time.Minute,
+	}
+	port := launchserver(t, s)
+
+	// Each byte arrives well within the timeout, but the headers never end
+	c := dialslowclient(t, port)
+	start := time.Now()
+	c.trickle("GET / HTTP/1.1\r\nHost: site\r\n"+strings.Repeat("X-Slow: a\r\n", 100), 20*time.Millisecond)
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(readuntilclosed(t, c.conn, 5*time.Second))), nil)
+	if err != nil {
+		t.Fatalf("Error parsing response: %v\n", err.Error())
+	}
+	if resp.StatusCode != 400 {
+		t.Fatalf("Expected response code of 400 but got %v\n", resp.StatusCode)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("Expected the slow client to be cut off after the read header timeout but it took %v\n", elapsed)
+	}
+
+	// A request trickled within the timeout is served
+	c = dialslowclient(t, port)
+	c.trickle("GET / HTTP/1.1\r\nHost: site\r\nConnection: close\r\n\r\n", time.Millisecond)
+	resp, err = http.ReadResponse(bufio.NewReader(bytes.NewReader(readuntilclosed(t, c.conn, 5*time.Second))), nil)
+	if err != nil {
+		t.Fatalf("Error parsing response: %v\n", err.Error())
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("Expected response code of 200 but got %v\n", resp.StatusCode)
+	}
+}
+
+func TestSlowRead(t *testing.T) {
+	large := bytes.Repeat([]byte("x"), 32<<20)
+	s := &Server{
+		VirtualHosts: map[string]fs.FS{
+			"site": fstest.MapFS{"large.txt": {Data: large}},
+		},
+		WriteTimeout: 500 * time.Millisecond,
+		MinWriteRate: 4 << 20,
+	}
+	port := launchserver(t, s)
+
+	// A client reading at full speed may take longer than WriteTimeout
+	resp := fetchresponse(t, port, "GET /large.txt HTTP/1.1\r\nHost: site\r\nConnection: close\r\n\r\n")
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Error reading response body: %v\n", err.Error())
+	}
+	if len(body) != len(large) {
+		t.Fatalf("Expected %v bytes but got %v\n", len(large), len(body))
+	}
+
+	// A client reading far below MinWriteRate is cut off
+	c := dialslowclient(t, port)
+	if _, err := c.conn.Write([]byte("GET /large.txt HTTP/1.1\r\nHost: site\r\n\r\n")); err != nil {
+		t.Fatal(err.Error())
+	}
+	total := c.readslowly(16*1024, 20*time.Millisecond, 4*time.Second)
+	total += len(readuntilclosed(t, c.conn, 5*time.Second))
+	if total >= len(large) {
+		t.Fatalf("Expected the slow reader to be cut off but got %v bytes\n", total)
+	}
+}
@@ -0,0 +1,106 @@
+package tritonhttp
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DirFS is a docroot served from a local directory. Unlike os.DirFS it
+// resolves symlinks and refuses to open anything that resolves to a
+// location outside of Root, unless FollowSymlinks is set.
+type DirFS struct {
+	Root string
+
+	// FollowSymlinks allows symlinks inside the docroot to point anywhere
+	// on the local file system
+	FollowSymlinks bool
+}
+
+// Open implements fs.FS
+func (d *DirFS) Open(name string) (fs.File, error) {
+	fullPath, err := d.resolve("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(fullPath)
+}
+
+// Stat implements fs.StatFS
+func (d *DirFS) Stat(name string) (fs.FileInfo, error) {
+	fullPath, err := d.resolve("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(fullPath)
+}
+
+// Method which maps name to a local path, making sure that the path
+// (after following all symlinks) doesn't leave the docroot
+func (d *DirFS) resolve(op string, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	fullPath := filepath.Join(d.Root, filepath.FromSlash(name))
+	if d.FollowSymlinks {
+		return fullPath, nil
+	}
+	root, err := filepath.EvalSymlinks(d.Root)
+	if err != nil {
+		return "", &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	resolved, err := filepath.EvalSymlinks(fullPath)
+	if err != nil {
+		return "", &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		// Pretend the file doesn't exist rather than revealing that the
+		// link points somewhere else
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return resolved, nil
+}
+
+// DotfilePolicy decides how requests for dotfiles and dot directories
+// (e.g. ".git" or ".env") are answered
+type DotfilePolicy int
+
+const (
+	// DotfilesHide responds with 404 Not Found, as if the file didn't exist
+	DotfilesHide DotfilePolicy = iota
+	// DotfilesDeny responds with 403 Forbidden
+	DotfilesDeny
+	// DotfilesAllow serves dotfiles like any other file
+	DotfilesAllow
+)
+
+// ParseDotfilePolicy converts "hide", "deny" or "allow" into a DotfilePolicy
+func ParseDotfilePolicy(s string) (DotfilePolicy, error) {
+	switch s {
+	case "hide":
+		return DotfilesHide, nil
+	case "deny":
+		return DotfilesDeny, nil
+	case "allow":
+		return DotfilesAllow, nil
+	}
+	return DotfilesHide, fmt.Errorf("unknown dotfile policy %q", s)
+}
+
+// Method which reports whether any segment of the slash-separated path
+// name starts with a dot. ".well-known" is exempt since RFC 8615 requires
+// it to be reachable.
+func isDotfile(name string) bool {
+	for _, segment := range strings.Split(name, "/") {
+		if segment == "." || segment == ".well-known" {
+			continue
+		}
+		if strings.HasPrefix(segment, ".") {
+			return true
+		}
+	}
+	return false
+}
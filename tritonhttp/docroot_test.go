@@ -0,0 +1,165 @@
+package tritonhttp
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+func TestMapFSDocRoot(t *testing.T) {
+	s := &Server{
+		VirtualHosts: map[string]fs.FS{
+			"memsite": fstest.MapFS{
+				"index.html":     {Data: []byte("<h1>in memory</h1>")},
+				"sub/style.css":  {Data: []byte("h1 {}")},
+				"sub/index.html": {Data: []byte("<h1>sub</h1>")},
+			},
+		},
+	}
+	port := launchserver(t, s)
+
+	tests := []struct {
+		url         string
+		statusCode  int
+		contentType string
+		body        string
+	}{
+		{"/", 200, "text/html; charset=utf-8", "<h1>in memory</h1>"},
+		{"/sub/style.css", 200, "text/css; charset=utf-8", "h1 {}"},
+		{"/sub/", 200, "text/html; charset=utf-8", "<h1>sub</h1>"},
+		{"/sub", 200, "text/html; charset=utf-8", "<h1>sub</h1>"},
+		{"/../index.html", 200, "text/html; charset=utf-8", "<h1>in memory</h1>"},
+		{"/missing.html", 404, "", ""},
+	}
+	for _, tt := range tests {
+		req := fmt.Sprintf("GET %s HTTP/1.1\r\n"+
+			"Host: memsite\r\n"+
+			"Connection: close\r\n"+
+			"\r\n", tt.url)
+		resp := fetchresponse(t, port, req)
+		if resp.StatusCode != tt.statusCode {
+			t.Fatalf("%v: expected response code of %v but got: %v\n", tt.url, tt.statusCode, resp.StatusCode)
+		}
+		if tt.statusCode != 200 {
+			continue
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != tt.contentType {
+			t.Fatalf("%v: expected Content-Type of %v but got %v\n", tt.url, tt.contentType, ct)
+		}
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("Error reading response body: %v\n", err.Error())
+		}
+		if string(body) != tt.body {
+			t.Fatalf("%v: expected body %q but got %q\n", tt.url, tt.body, body)
+		}
+	}
+}
+
+func TestZipDocRoot(t *testing.T) {
+	archive := filepath.Join(t.TempDir(), "site.zip")
+	f, err := os.Create(archive)
+	if err != nil {
+		t.Fatalf("Error creating archive: %v\n", err.Error())
+	}
+	zw := zip.NewWriter(f)
+	w, err := zw.Create("index.html")
+	if err != nil {
+		t.Fatalf("Error adding file to archive: %v\n", err.Error())
+	}
+	io.WriteString(w, "<h1>zipped</h1>")
+	if err := zw.Close(); err != nil {
+		t.Fatalf("Error writing archive: %v\n", err.Error())
+	}
+	f.Close()
+
+	docRoot, err := OpenDocRoot(archive)
+	if err != nil {
+		t.Fatalf("Error opening archive docroot: %v\n", err.Error())
+	}
+	s := &Server{
+		VirtualHosts: map[string]fs.FS{"zipsite": docRoot},
+	}
+	port := launchserver(t, s)
+
+	resp := fetchresponse(t, port, "GET / HTTP/1.1\r\nHost: zipsite\r\nConnection: close\r\n\r\n")
+	if resp.StatusCode != 200 {
+		t.Fatalf("Expected response code of 200 but got: %v\n", resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Error reading response body: %v\n", err.Error())
+	}
+	if string(body) != "<h1>zipped</h1>" {
+		t.Fatalf("Expected zipped index but got %q\n", body)
+	}
+}
+
+func TestDocRootContainment(t *testing.T) {
+	tmp := t.TempDir()
+	docroot := filepath.Join(tmp, "htdocs")
+	secretdir := filepath.Join(tmp, "secret")
+	for _, dir := range []string{docroot, secretdir, filepath.Join(docroot, "sub"), filepath.Join(docroot, ".git")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	files := map[string]string{
+		filepath.Join(docroot, "index.html"):       "index",
+		filepath.Join(docroot, "sub", "page.html"): "page",
+		filepath.Join(docroot, ".env"):             "SECRET=1",
+		filepath.Join(docroot, ".git", "config"):   "[core]",
+		filepath.Join(secretdir, "passwd.html"):    "root",
+	}
+	for name, contents := range files {
+		if err := os.WriteFile(name, []byte(contents), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	links := map[string]string{
+		filepath.Join(docroot, "inside.html"): filepath.Join(docroot, "sub", "page.html"),
+		filepath.Join(docroot, "escape"):      secretdir,
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, name); err != nil {
+			t.Skipf("symlinks not supported: %v", err)
+		}
+	}
+
+	tests := []struct {
+		followSymlinks bool
+		dotfiles       DotfilePolicy
+		url            string
+		statusCode     int
+	}{
+		{false, DotfilesHide, "/index.html", 200},
+		{false, DotfilesHide, "/inside.html", 200},
+		{false, DotfilesHide, "/escape/passwd.html", 404},
+		{true, DotfilesHide, "/escape/passwd.html", 200},
+		{false, DotfilesHide, "/.env", 404},
+		{false, DotfilesHide, "/.git/config", 404},
+		{false, DotfilesDeny, "/.env", 403},
+		{false, DotfilesDeny, "/.git/config", 403},
+		{false, DotfilesAllow, "/.env", 200},
+	}
+	for _, tt := range tests {
+		s := &Server{
+			VirtualHosts: map[string]fs.FS{
+				"site": &DirFS{Root: docroot, FollowSymlinks: tt.followSymlinks},
+			},
+			Dotfiles: tt.dotfiles,
+		}
+		port := launchserver(t, s)
+		req := fmt.Sprintf("GET %s HTTP/1.1\r\nHost: site\r\nConnection: close\r\n\r\n", tt.url)
+		resp := fetchresponse(t, port, req)
+		if resp.StatusCode != tt.statusCode {
+			t.Fatalf("%v (followSymlinks=%v, dotfiles=%v): expected response code of %v but got: %v\n",
+				tt.url, tt.followSymlinks, tt.dotfiles, tt.statusCode, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package tritonhttp
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DEFAULT_EVENT_STREAM_HEARTBEAT is how often an idle event stream sends a
+// heartbeat comment when Server.EventStreamHeartbeat isn't set
+const DEFAULT_EVENT_STREAM_HEARTBEAT time.Duration = 15 * time.Second
+
+// EventStreamHandler produces the events of a Server-Sent Events stream.
+// The stream ends when it returns.
+type EventStreamHandler func(stream *EventStream)
+
+// Event is a single Server-Sent Event. Data may span several lines; ID
+// and Event may not contain line breaks. Retry, if set, tells the client
+// how long to wait before reconnecting.
+type Event struct {
+	ID    string
+	Event string
+	Data  string
+	Retry time.Duration
+}
+
+// EventStream is a text/event-stream response in progress
+type EventStream struct {
+	// Request is the request that opened the stream
+	Request *Request
+	// LastEventID is the Last-Event-ID the client reconnected with, i.e.
+	// the ID of the last event it received, or "" on a first connection
+	LastEventID string
+
+	pw   *io.PipeWriter
+	done chan struct{}
+}
+
+// Method which answers req with an event stream produced by handler. The
+// events are written as handler sends them, with heartbeat comments
+// in between so that proxies keep the connection open and a client that
+// went away is noticed. The stream is torn down once handler returns or
+// the client disconnects.
+func (s *Server) serveEventStream(req *Request, handler EventStreamHandler) *Response {
+	res := &Response{}
+	if req.Method != GET {
+		res.HandleBadRequest()
+		if req.Close {
+			res.Headers[CONNECTION] = CLOSE
+		}
+		return res
+	}
+	pr, pw := io.Pipe()
+	stream := &EventStream{
+		Request:     req,
+		LastEventID: req.Headers["Last-Event-Id"],
+		pw:          pw,
+		done:        make(chan struct{}),
+	}
+	res.AddProto(responseProto)
+	res.StatusCode = statusOK
+	res.Headers = make(map[string]string)
+	res.Headers["Date"] = FormatTime(time.Now())
+	res.Headers["Content-Type"] = "text/event-stream; charset=utf-8"
+	res.Headers["Cache-Control"] = "no-cache"
+	// The stream has no length, so it is chunked or ends with the
+	// connection
+	if req.ProtoAtLeast(1, 1) {
+		res.Headers["Transfer-Encoding"] = "chunked"
+	} else {
+		req.Close = true
+	}
+	if req.Close {
+		res.Headers[CONNECTION] = CLOSE
+	}
+	res.Body = pr
+	res.done = func(err error) {
+		if err == nil {
+			err = io.ErrClosedPipe
+		}
+		// Unblocks a handler sending an event to a client that is gone
+		_ = pr.CloseWithError(err)
+		close(stream.done)
+	}
+	go stream.heartbeat(durationOr(s.EventStreamHeartbeat, DEFAULT_EVENT_STREAM_HEARTBEAT))
+	go func() {
+		defer pw.Close()
+		handler(stream)
+	}()
+	return res
+}
+
+// Method which sends a comment each interval until the stream is done
+func (es *EventStream) heartbeat(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-es.done:
+			return
+		case <-ticker.C:
+			if _, err := io.WriteString(es.pw, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Send writes ev to the client. It fails once the client disconnected.
+func (es *EventStream) Send(ev Event) error {
+	if strings.ContainsAny(ev.ID, "\r\n") || strings.ContainsAny(ev.Event, "\r\n") {
+		return fmt.Errorf("event id and name may not contain line breaks")
+	}
+	var b strings.Builder
+	if len(ev.ID) > 0 {
+		b.WriteString("id: " + ev.ID + "\n")
+	}
+	if len(ev.Event) > 0 {
+		b.WriteString("event: " + ev.Event + "\n")
+	}
+	if ev.Retry > 0 {
+		b.WriteString("retry: " + strconv.FormatInt(ev.Retry.Milliseconds(), 10) + "\n")
+	}
+	data := strings.ReplaceAll(ev.Data, "\r\n", "\n")
+	for _, line := range strings.Split(strings.ReplaceAll(data, "\r", "\n"), "\n") {
+		b.WriteString("data: " + line + "\n")
+	}
+	b.WriteString("\n")
+	// The whole event is a single write, so heartbeats can't end up in
+	// the middle of it
+	_, err := io.WriteString(es.pw, b.String())
+	return err
+}
+
+// Done returns a channel that is closed once the stream is over, because
+// the handler returned or the client disconnected
+func (es *EventStream) Done() <-chan struct{} {
+	return es.done
+}
@@ -0,0 +1,79 @@
+package tritonhttp
+
+import (
+	"bufio"
+	"io"
+	"io/fs"
+	"net/http"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestEventStream(t *testing.T) {
+	lastids := make(chan string, 1)
+	torndown := make(chan error, 1)
+	s := &Server{
+		VirtualHosts: map[string]fs.FS{"site": fstest.MapFS{"index.html": {Data: []byte("index")}}},
+		EventStreamHandlers: map[string]EventStreamHandler{
+			"/events": func(stream *EventStream) {
+				lastids <- stream.LastEventID
+				stream.Send(Event{ID: "2", Event: "update", Data: "line1\nline2", Retry: 3 * time.Second})
+				stream.Send(Event{ID: "3", Data: "three"})
+				<-stream.Done()
+				torndown <- stream.Send(Event{Data: "too late"})
+			},
+			"/finite": func(stream *EventStream) {
+				stream.Send(Event{Data: "done"})
+			},
+		},
+		EventStreamHeartbeat: 50 * time.Millisecond,
+	}
+	port := launchserver(t, s)
+
+	conn := dialfrom(t, "127.0.0.1", port)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET /events HTTP/1.1\r\nHost: site\r\nLast-Event-ID: 1\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("Error parsing response: %v\n", err)
+	}
+	if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != "text/event-stream; charset=utf-8" ||
+		resp.Header.Get("Cache-Control") != "no-cache" {
+		t.Fatalf("Expected an event stream but got %v %v\n", resp.StatusCode, resp.Header)
+	}
+	if lastid := <-lastids; lastid != "1" {
+		t.Fatalf("Expected the handler to see Last-Event-ID 1 but got %q\n", lastid)
+	}
+	// The events arrive while the handler is still running
+	br := bufio.NewReader(resp.Body)
+	expected := "id: 2\nevent: update\nretry: 3000\ndata: line1\ndata: line2\n\nid: 3\ndata: three\n\n"
+	received := make([]byte, len(expected))
+	if _, err := io.ReadFull(br, received); err != nil || string(received) != expected {
+		t.Fatalf("Expected %q but got %q (%v)\n", expected, received, err)
+	}
+	if line, err := br.ReadString('\n'); err != nil || line != ": heartbeat\n" {
+		t.Fatalf("Expected a heartbeat comment but got %q (%v)\n", line, err)
+	}
+
+	// Disconnecting ends the stream
+	conn.Close()
+	select {
+	case err := <-torndown:
+		if err == nil {
+			t.Fatalf("Expected sending after the disconnect to fail\n")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Expected the stream to be torn down after the client disconnected\n")
+	}
+
+	// A stream ends when its handler returns
+	resp = requestfrom(t, "127.0.0.1", port, "GET /finite HTTP/1.1\r\nHost: site\r\nConnection: close\r\n\r\n")
+	if body, _ := io.ReadAll(resp.Body); string(body) != "data: done\n\n" {
+		t.Fatalf("Expected a single event but got %q\n", body)
+	}
+	resp = requestfrom(t, "127.0.0.1", port, "POST /finite HTTP/1.1\r\nHost: site\r\nConnection: close\r\nContent-Length: 0\r\n\r\n")
+	if resp.StatusCode != 400 {
+		t.Fatalf("Expected 400 for POST but got %v\n", resp.StatusCode)
+	}
+}
@@ -0,0 +1,613 @@
+package tritonhttp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DEFAULT_FASTCGI_TIMEOUT is how long a FastCGI backend may take to
+	// answer when the route has no timeout
+	DEFAULT_FASTCGI_TIMEOUT time.Duration = 30 * time.Second
+	// How many idle connections are kept per FastCGI backend
+	MAX_IDLE_FASTCGI_CONNS = 16
+)
+
+// FastCGI record types and flags, see the FastCGI specification
+const (
+	fcgiVersion         = 1
+	fcgiBeginRequest    = 1
+	fcgiAbortRequest    = 2
+	fcgiEndRequest      = 3
+	fcgiParams          = 4
+	fcgiStdin           = 5
+	fcgiStdout          = 6
+	fcgiStderr          = 7
+	fcgiGetValues       = 9
+	fcgiGetValuesResult = 10
+	fcgiResponder       = 1
+	fcgiKeepConn        = 1
+	fcgiHeaderLen       = 8
+	fcgiMaxContent      = 65535
+	// Records of the response are queued per request up to this many
+	fcgiQueueLen = 32
+)
+
+// FastCGIConfig sends the requests under Path to the FastCGI backend
+// listening on Address, either "host:port" or "unix:/path/to/socket".
+// Script, if set, is the script every request runs, e.g. a front
+// controller such as /srv/app/index.php; otherwise the backend runs the
+// file the request path names in the docroot. A backend taking longer than
+// Timeout to answer gets a 504.
+type FastCGIConfig struct {
+	Path    string        `yaml:"path"`
+	Address string        `yaml:"address"`
+	Script  string        `yaml:"script"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// Method which checks fc and builds its route. previous holds the routes
+// currently in use, whose clients are kept when the backend didn't change
+// so that their connections survive a reload.
+func (fc *FastCGIConfig) parse(docRoot string, previous []*fastCGIRoute) (*fastCGIRoute, error) {
+	route := &fastCGIRoute{path: fc.Path, script: fc.Script, docRoot: docRoot}
+	if len(route.path) == 0 {
+		route.path = "/"
+	}
+	if !strings.HasPrefix(route.path, "/") {
+		return nil, fmt.Errorf("path %q must start with /", fc.Path)
+	}
+	if len(fc.Script) > 0 && !filepath.IsAbs(fc.Script) {
+		return nil, fmt.Errorf("script %q must be an absolute path", fc.Script)
+	}
+	if fc.Timeout < 0 {
+		return nil, fmt.Errorf("timeout must not be negative")
+	}
+	network, addr, err := parseFastCGIAddress(fc.Address)
+	if err != nil {
+		return nil, err
+	}
+	timeout := durationOr(fc.Timeout, DEFAULT_FASTCGI_TIMEOUT)
+	for _, old := range previous {
+		if old.client.network == network && old.client.addr == addr && old.client.timeout == timeout {
+			route.client = old.client
+			return route, nil
+		}
+	}
+	route.client = &fastCGIClient{network: network, addr: addr, timeout: timeout}
+	return route, nil
+}
+
+// fastCGIRoute sends the requests for a path prefix of a virtual host to a
+// FastCGI backend
+type fastCGIRoute struct {
+	path   string
+	client *fastCGIClient
+	// script, if set, is the SCRIPT_FILENAME of every request, e.g. a
+	// front controller. Otherwise it is the request path in docRoot.
+	script  string
+	docRoot string
+}
+
+// Method which returns the FastCGI route in options serving req, if any. The
+// longest matching path wins.
+func (s *Server) fastCGIRoute(options *virtualHostOptions, req *Request) *fastCGIRoute {
+	var route *fastCGIRoute
+	reqPath := cleanPath(req.Path)
+	for _, r := range options.fastCGI {
+		if pathHasPrefix(reqPath, r.path) && (route == nil || len(r.path) > len(route.path)) {
+			route = r
+		}
+	}
+	return route
+}
+
+// Method which forwards req to the FastCGI backend of its route, if it has
+// one, and returns the response. It returns nil for other requests.
+// Backends that can't be reached or answer garbage are answered with 502,
+// and ones that take longer than the timeout to answer with 504.
+func (s *Server) serveFastCGI(options *virtualHostOptions, req *Request) *Response {
+	route := s.fastCGIRoute(options, req)
+	if route == nil {
+		return nil
+	}
+	res := &Response{}
+	fail := func(handle func()) *Response {
+		handle()
+		if req.Close {
+			res.Headers[CONNECTION] = CLOSE
+		}
+		return res
+	}
+
+	// A chunked body is read in full first, as CONTENT_LENGTH is required
+	body, contentLength := req.Body, req.ContentLength
+	if body != nil && contentLength < 0 {
+		data, err := io.ReadAll(io.LimitReader(body, MAX_CGI_BODY_BYTES+1))
+		if err != nil {
+			req.Close = true
+			return fail(res.HandleBadRequest)
+		}
+		if len(data) > MAX_CGI_BODY_BYTES {
+			req.Close = true
+			return fail(res.HandleRequestEntityTooLarge)
+		}
+		body, contentLength = bytes.NewReader(data), int64(len(data))
+	}
+	script := route.script
+	if len(script) == 0 {
+		script = filepath.Join(route.docRoot, filepath.FromSlash(req.Path))
+	}
+	params := cgiEnviron(req, route.docRoot, req.Path, script, "", contentLength)
+
+	conn, fr, err := route.client.roundTrip(params, body)
+	if err != nil {
+		log.Printf("FastCGI backend %v failed: %v", route.client.addr, err)
+		return fail(res.HandleBadGateway)
+	}
+	out := &fcgiStdoutReader{req: fr, timeout: route.client.timeout}
+	br := bufio.NewReader(io.LimitReader(out, maxCGIHeaderBytes))
+	headers, err := readCGIHeaders(br)
+	if err == nil {
+		// A local redirect is served as if the new URL had been requested
+		if location := headers["Location"]; strings.HasPrefix(location, "/") && len(headers["Status"]) == 0 {
+			conn.finish(fr)
+			return s.redirectCGI(req, location)
+		}
+		err = fillCGIResponse(res, req, headers)
+	}
+	if err != nil {
+		conn.finish(fr)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return fail(res.HandleGatewayTimeout)
+		}
+		log.Printf("Invalid response from FastCGI backend %v: %v", route.client.addr, err)
+		return fail(res.HandleBadGateway)
+	}
+	stdout := io.MultiReader(br, out)
+	if !hasResponseBody(req.Method, res.StatusCode) {
+		_, _ = io.Copy(io.Discard, stdout)
+		conn.finish(fr)
+		return res
+	}
+	res.Body = stdout
+	res.done = func(error) {
+		conn.finish(fr)
+	}
+	return res
+}
+
+// fastCGIClient sends requests to a FastCGI backend, reusing connections
+// and, if the backend supports it, multiplexing requests over them
+type fastCGIClient struct {
+	network string
+	addr    string
+	timeout time.Duration
+
+	mu    sync.Mutex
+	conns []*fcgiConn
+}
+
+// Method which parses a backend address: "unix:/path/to/socket" or an
+// absolute socket path for a Unix socket, "host:port" for TCP
+func parseFastCGIAddress(address string) (network string, addr string, err error) {
+	if strings.HasPrefix(address, "unix:") || strings.HasPrefix(address, "/") {
+		addr = strings.TrimPrefix(address, "unix:")
+		if len(addr) == 0 {
+			return "", "", fmt.Errorf("empty socket path in %q", address)
+		}
+		return "unix", addr, nil
+	}
+	if host, port, err := net.SplitHostPort(address); err != nil || len(host) == 0 || len(port) == 0 {
+		return "", "", fmt.Errorf("%q is neither host:port nor unix:/path", address)
+	}
+	return TCP, address, nil
+}
+
+// Method which sends a request with params and body to the backend. A
+// request without a body is retried once on a new connection if a reused
+// one turns out to be closed.
+func (c *fastCGIClient) roundTrip(params []string, body io.Reader) (*fcgiConn, *fcgiRequest, error) {
+	for {
+		conn, fr, reused, err := c.acquire()
+		if err != nil {
+			return nil, nil, err
+		}
+		err = conn.send(fr, params, body)
+		if err == nil {
+			return conn, fr, nil
+		}
+		// Output the backend sent before failing isn't waited for
+		close(fr.abandoned)
+		conn.fail(err)
+		if !reused || body != nil {
+			return nil, nil, err
+		}
+	}
+}
+
+// Method which starts a request on a connection that can take it, dialing
+// a new one if none can. Connections of a backend that doesn't multiplex
+// carry one request at a time.
+func (c *fastCGIClient) acquire() (*fcgiConn, *fcgiRequest, bool, error) {
+	c.mu.Lock()
+	var best *fcgiConn
+	bestLoad := 0
+	open := c.conns[:0]
+	for _, conn := range c.conns {
+		load, multiplex, broken := conn.state()
+		if broken {
+			continue
+		}
+		open = append(open, conn)
+		if (load == 0 || multiplex) && (best == nil || load < bestLoad) {
+			best, bestLoad = conn, load
+		}
+	}
+	c.conns = open
+	if best != nil {
+		fr := best.start()
+		c.mu.Unlock()
+		return best, fr, true, nil
+	}
+	c.mu.Unlock()
+
+	netConn, err := net.DialTimeout(c.network, c.addr, CONNECT_TIMEOUT)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	conn := &fcgiConn{conn: netConn, client: c, requests: make(map[uint16]*fcgiRequest)}
+	go conn.readLoop()
+	// Ask whether requests may be multiplexed. Until the answer arrives
+	// the connection carries one request at a time.
+	if err := conn.writeRecord(fcgiGetValues, 0, encodeFastCGIPairs([]string{"FCGI_MPXS_CONNS="})); err != nil {
+		conn.fail(err)
+		return nil, nil, false, err
+	}
+	c.mu.Lock()
+	c.conns = append(c.conns, conn)
+	fr := conn.start()
+	c.mu.Unlock()
+	return conn, fr, false, nil
+}
+
+// Method which closes conn if it is idle and enough other connections are
+func (c *fastCGIClient) trimIdle(conn *fcgiConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	idle := 0
+	for _, other := range c.conns {
+		if load, _, broken := other.state(); load == 0 && !broken {
+			idle++
+		}
+	}
+	if load, _, _ := conn.state(); load == 0 && idle > MAX_IDLE_FASTCGI_CONNS {
+		conn.fail(fmt.Errorf("too many idle connections"))
+	}
+}
+
+// Method which closes the idle connections, e.g. once a reload dropped
+// the backend
+func (c *fastCGIClient) closeIdle() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, conn := range c.conns {
+		if load, _, _ := conn.state(); load == 0 {
+			conn.fail(fmt.Errorf("backend removed"))
+		}
+	}
+}
+
+// fcgiConn is a connection to a FastCGI backend. A goroutine reads the
+// records arriving on it and hands them to the requests they belong to.
+type fcgiConn struct {
+	conn   net.Conn
+	client *fastCGIClient
+
+	writeMu sync.Mutex
+
+	mu        sync.Mutex
+	requests  map[uint16]*fcgiRequest
+	nextID    uint16
+	multiplex bool
+	broken    bool
+}
+
+// fcgiRequest is a request in flight on an fcgiConn. stdout carries the
+// output of the backend and is closed by the read loop once the request
+// ended. If the connection fails instead, err is set and failed closed.
+type fcgiRequest struct {
+	id        uint16
+	stdout    chan []byte
+	abandoned chan struct{}
+	failed    chan struct{}
+	err       error
+	ended     bool
+}
+
+// Method which returns the number of requests in flight on c, whether c
+// multiplexes them and whether c is unusable
+func (c *fcgiConn) state() (int, bool, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.requests), c.multiplex, c.broken
+}
+
+// Method which registers a new request on c with an unused ID
+func (c *fcgiConn) start() *fcgiRequest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		// ID 0 is reserved for management records
+		if c.nextID++; c.nextID == 0 {
+			continue
+		}
+		if _, inUse := c.requests[c.nextID]; !inUse {
+			break
+		}
+	}
+	fr := &fcgiRequest{id: c.nextID, stdout: make(chan []byte, fcgiQueueLen), abandoned: make(chan struct{}), failed: make(chan struct{})}
+	c.requests[fr.id] = fr
+	return fr
+}
+
+// Method which sends the records starting fr: the begin request record,
+// the params and the body on stdin
+func (c *fcgiConn) send(fr *fcgiRequest, params []string, body io.Reader) error {
+	begin := []byte{0, fcgiResponder, fcgiKeepConn, 0, 0, 0, 0, 0}
+	if err := c.writeRecord(fcgiBeginRequest, fr.id, begin); err != nil {
+		return err
+	}
+	if err := c.writeStream(fcgiParams, fr.id, bytes.NewReader(encodeFastCGIPairs(params))); err != nil {
+		return err
+	}
+	if body == nil {
+		body = bytes.NewReader(nil)
+	}
+	return c.writeStream(fcgiStdin, fr.id, body)
+}
+
+// Method which writes r as a stream of records, ended by an empty one
+func (c *fcgiConn) writeStream(recType uint8, id uint16, r io.Reader) error {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if err := c.writeRecord(recType, id, buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return c.writeRecord(recType, id, nil)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Method which writes a single record, padded to a multiple of 8 bytes
+func (c *fcgiConn) writeRecord(recType uint8, id uint16, content []byte) error {
+	padding := (8 - len(content)%8) % 8
+	record := make([]byte, fcgiHeaderLen, fcgiHeaderLen+len(content)+padding)
+	record[0] = fcgiVersion
+	record[1] = recType
+	binary.BigEndian.PutUint16(record[2:4], id)
+	binary.BigEndian.PutUint16(record[4:6], uint16(len(content)))
+	record[6] = byte(padding)
+	record = append(record, content...)
+	record = append(record, make([]byte, padding)...)
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := c.conn.SetWriteDeadline(time.Now().Add(c.client.timeout)); err != nil {
+		return err
+	}
+	_, err := c.conn.Write(record)
+	return err
+}
+
+// Method which reads records until the connection fails
+func (c *fcgiConn) readLoop() {
+	br := bufio.NewReader(c.conn)
+	header := make([]byte, fcgiHeaderLen)
+	for {
+		if _, err := io.ReadFull(br, header); err != nil {
+			c.fail(err)
+			return
+		}
+		if header[0] != fcgiVersion {
+			c.fail(fmt.Errorf("unsupported FastCGI version %d", header[0]))
+			return
+		}
+		id := binary.BigEndian.Uint16(header[2:4])
+		content := make([]byte, int(binary.BigEndian.Uint16(header[4:6]))+int(header[6]))
+		if _, err := io.ReadFull(br, content); err != nil {
+			c.fail(err)
+			return
+		}
+		content = content[:binary.BigEndian.Uint16(header[4:6])]
+		switch header[1] {
+		case fcgiGetValuesResult:
+			for _, pair := range decodeFastCGIPairs(content) {
+				if pair == "FCGI_MPXS_CONNS=1" {
+					c.mu.Lock()
+					c.multiplex = true
+					c.mu.Unlock()
+				}
+			}
+		case fcgiStdout:
+			if len(content) > 0 {
+				c.deliver(id, content)
+			}
+		case fcgiStderr:
+			if len(content) > 0 {
+				log.Printf("FastCGI %v: %s", c.client.addr, strings.TrimRight(string(content), "\n"))
+			}
+		case fcgiEndRequest:
+			c.end(id)
+		}
+	}
+}
+
+// Method which hands output to the request id, unless it was abandoned
+func (c *fcgiConn) deliver(id uint16, content []byte) {
+	c.mu.Lock()
+	fr, exists := c.requests[id]
+	c.mu.Unlock()
+	if !exists {
+		return
+	}
+	select {
+	case fr.stdout <- content:
+	case <-fr.abandoned:
+	case <-fr.failed:
+	}
+}
+
+// Method which ends the request id. Like deliver it is only called by the
+// read loop, so stdout is never closed while being sent on.
+func (c *fcgiConn) end(id uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if fr, exists := c.requests[id]; exists {
+		delete(c.requests, id)
+		close(fr.stdout)
+	}
+}
+
+// Method which marks c unusable, closes it and fails its requests. It may
+// be called from any goroutine, so it leaves stdout to the read loop.
+func (c *fcgiConn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.broken {
+		return
+	}
+	c.broken = true
+	_ = c.conn.Close()
+	for id, fr := range c.requests {
+		fr.err = err
+		delete(c.requests, id)
+		close(fr.failed)
+	}
+}
+
+// Method which is called once the response to fr has been relayed. A
+// request whose output wasn't read to the end is aborted.
+func (c *fcgiConn) finish(fr *fcgiRequest) {
+	if !fr.ended {
+		close(fr.abandoned)
+		c.mu.Lock()
+		_, inFlight := c.requests[fr.id]
+		multiplex := c.multiplex
+		c.mu.Unlock()
+		if inFlight {
+			// Without multiplexing the connection would stay busy until the
+			// backend gives up, so it is dropped
+			if !multiplex {
+				c.fail(fmt.Errorf("request aborted"))
+				return
+			}
+			if err := c.writeRecord(fcgiAbortRequest, fr.id, nil); err != nil {
+				c.fail(err)
+				return
+			}
+		}
+	}
+	c.client.trimIdle(c)
+}
+
+// fcgiStdoutReader reads the output of a FastCGI request, giving every
+// read the backend's timeout
+type fcgiStdoutReader struct {
+	req     *fcgiRequest
+	timeout time.Duration
+	chunk   []byte
+}
+
+func (r *fcgiStdoutReader) Read(p []byte) (int, error) {
+	if len(r.chunk) == 0 {
+		timer := time.NewTimer(r.timeout)
+		defer timer.Stop()
+		select {
+		case chunk, ok := <-r.req.stdout:
+			if !ok {
+				r.req.ended = true
+				return 0, io.EOF
+			}
+			r.chunk = chunk
+		case <-r.req.failed:
+			return 0, r.req.err
+		case <-timer.C:
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+	n := copy(p, r.chunk)
+	r.chunk = r.chunk[n:]
+	return n, nil
+}
+
+// Method which encodes "name=value" pairs in the FastCGI name-value format
+func encodeFastCGIPairs(pairs []string) []byte {
+	var b bytes.Buffer
+	writeLen := func(n int) {
+		if n < 128 {
+			b.WriteByte(byte(n))
+			return
+		}
+		var buf [4]byte
+		binary.BigEndian.PutUint32(buf[:], uint32(n)|1<<31)
+		b.Write(buf[:])
+	}
+	for _, pair := range pairs {
+		name, value, _ := strings.Cut(pair, "=")
+		writeLen(len(name))
+		writeLen(len(value))
+		b.WriteString(name)
+		b.WriteString(value)
+	}
+	return b.Bytes()
+}
+
+// Method which decodes FastCGI name-value pairs into "name=value" strings,
+// stopping at the first malformed one
+func decodeFastCGIPairs(content []byte) []string {
+	pairs := make([]string, 0)
+	readLen := func() (int, bool) {
+		if len(content) == 0 {
+			return 0, false
+		}
+		if content[0] < 128 {
+			n := int(content[0])
+			content = content[1:]
+			return n, true
+		}
+		if len(content) < 4 {
+			return 0, false
+		}
+		n := int(binary.BigEndian.Uint32(content[:4]) &^ (1 << 31))
+		content = content[4:]
+		return n, true
+	}
+	for len(content) > 0 {
+		nameLen, ok1 := readLen()
+		valueLen, ok2 := readLen()
+		if !ok1 || !ok2 || nameLen+valueLen > len(content) {
+			break
+		}
+		pairs = append(pairs, string(content[:nameLen])+"="+string(content[nameLen:nameLen+valueLen]))
+		content = content[nameLen+valueLen:]
+	}
+	return pairs
+}
@@ -0,0 +1,221 @@
+package tritonhttp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countinglistener counts the connections it accepts
+type countinglistener struct {
+	net.Listener
+	accepted atomic.Int32
+}
+
+func (l *countinglistener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.accepted.Add(1)
+	}
+	return conn, err
+}
+
+func TestFastCGI(t *testing.T) {
+	holding := make(chan struct{})
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/app/hold":
+			close(holding)
+			<-release
+		case "/app/slow":
+			time.Sleep(time.Second)
+		}
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Add("Set-Cookie", "a=1")
+		w.Header().Add("Set-Cookie", "b=2")
+		env := fcgi.ProcessEnv(r)
+		// A Proxy header would have arrived as HTTP_PROXY
+		fmt.Fprintf(w, "%s %s body=%s custom=%s proxy=%s script=%s", r.Method, r.URL.RequestURI(), body, r.Header.Get("X-Custom"), r.Header.Get("Proxy"), env["SCRIPT_FILENAME"])
+	})
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	backend := &countinglistener{Listener: tcpListener}
+	t.Cleanup(func() { backend.Close() })
+	go fcgi.Serve(backend, handler)
+	tmp := t.TempDir()
+	socket := filepath.Join(tmp, "fcgi.sock")
+	unixListener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	t.Cleanup(func() { unixListener.Close() })
+	go fcgi.Serve(unixListener, handler)
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	down.Close()
+
+	if err := os.MkdirAll(filepath.Join(tmp, "site"), 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := os.WriteFile(filepath.Join(tmp, "site", "index.html"), []byte("index"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	config := filepath.Join(tmp, "virtual_hosts.yaml")
+	if err := os.WriteFile(config, []byte(`virtual_hosts:
+  - hostName: "site"
+    docRoot: "site"
+    fastcgi:
+      - path: "/app"
+        address: "`+backend.Addr().String()+`"
+        timeout: 300ms
+      - path: "/sock"
+        address: "unix:`+socket+`"
+        script: "/srv/front.php"
+      - path: "/down"
+        address: "`+down.Addr().String()+`"
+`), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	c, err := LoadConfig(config, tmp)
+	if err != nil {
+		t.Fatalf("Expected config to be valid but got %v\n", err)
+	}
+	s := &Server{}
+	if err := s.ApplyConfig(c); err != nil {
+		t.Fatal(err.Error())
+	}
+	port := launchserver(t, s)
+	request := func(req string) (*http.Response, string) {
+		t.Helper()
+		resp := requestfrom(t, "127.0.0.1", port, req)
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	// Request line, headers and body reach the backend, chunked bodies
+	// with a CONTENT_LENGTH, but no HTTP_PROXY (httpoxy)
+	docroot := filepath.Join(tmp, "site")
+	for _, framing := range []string{"Content-Length: 5\r\n\r\nhello", "Transfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n"} {
+		resp, body := request("POST /app/echo?q=1 HTTP/1.1\r\nHost: site\r\nConnection: close\r\nX-Custom: yes\r\nProxy: http://evil.example:8080\r\n" + framing)
+		expected := "POST /app/echo?q=1 body=hello custom=yes proxy= script=" + filepath.Join(docroot, "app", "echo")
+		if resp.StatusCode != 200 || body != expected || len(resp.Header.Values("Set-Cookie")) != 2 {
+			t.Fatalf("Expected %q but got %v %q %v\n", expected, resp.StatusCode, body, resp.Header)
+		}
+	}
+	resp, body := request("GET /sock/page HTTP/1.1\r\nHost: site\r\nConnection: close\r\n\r\n")
+	if resp.StatusCode != 200 || body != "GET /sock/page body= custom= proxy= script=/srv/front.php" {
+		t.Fatalf("Expected the Unix socket backend to run the front controller but got %v %q\n", resp.StatusCode, body)
+	}
+
+	// The backend connection is kept, and shared by concurrent requests
+	if accepted := backend.accepted.Load(); accepted != 1 {
+		t.Fatalf("Expected a single backend connection but got %v\n", accepted)
+	}
+	held := make(chan string)
+	go func() {
+		conn := dialfrom(t, "127.0.0.1", port)
+		defer conn.Close()
+		conn.Write([]byte("GET /app/hold HTTP/1.1\r\nHost: site\r\nConnection: close\r\n\r\n"))
+		held <- string(readuntilclosed(t, conn, 5*time.Second))
+	}()
+	<-holding
+	resp, _ = request("GET /app/echo HTTP/1.1\r\nHost: site\r\nConnection: close\r\n\r\n")
+	close(release)
+	if response := <-held; resp.StatusCode != 200 || !strings.HasPrefix(response, "HTTP/1.1 200") {
+		t.Fatalf("Expected both concurrent requests to succeed but got %v and %q\n", resp.StatusCode, response)
+	}
+	if accepted := backend.accepted.Load(); accepted != 1 {
+		t.Fatalf("Expected concurrent requests to be multiplexed but the backend accepted %v connections\n", accepted)
+	}
+
+	tests := []struct {
+		path       string
+		statusCode int
+	}{
+		{"/app/slow", 504},
+		{"/down/page", 502},
+		// Other paths are served from the docroot
+		{"/index.html", 200},
+	}
+	for _, tt := range tests {
+		resp, _ := request("GET " + tt.path + " HTTP/1.1\r\nHost: site\r\nConnection: close\r\n\r\n")
+		if resp.StatusCode != tt.statusCode {
+			t.Fatalf("Expected response code of %v for %v but got %v\n", tt.statusCode, tt.path, resp.StatusCode)
+		}
+	}
+}
+
+func TestFastCGIOutputBeforeInput(t *testing.T) {
+	// The backend answers at length before it reads the body, so the
+	// output queue fills up and both sides block until the server gives
+	// up sending the body
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 16*fcgiQueueLen; i++ {
+			w.Write(make([]byte, 60000))
+			w.(http.Flusher).Flush()
+		}
+		io.Copy(io.Discard, r.Body)
+	})
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	t.Cleanup(func() { backend.Close() })
+	go fcgi.Serve(backend, handler)
+	tmp := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(tmp, "site"), 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+	config := filepath.Join(tmp, "virtual_hosts.yaml")
+	if err := os.WriteFile(config, []byte(`virtual_hosts:
+  - hostName: "site"
+    docRoot: "site"
+    fastcgi:
+      - path: "/app"
+        address: "`+backend.Addr().String()+`"
+        timeout: 300ms
+`), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	c, err := LoadConfig(config, tmp)
+	if err != nil {
+		t.Fatalf("Expected config to be valid but got %v\n", err)
+	}
+	s := &Server{}
+	if err := s.ApplyConfig(c); err != nil {
+		t.Fatal(err.Error())
+	}
+	port := launchserver(t, s)
+
+	for i := 0; i < 3; i++ {
+		conn := dialfrom(t, "127.0.0.1", port)
+		const size = 32 << 20
+		go func() {
+			fmt.Fprintf(conn, "POST /app/upload HTTP/1.1\r\nHost: site\r\nConnection: close\r\nContent-Length: %d\r\n\r\n", size)
+			conn.Write(make([]byte, size))
+		}()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("Error parsing response: %v\n", err.Error())
+		}
+		if resp.StatusCode != 502 {
+			t.Fatalf("Expected the stalled upload to get 502 but got %v\n", resp.StatusCode)
+		}
+	}
+}
@@ -19,6 +19,9 @@ func Fetch(hostname string, port string, inp []byte) ([]byte, time.Duration, err
                 log.Printf("Error connecting to web server: %v\n", err.Error())
                 return nil, 0, errors.New("dial timeout")
         }
+        // close the connection once the response is read, or it stays
+        // open until the garbage collector gets to it
+        defer conn.Close()
         
         // start timing this http session
         start := time.Now()
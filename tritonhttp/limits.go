@@ -0,0 +1,118 @@
+package tritonhttp
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// DEFAULT_RETRY_AFTER is the default for Server.RetryAfter
+	DEFAULT_RETRY_AFTER time.Duration = 1 * time.Second
+	// Bounds of the delay between retries of a failed Accept
+	MIN_ACCEPT_BACKOFF time.Duration = 5 * time.Millisecond
+	MAX_ACCEPT_BACKOFF time.Duration = 1 * time.Second
+	// How long a refused connection may take to send its request before
+	// the 503 is written anyway
+	REFUSE_READ_TIMEOUT time.Duration = 1 * time.Second
+	// How long writing the 503 to a refused connection may take
+	REFUSE_WRITE_TIMEOUT time.Duration = 100 * time.Millisecond
+	// MAX_REFUSALS is the number of connections answered with 503 at once.
+	// Connections refused beyond it are closed without a response.
+	MAX_REFUSALS = 64
+)
+
+// connCounter counts open connections in total and per client IP
+type connCounter struct {
+	mu    sync.Mutex
+	total int
+	perIP map[string]int
+}
+
+// Method which counts a new connection from ip unless that would exceed
+// maxConns or maxPerIP, in which case it returns the limit hit
+func (c *connCounter) acquire(ip string, maxConns int, maxPerIP int) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if maxConns > 0 && c.total >= maxConns {
+		return "max_conns"
+	}
+	if maxPerIP > 0 && c.perIP[ip] >= maxPerIP {
+		return "max_conns_per_ip"
+	}
+	if c.perIP == nil {
+		c.perIP = make(map[string]int)
+	}
+	c.total++
+	c.perIP[ip]++
+	return ""
+}
+
+// Method which forgets a connection counted by acquire
+func (c *connCounter) release(ip string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.total--
+	if c.perIP[ip]--; c.perIP[ip] <= 0 {
+		delete(c.perIP, ip)
+	}
+}
+
+// Method which refuses a connection over the connection limits in the
+// background, or closes it right away if MAX_REFUSALS connections are
+// already being refused, so that a flood of connections can't pile up
+// goroutines
+func (s *Server) refuseConnection(conn net.Conn) {
+	if s.refusing.Add(1) > MAX_REFUSALS {
+		s.refusing.Add(-1)
+		_ = conn.Close()
+		return
+	}
+	go func() {
+		defer s.refusing.Add(-1)
+		s.sendServiceUnavailable(conn)
+	}()
+}
+
+// Method which answers a refused connection with 503 and closes it. The
+// request is read first, if it arrives in time, so closing the connection
+// doesn't reset it before the client got the response. The response is
+// written directly, with a short deadline, rather than through
+// writeResponse.
+func (s *Server) sendServiceUnavailable(conn net.Conn) {
+	defer conn.Close()
+	start := time.Now()
+	_ = conn.SetReadDeadline(start.Add(REFUSE_READ_TIMEOUT))
+	buf := make([]byte, 1024)
+	_, _ = conn.Read(buf)
+	res := &Response{}
+	res.HandleServiceUnavailable(durationOr(s.RetryAfter, DEFAULT_RETRY_AFTER))
+	res.Headers[CONNECTION] = CLOSE
+	_ = conn.SetWriteDeadline(time.Now().Add(REFUSE_WRITE_TIMEOUT))
+	_ = res.Write(conn)
+	s.logResponse(conn, nil, res, start)
+}
+
+// Method which returns the IP address of the client at the other end of conn
+func remoteIP(conn net.Conn) string {
+	addr := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// Method which reports whether Accept failed for a reason that may go
+// away, like running out of file descriptors, rather than because the
+// listener was closed
+func isTemporaryAcceptError(err error) bool {
+	if errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) ||
+		errors.Is(err, syscall.ENOBUFS) || errors.Is(err, syscall.ENOMEM) ||
+		errors.Is(err, syscall.ECONNABORTED) {
+		return true
+	}
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
@@ -0,0 +1,103 @@
+package tritonhttp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestConnectionLimits(t *testing.T) {
+	s := &Server{
+		VirtualHosts: map[string]fs.FS{
+			"site": fstest.MapFS{"index.html": {Data: []byte("index")}},
+		},
+		IdleTimeout:   time.Minute,
+		MaxConns:      3,
+		MaxConnsPerIP: 2,
+		RetryAfter:    1500 * time.Millisecond,
+		Metrics:       NewMetrics(),
+	}
+	port := launchserver(t, s)
+	req := "GET / HTTP/1.1\r\nHost: site\r\nConnection: close\r\n\r\n"
+
+	// Two idle connections use up the limit of 127.0.0.1
+	held := []net.Conn{dialfrom(t, "127.0.0.1", port), dialfrom(t, "127.0.0.1", port)}
+	resp := waitforstatus(t, "127.0.0.1", port, req, 503)
+	if ra := resp.Header.Get("Retry-After"); ra != "2" {
+		t.Fatalf("Expected Retry-After 2 but got %q\n", ra)
+	}
+	// Other clients are still served until the global limit is reached
+	waitforstatus(t, "127.0.0.2", port, req, 200)
+	held = append(held, dialfrom(t, "127.0.0.3", port))
+	waitforstatus(t, "127.0.0.2", port, req, 503)
+
+	// Closing a connection makes room again
+	held[0].Close()
+	waitforstatus(t, "127.0.0.2", port, req, 200)
+	held[2].Close()
+	waitforstatus(t, "127.0.0.1", port, req, 200)
+
+	var metrics bytes.Buffer
+	if _, err := s.Metrics.WriteTo(&metrics); err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, reason := range []string{"max_conns", "max_conns_per_ip"} {
+		if !strings.Contains(metrics.String(), `tritonhttp_rejected_connections_total{reason="`+reason+`"}`) {
+			t.Fatalf("Expected rejected connections to be counted for %v:\n%s", reason, metrics.String())
+		}
+	}
+}
+
+func TestRefusalLimit(t *testing.T) {
+	s := &Server{
+		VirtualHosts: map[string]fs.FS{
+			"site": fstest.MapFS{"index.html": {Data: []byte("index")}},
+		},
+		IdleTimeout: time.Minute,
+		MaxConns:    1,
+	}
+	port := launchserver(t, s)
+	req := "GET / HTTP/1.1\r\nHost: site\r\nConnection: close\r\n\r\n"
+	dialfrom(t, "127.0.0.1", port)
+	waitforstatus(t, "127.0.0.1", port, req, 503)
+	for s.refusing.Load() > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Once MAX_REFUSALS connections are being refused, further ones are
+	// closed without a response
+	s.refusing.Store(MAX_REFUSALS)
+	conn := dialfrom(t, "127.0.0.1", port)
+	if _, err := conn.Write([]byte(req)); err != nil {
+		t.Fatal(err.Error())
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(REFUSE_READ_TIMEOUT / 2))
+	// Closing with the request unread may reset the connection
+	if data, err := io.ReadAll(conn); len(data) > 0 || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Expected the connection to be closed right away but got %q, %v\n", data, err)
+	}
+	s.refusing.Store(0)
+	waitforstatus(t, "127.0.0.1", port, req, 503)
+}
+
+// flakylistener fails its first failures calls to Accept with err
+type flakylistener struct {
+	net.Listener
+	failures int
+	err      error
+}
+
+func (l *flakylistener) Accept() (net.Conn, error) {
+	if l.failures > 0 {
+		l.failures--
+		return nil, l.err
+	}
+	return l.Listener.Accept()
+}
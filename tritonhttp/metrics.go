@@ -0,0 +1,282 @@
+package tritonhttp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	sizeBuckets     = []float64{100, 1000, 10000, 100000, 1000000, 10000000}
+	pipelineBuckets = []float64{1, 2, 4, 8, 16, 32}
+)
+
+// Metrics collects counters about the server and exposes them in the
+// Prometheus text format. It implements http.Handler so it can be served
+// on an admin listener, e.g. with http.ListenAndServe(":9090", metrics).
+type Metrics struct {
+	mu       sync.Mutex
+	counters map[string]*metricFamily
+	gauges   map[string]*metricFamily
+	hists    map[string]*metricFamily
+}
+
+// metricFamily holds the values of one metric, keyed by rendered labels
+type metricFamily struct {
+	help   string
+	values map[string]float64
+	hists  map[string]*histogram
+}
+
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+// connState is the state of a connection as reported by the
+// tritonhttp_connections gauge
+type connState string
+
+const (
+	connIdle   connState = "idle"
+	connActive connState = "active"
+	connClosed connState = ""
+)
+
+// NewMetrics returns an empty set of metrics
+func NewMetrics() *Metrics {
+	return &Metrics{
+		counters: make(map[string]*metricFamily),
+		gauges:   make(map[string]*metricFamily),
+		hists:    make(map[string]*metricFamily),
+	}
+}
+
+// AddCounter adds delta to the counter name with the given label
+// key-value pairs, creating it with help as its description if needed
+func (m *Metrics) AddCounter(name string, help string, delta float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	family(m.counters, name, help).values[renderLabels(labels)] += delta
+}
+
+// AddGauge adds delta to the gauge name with the given label key-value
+// pairs, creating it with help as its description if needed
+func (m *Metrics) AddGauge(name string, help string, delta float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	family(m.gauges, name, help).values[renderLabels(labels)] += delta
+}
+
+// Observe records value in the histogram name with the given label
+// key-value pairs, creating it with buckets and help if needed
+func (m *Metrics) Observe(name string, help string, buckets []float64, value float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f := family(m.hists, name, help)
+	key := renderLabels(labels)
+	h, exists := f.hists[key]
+	if !exists {
+		h = &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+		f.hists[key] = h
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+func family(families map[string]*metricFamily, name string, help string) *metricFamily {
+	f, exists := families[name]
+	if !exists {
+		f = &metricFamily{help: help, values: make(map[string]float64), hists: make(map[string]*histogram)}
+		families[name] = f
+	}
+	return f
+}
+
+// Method which renders label key-value pairs as {k1="v1",k2="v2"}
+func renderLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+"="+quoteLabel(labels[i+1]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// WriteTo writes all metrics in the Prometheus text exposition format
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	writeFamilies(bw, "counter", m.counters)
+	writeFamilies(bw, "gauge", m.gauges)
+	for _, name := range sortedKeys(m.hists) {
+		f := m.hists[name]
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s histogram\n", name, f.help, name)
+		for _, key := range sortedKeys(f.hists) {
+			h := f.hists[key]
+			for i, bound := range h.buckets {
+				fmt.Fprintf(bw, "%s_bucket%s %d\n", name, withLabel(key, "le", formatFloat(bound)), h.counts[i])
+			}
+			fmt.Fprintf(bw, "%s_bucket%s %d\n", name, withLabel(key, "le", "+Inf"), h.count)
+			fmt.Fprintf(bw, "%s_sum%s %s\n", name, key, formatFloat(h.sum))
+			fmt.Fprintf(bw, "%s_count%s %d\n", name, key, h.count)
+		}
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// ServeHTTP serves the metrics to a Prometheus scrape
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = m.WriteTo(w)
+}
+
+func writeFamilies(w io.Writer, kind string, families map[string]*metricFamily) {
+	for _, name := range sortedKeys(families) {
+		f := families[name]
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, f.help, name, kind)
+		for _, key := range sortedKeys(f.values) {
+			fmt.Fprintf(w, "%s%s %s\n", name, key, formatFloat(f.values[key]))
+		}
+	}
+}
+
+// Method which adds the label k="v" to rendered labels
+func withLabel(labels string, k string, v string) string {
+	label := k + "=" + quoteLabel(v)
+	if len(labels) == 0 {
+		return "{" + label + "}"
+	}
+	return labels[:len(labels)-1] + "," + label + "}"
+}
+
+// Method which quotes a label value, escaping as the text format requires
+func quoteLabel(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, `"`, `\"`)
+	v = strings.ReplaceAll(v, "\n", `\n`)
+	return `"` + v + `"`
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Method which limits the method label to the methods the server knows,
+// so clients can't blow up the number of series
+func methodLabel(method string) string {
+	if knownMethods[method] {
+		return method
+	}
+	switch method {
+	case "":
+		return "none"
+	}
+	return "other"
+}
+
+// The unexported recording methods below do nothing on a nil *Metrics, so
+// the server can call them whether metrics are enabled or not.
+
+// Method which records a response written by the server
+func (m *Metrics) observeResponse(req *Request, res *Response, bytes int64, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	vhost, method := "", "none"
+	if req != nil {
+		vhost, method = req.VirtualHost, methodLabel(req.Method)
+	}
+	status := strconv.Itoa(res.StatusCode)
+	m.AddCounter("tritonhttp_requests_total", "Responses sent, by virtual host, method and status code.",
+		1, "vhost", vhost, "method", method, "status", status)
+	m.Observe("tritonhttp_request_duration_seconds", "Time from receiving a request to writing its response.",
+		durationBuckets, duration.Seconds(), "vhost", vhost)
+	m.Observe("tritonhttp_response_size_bytes", "Bytes written per response, headers included.",
+		sizeBuckets, float64(bytes), "vhost", vhost)
+}
+
+// Method which moves a connection from the state from to the state to
+// in the tritonhttp_connections gauge
+func (m *Metrics) setConnState(from *connState, to connState) {
+	if m == nil {
+		return
+	}
+	if *from == to {
+		return
+	}
+	const help = "Open connections, by whether a request is in progress."
+	if *from != connClosed {
+		m.AddGauge("tritonhttp_connections", help, -1, "state", string(*from))
+	}
+	if to != connClosed {
+		m.AddGauge("tritonhttp_connections", help, 1, "state", string(to))
+	}
+	*from = to
+}
+
+// Method which records how many pipelined requests a single read returned
+func (m *Metrics) observePipelineDepth(depth int) {
+	if m == nil {
+		return
+	}
+	m.Observe("tritonhttp_pipelined_requests", "Requests received in a single read from a connection.",
+		pipelineBuckets, float64(depth))
+}
+
+// Method which counts a connection closed because of a read timeout.
+// partial tells whether the client had sent part of a request, which is
+// answered with 400.
+func (m *Metrics) countTimeout(partial bool) {
+	if m == nil {
+		return
+	}
+	m.AddCounter("tritonhttp_timeouts_total", "Connections closed because of a read timeout, by whether a partial request was received.",
+		1, "partial", strconv.FormatBool(partial))
+}
+
+// Method which counts a connection refused because of a connection limit
+func (m *Metrics) countRejectedConn(reason string) {
+	if m == nil {
+		return
+	}
+	m.AddCounter("tritonhttp_rejected_connections_total", "Connections answered with 503 because of a connection limit, by limit.",
+		1, "reason", reason)
+}
+
+// Method which counts a request refused by the rate limit of a virtual host
+func (m *Metrics) countRateLimited(vhost string) {
+	if m == nil {
+		return
+	}
+	m.AddCounter("tritonhttp_rate_limited_total", "Requests answered with 429 by the rate limit of a virtual host.",
+		1, "vhost", vhost)
+}
@@ -0,0 +1,77 @@
+package tritonhttp
+
+import (
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestMetricsScrape(t *testing.T) {
+	s := &Server{
+		VirtualHosts: map[string]fs.FS{
+			"site": fstest.MapFS{"index.html": {Data: []byte("index")}},
+		},
+		Metrics: NewMetrics(),
+	}
+	port := launchserver(t, s)
+	admin := httptest.NewServer(s.Metrics)
+	defer admin.Close()
+
+	fetchresponse(t, port, "GET / HTTP/1.1\r\nHost: site\r\n\r\nGET /missing HTTP/1.1\r\nHost: site\r\nConnection: close\r\n\r\n")
+	fetchresponse(t, port, "FOO / HTTP/1.1\r\nHost: site\r\nConnection: close\r\n\r\n")
+
+	// Keep a connection open without sending anything
+	idle, err := net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v\n", err.Error())
+	}
+	defer idle.Close()
+
+	expected := []string{
+		`tritonhttp_requests_total{vhost="site",method="GET",status="200"} 1`,
+		`tritonhttp_requests_total{vhost="site",method="GET",status="404"} 1`,
+		`tritonhttp_requests_total{vhost="",method="other",status="400"} 1`,
+		`tritonhttp_connections{state="idle"} 1`,
+		`tritonhttp_connections{state="active"} 0`,
+		`tritonhttp_pipelined_requests_bucket{le="2"} 2`,
+		`tritonhttp_pipelined_requests_bucket{le="1"} 1`,
+		`tritonhttp_request_duration_seconds_count{vhost="site"} 2`,
+		`tritonhttp_response_size_bytes_count{vhost="site"} 2`,
+		"# TYPE tritonhttp_request_duration_seconds histogram",
+	}
+	var body []byte
+	for i := 0; i < 50; i++ {
+		resp, err := http.Get(admin.URL)
+		if err != nil {
+			t.Fatalf("Error scraping metrics: %v\n", err.Error())
+		}
+		if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+			t.Fatalf("Unexpected Content-Type %v\n", ct)
+		}
+		body, _ = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		// The idle connection shows up once the server accepted it
+		if strings.Contains(string(body), `tritonhttp_connections{state="idle"} 1`) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	lines := strings.Split(string(body), "\n")
+	for _, metric := range expected {
+		found := false
+		for _, line := range lines {
+			if line == metric {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("Expected %q in the scraped metrics:\n%s", metric, body)
+		}
+	}
+}
@@ -0,0 +1,477 @@
+package tritonhttp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DEFAULT_UPSTREAM_TIMEOUT is how long an upstream may take to answer
+	// when upstreamTimeout isn't set
+	DEFAULT_UPSTREAM_TIMEOUT time.Duration = 30 * time.Second
+	// How many idle keep-alive connections are kept per upstream
+	MAX_IDLE_UPSTREAM_CONNS = 16
+	// How long an idle upstream connection is kept before it is closed
+	UPSTREAM_IDLE_TIMEOUT time.Duration = 60 * time.Second
+	// viaName identifies the server in Via headers
+	viaName = "tritonhttpd"
+)
+
+// hopByHopHeaders only apply to a single connection and aren't forwarded
+var hopByHopHeaders = []string{
+	CONNECTION, "Keep-Alive", "Proxy-Connection", "Proxy-Authenticate",
+	"Proxy-Authorization", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// reverseProxy forwards the requests of a virtual host to its upstream
+// servers, reusing keep-alive connections to them
+type reverseProxy struct {
+	balancer
+	timeout time.Duration
+}
+
+// upstream is a server requests are forwarded to, together with its idle
+// connections and its health
+type upstream struct {
+	addr string
+
+	mu   sync.Mutex
+	idle []*upstreamConn
+	upstreamHealth
+}
+
+// upstreamConn is a connection to an upstream with the reader responses
+// are parsed from
+type upstreamConn struct {
+	net.Conn
+	br        *bufio.Reader
+	idleSince time.Time
+}
+
+// Method which returns an idle connection to u, or dials a new one. reused
+// tells whether the connection was idle, in which case the upstream may
+// have closed it in the meantime.
+func (u *upstream) get() (conn *upstreamConn, reused bool, err error) {
+	u.mu.Lock()
+	for len(u.idle) > 0 {
+		conn = u.idle[len(u.idle)-1]
+		u.idle = u.idle[:len(u.idle)-1]
+		if time.Since(conn.idleSince) < UPSTREAM_IDLE_TIMEOUT {
+			u.mu.Unlock()
+			return conn, true, nil
+		}
+		_ = conn.Close()
+	}
+	u.mu.Unlock()
+	c, err := net.DialTimeout(TCP, u.addr, CONNECT_TIMEOUT)
+	if err != nil {
+		return nil, false, err
+	}
+	return &upstreamConn{Conn: c, br: bufio.NewReader(c)}, false, nil
+}
+
+// Method which keeps conn for the next request, or closes it if enough
+// connections are idle already
+func (u *upstream) put(conn *upstreamConn) {
+	conn.idleSince = time.Now()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if len(u.idle) >= MAX_IDLE_UPSTREAM_CONNS {
+		_ = conn.Close()
+		return
+	}
+	u.idle = append(u.idle, conn)
+}
+
+// requestBodyError is a failure to read the request body from the client,
+// which isn't held against the upstream
+type requestBodyError struct {
+	err error
+}
+
+func (e *requestBodyError) Error() string {
+	return "reading request body: " + e.err.Error()
+}
+
+// requestHeadError is a request header that can't be sent upstream
+// without starting a header of its own, which isn't held against the
+// upstream either
+type requestHeadError struct {
+	key string
+}
+
+func (e *requestHeadError) Error() string {
+	return "invalid request header " + e.key
+}
+
+// Method which forwards req to one of the upstreams, picked by the load
+// balancing policy, and turns its answer into the response to the client.
+// Upstreams that can't be reached or fail answer 502, and upstreams that
+// don't answer within the timeout 504. clientIP is used by "ip-hash".
+func (p *reverseProxy) serve(req *Request, clientIP string) *Response {
+	res := &Response{}
+	u := p.pick(req, clientIP)
+	if u == nil {
+		// Every upstream is down
+		res.HandleBadGateway()
+		if req.Close {
+			res.Headers[CONNECTION] = CLOSE
+		}
+		return res
+	}
+	resp, conn, err := p.roundTrip(u, req)
+	if err != nil {
+		u.release()
+		switch err.(type) {
+		case *requestBodyError, *requestHeadError:
+		default:
+			p.failed(u)
+		}
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			res.HandleGatewayTimeout()
+		} else {
+			res.HandleBadGateway()
+		}
+		if req.Close {
+			res.Headers[CONNECTION] = CLOSE
+		}
+		return res
+	}
+	p.succeeded(u)
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		if !isUpgrade(req) {
+			// Nothing asked the upstream to switch protocols
+			u.release()
+			_ = conn.Close()
+			res.HandleBadGateway()
+			if req.Close {
+				res.Headers[CONNECTION] = CLOSE
+			}
+			return res
+		}
+		p.fillUpgrade(res, resp, conn, u)
+		return res
+	}
+	p.fillResponse(res, req, resp, conn, u)
+	return res
+}
+
+// Method which sends req to u and reads the response headers. A request
+// without a body is retried once on a fresh connection if a reused one
+// turns out to be closed.
+func (p *reverseProxy) roundTrip(u *upstream, req *Request) (*http.Response, *upstreamConn, error) {
+	head, err := p.requestHead(req, u.addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	for {
+		conn, reused, err := u.get()
+		if err != nil {
+			return nil, nil, err
+		}
+		resp, err := p.exchange(conn, req, head)
+		if err == nil {
+			return resp, conn, nil
+		}
+		_ = conn.Close()
+		if netErr, ok := err.(net.Error); (ok && netErr.Timeout()) || !reused || req.Body != nil {
+			return nil, nil, err
+		}
+	}
+}
+
+// Method which writes req, starting with its head as built by requestHead,
+// to conn and reads the response headers, skipping interim 1xx responses
+func (p *reverseProxy) exchange(conn *upstreamConn, req *Request, head string) (*http.Response, error) {
+	if err := conn.SetDeadline(time.Now().Add(p.timeout)); err != nil {
+		return nil, err
+	}
+	bw := bufio.NewWriter(conn)
+	if _, err := bw.WriteString(head); err != nil {
+		return nil, err
+	}
+	if req.Body != nil {
+		if err := p.copyBody(bw, conn, req); err != nil {
+			return nil, err
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return nil, err
+	}
+	if err := conn.SetDeadline(time.Now().Add(p.timeout)); err != nil {
+		return nil, err
+	}
+	for {
+		resp, err := http.ReadResponse(conn.br, &http.Request{Method: req.Method})
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode >= 100 && resp.StatusCode < 200 && resp.StatusCode != http.StatusSwitchingProtocols {
+			continue
+		}
+		return resp, nil
+	}
+}
+
+// Method which streams the request body upstream, keeping the chunked
+// transfer coding if the client used it. Every write gets the timeout.
+func (p *reverseProxy) copyBody(bw *bufio.Writer, conn *upstreamConn, req *Request) error {
+	var w io.Writer = bw
+	var cw io.WriteCloser
+	if req.ContentLength < 0 {
+		cw = httputil.NewChunkedWriter(bw)
+		w = cw
+	}
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := req.Body.Read(buf)
+		if n > 0 {
+			if err := conn.SetWriteDeadline(time.Now().Add(p.timeout)); err != nil {
+				return err
+			}
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return &requestBodyError{err}
+		}
+	}
+	if cw != nil {
+		if err := cw.Close(); err != nil {
+			return err
+		}
+		if _, err := bw.WriteString(carriageReturnNewLine); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Method which returns the request line and headers sent upstream for req:
+// the target in origin-form, hop-by-hop headers removed and the
+// X-Forwarded-* and Via headers added. Headers that would start a header
+// of their own are refused.
+func (p *reverseProxy) requestHead(req *Request, upstreamAddr string) (string, error) {
+	headers := make(map[string]string)
+	for key, value := range req.Headers {
+		headers[key] = value
+	}
+	removeHopByHopHeaders(headers)
+	// Upgrades, e.g. to WebSocket, are passed on so that the upstream can
+	// switch protocols
+	if isUpgrade(req) {
+		headers[CONNECTION] = "Upgrade"
+		headers["Upgrade"] = req.Headers["Upgrade"]
+	}
+	// The server answers "100 Continue" itself when the body is read
+	delete(headers, "Expect")
+	if req.stripAuthorization {
+		delete(headers, "Authorization")
+	}
+	host := req.Host
+	if len(host) == 0 {
+		host = upstreamAddr
+	}
+	headers[HOST] = host
+	if clientIP, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		headers["X-Forwarded-For"] = appendList(headers["X-Forwarded-For"], clientIP)
+	}
+	headers["X-Forwarded-Proto"] = "http"
+	if len(req.Host) > 0 {
+		headers["X-Forwarded-Host"] = req.Host
+	}
+	headers["Via"] = appendList(headers["Via"], via(req.ProtoMajor, req.ProtoMinor))
+	if req.Body != nil {
+		if req.ContentLength < 0 {
+			headers["Transfer-Encoding"] = "chunked"
+		} else {
+			headers["Content-Length"] = strconv.FormatInt(req.ContentLength, 10)
+		}
+	}
+
+	var b strings.Builder
+	target := originForm(req.URL)
+	if req.rewritten {
+		target = (&url.URL{Path: req.Path, RawQuery: req.RawQuery}).RequestURI()
+	}
+	b.WriteString(req.Method + " " + target + " HTTP/1.1\r\n")
+	for key, value := range headers {
+		if !isToken(key) || !validHeaderValue(value) {
+			return "", &requestHeadError{key}
+		}
+		b.WriteString(key + ": " + value + "\r\n")
+	}
+	b.WriteString(carriageReturnNewLine)
+	return b.String(), nil
+}
+
+// Method which turns resp into res. Bodies of unknown length are chunked
+// for HTTP/1.1 clients and delimited by closing the connection for
+// HTTP/1.0 ones. conn goes back to u once the response has been relayed.
+func (p *reverseProxy) fillResponse(res *Response, req *Request, resp *http.Response, conn *upstreamConn, u *upstream) {
+	copyResponseHead(res, resp)
+	var body *upstreamBody
+	if hasResponseBody(req.Method, resp.StatusCode) {
+		if resp.ContentLength >= 0 {
+			res.Headers["Content-Length"] = strconv.FormatInt(resp.ContentLength, 10)
+		} else if req.ProtoAtLeast(1, 1) {
+			res.Headers["Transfer-Encoding"] = "chunked"
+		} else {
+			req.Close = true
+		}
+		body = &upstreamBody{body: resp.Body, conn: conn, timeout: p.timeout}
+		res.Body = body
+	}
+	if req.Close {
+		res.Headers[CONNECTION] = CLOSE
+	}
+	reusable := !resp.Close
+	res.done = func(err error) {
+		u.release()
+		if reusable && (body == nil || (err == nil && body.eof)) {
+			u.put(conn)
+		} else {
+			_ = conn.Close()
+		}
+	}
+}
+
+// Method which turns the 101 answer of an upstream to an upgrade request
+// into res. Once res has been written the client connection is tunnelled
+// to the upstream connection, which is closed when either side is done.
+func (p *reverseProxy) fillUpgrade(res *Response, resp *http.Response, conn *upstreamConn, u *upstream) {
+	copyResponseHead(res, resp)
+	res.Headers[CONNECTION] = "Upgrade"
+	res.Headers["Upgrade"] = resp.Header.Get("Upgrade")
+	res.done = func(err error) {
+		if err != nil {
+			u.release()
+			_ = conn.Close()
+		}
+	}
+	res.Hijack = func(client net.Conn, buffered []byte) {
+		defer u.release()
+		defer conn.Close()
+		defer client.Close()
+		_ = conn.SetDeadline(time.Time{})
+		splice(client, io.MultiReader(bytes.NewReader(buffered), client), conn, conn.br)
+	}
+}
+
+// Method which copies the status and the end-to-end headers of resp to
+// res, adding Via and, if missing, Date
+func copyResponseHead(res *Response, resp *http.Response) {
+	res.AddProto(responseProto)
+	res.StatusCode = resp.StatusCode
+	res.StatusText = strings.TrimSpace(strings.TrimPrefix(resp.Status, strconv.Itoa(resp.StatusCode)))
+	res.Headers = make(map[string]string)
+	for key, values := range resp.Header {
+		separator := ", "
+		if key == "Set-Cookie" {
+			separator = "\n"
+		}
+		res.Headers[key] = strings.Join(values, separator)
+	}
+	for _, value := range resp.Header.Values(CONNECTION) {
+		for _, token := range strings.Split(value, ",") {
+			delete(res.Headers, CanonicalHeaderKey(strings.TrimSpace(token)))
+		}
+	}
+	removeHopByHopHeaders(res.Headers)
+	res.Headers["Via"] = appendList(res.Headers["Via"], via(resp.ProtoMajor, resp.ProtoMinor))
+	if len(res.Headers["Date"]) == 0 {
+		res.Headers["Date"] = FormatTime(time.Now())
+	}
+}
+
+// Method which reports whether req asks to switch to another protocol on
+// the same connection, e.g. WebSocket
+func isUpgrade(req *Request) bool {
+	return req.ProtoAtLeast(1, 1) && req.Body == nil && len(req.Headers["Upgrade"]) > 0 && hasToken(req.Headers[CONNECTION], "upgrade")
+}
+
+// upstreamBody reads a response body from an upstream, giving every read
+// the upstream timeout
+type upstreamBody struct {
+	body    io.Reader
+	conn    net.Conn
+	timeout time.Duration
+	eof     bool
+}
+
+func (ub *upstreamBody) Read(p []byte) (int, error) {
+	if err := ub.conn.SetReadDeadline(time.Now().Add(ub.timeout)); err != nil {
+		return 0, err
+	}
+	n, err := ub.body.Read(p)
+	if err == io.EOF {
+		ub.eof = true
+	}
+	return n, err
+}
+
+// Method which reports whether a response to method with the given status
+// has a body
+func hasResponseBody(method string, status int) bool {
+	return method != HEAD && status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+// Method which removes the hop-by-hop headers from headers, including the
+// ones listed in its Connection header
+func removeHopByHopHeaders(headers map[string]string) {
+	for _, token := range strings.Split(headers[CONNECTION], ",") {
+		if token = strings.TrimSpace(token); len(token) > 0 {
+			delete(headers, CanonicalHeaderKey(token))
+		}
+	}
+	for _, key := range hopByHopHeaders {
+		delete(headers, key)
+	}
+}
+
+// Method which returns the origin-form of a request-target: the path and
+// query, without the scheme and authority of the absolute-form or a
+// fragment
+func originForm(target string) string {
+	if scheme, rest, ok := strings.Cut(target, "://"); ok && isHTTPScheme(scheme) {
+		target = "/"
+		if i := strings.IndexAny(rest, "/?"); i != -1 {
+			target = rest[i:]
+			if target[0] != '/' {
+				target = "/" + target
+			}
+		}
+	}
+	if i := strings.IndexByte(target, '#'); i != -1 {
+		target = target[:i]
+	}
+	return target
+}
+
+// Method which returns the Via entry of this server for a message received
+// with the given protocol version
+func via(major, minor int) string {
+	return fmt.Sprintf("%d.%d %s", major, minor, viaName)
+}
+
+// Method which appends value to a comma-separated header list
+func appendList(list string, value string) string {
+	if len(list) == 0 {
+		return value
+	}
+	return list + ", " + value
+}
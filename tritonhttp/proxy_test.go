@@ -0,0 +1,265 @@
+package tritonhttp
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// upstreamrequest is what the stand-in upstream of the proxy tests saw
+type upstreamrequest struct {
+	Method     string
+	URI        string
+	Header     http.Header
+	Body       string
+	RemoteAddr string
+}
+
+// launchupstream starts a stand-in upstream that echoes every request as
+// JSON. It also streams a body of unknown length on /stream and answers
+// /slow only after a second.
+func launchupstream(t *testing.T) (*httptest.Server, func() int) {
+	var mu sync.Mutex
+	conns := make(map[string]bool)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		conns[r.RemoteAddr] = true
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/stream":
+			w.Write([]byte("first,"))
+			w.(http.Flusher).Flush()
+			w.Write([]byte("second"))
+			return
+		case "/slow":
+			time.Sleep(time.Second)
+		}
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Add("Set-Cookie", "a=1")
+		w.Header().Add("Set-Cookie", "b=2")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(upstreamrequest{r.Method, r.RequestURI, r.Header, string(body), r.RemoteAddr})
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(conns)
+	}
+}
+
+func TestReverseProxy(t *testing.T) {
+	upstream, upstreamconns := launchupstream(t)
+	down, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	down.Close()
+	tmp := t.TempDir()
+	config := filepath.Join(tmp, "virtual_hosts.yaml")
+	if err := os.WriteFile(config, []byte(`virtual_hosts:
+  - hostName: "app"
+    upstream: "`+upstream.Listener.Addr().String()+`"
+    upstreamTimeout: 300ms
+  - hostName: "down"
+    upstream: "`+down.Addr().String()+`"
+`), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	c, err := LoadConfig(config, tmp)
+	if err != nil {
+		t.Fatalf("Expected config to be valid but got %v\n", err)
+	}
+	s := &Server{}
+	if err := s.ApplyConfig(c); err != nil {
+		t.Fatal(err.Error())
+	}
+	port := launchserver(t, s)
+
+	conn := dialfrom(t, "127.0.0.1", port)
+	br := bufio.NewReader(conn)
+	roundtrip := func(req string) (*http.Response, string) {
+		t.Helper()
+		if _, err := conn.Write([]byte(req)); err != nil {
+			t.Fatal(err.Error())
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("Error parsing response: %v\n", err.Error())
+		}
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("Error reading response body: %v\n", err.Error())
+		}
+		return resp, string(body)
+	}
+	echoed := func(body string) upstreamrequest {
+		t.Helper()
+		var seen upstreamrequest
+		if err := json.Unmarshal([]byte(body), &seen); err != nil {
+			t.Fatalf("Expected the upstream to echo the request but got %q\n", body)
+		}
+		return seen
+	}
+
+	// Hop-by-hop headers are dropped and forwarding headers added
+	resp, body := roundtrip("GET http://app/echo?q=1#top HTTP/1.1\r\nHost: app\r\n" +
+		"Connection: keep-alive, X-Hop\r\nX-Hop: 1\r\nKeep-Alive: timeout=5\r\n" +
+		"X-Forwarded-For: 192.0.2.1\r\nVia: 1.1 edge\r\nX-Custom: yes\r\n\r\n")
+	seen := echoed(body)
+	if resp.StatusCode != 200 || seen.Method != "GET" || seen.URI != "/echo?q=1" {
+		t.Fatalf("Expected GET /echo?q=1 to be forwarded but got %v %+v\n", resp.StatusCode, seen)
+	}
+	expected := map[string]string{
+		"X-Hop":             "",
+		"Keep-Alive":        "",
+		"X-Custom":          "yes",
+		"X-Forwarded-For":   "192.0.2.1, 127.0.0.1",
+		"X-Forwarded-Proto": "http",
+		"X-Forwarded-Host":  "app",
+		"Via":               "1.1 edge, 1.1 tritonhttpd",
+	}
+	for key, value := range expected {
+		if got := seen.Header.Get(key); got != value {
+			t.Fatalf("Expected upstream header %v to be %q but got %q\n", key, value, got)
+		}
+	}
+	if got := resp.Header.Values("Set-Cookie"); len(got) != 2 || got[0] != "a=1" || got[1] != "b=2" {
+		t.Fatalf("Expected both cookies to be relayed but got %v\n", got)
+	}
+	if resp.Header.Get("Via") != "1.1 tritonhttpd" || resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("Expected upstream response headers plus Via but got %v\n", resp.Header)
+	}
+
+	// Bodies are forwarded, whether sized or chunked
+	_, body = roundtrip("POST /echo HTTP/1.1\r\nHost: app\r\nContent-Length: 5\r\n\r\nhello")
+	if seen := echoed(body); seen.Method != "POST" || seen.Body != "hello" {
+		t.Fatalf("Expected the POST body to be forwarded but got %+v\n", seen)
+	}
+	_, body = roundtrip("PUT /echo HTTP/1.1\r\nHost: app\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"6\r\nchunk \r\n7\r\nencoded\r\n0\r\n\r\n")
+	if seen := echoed(body); seen.Method != "PUT" || seen.Body != "chunk encoded" {
+		t.Fatalf("Expected the chunked body to be forwarded but got %+v\n", seen)
+	}
+
+	// "100 Continue" is sent once the proxy reads the body
+	if _, err := conn.Write([]byte("POST /echo HTTP/1.1\r\nHost: app\r\nExpect: 100-continue\r\nContent-Length: 4\r\n\r\n")); err != nil {
+		t.Fatal(err.Error())
+	}
+	line, err := br.ReadString('\n')
+	if err != nil || line != "HTTP/1.1 100 Continue\r\n" {
+		t.Fatalf("Expected 100 Continue but got %q %v\n", line, err)
+	}
+	br.ReadString('\n')
+	_, body = roundtrip("body")
+	if seen := echoed(body); seen.Body != "body" || seen.Header.Get("Expect") != "" {
+		t.Fatalf("Expected the body to follow 100 Continue but got %+v\n", seen)
+	}
+
+	// A body of unknown length is chunked for HTTP/1.1 clients
+	resp, body = roundtrip("GET /stream HTTP/1.1\r\nHost: app\r\n\r\n")
+	if body != "first,second" || len(resp.TransferEncoding) != 1 || resp.TransferEncoding[0] != "chunked" {
+		t.Fatalf("Expected a chunked streamed body but got %q %v\n", body, resp.TransferEncoding)
+	}
+
+	// Every request so far reused the same upstream connection
+	if n := upstreamconns(); n != 1 {
+		t.Fatalf("Expected the upstream connection to be reused but saw %v connections\n", n)
+	}
+
+	// HTTP/1.0 clients get a body of unknown length delimited by close
+	resp = requestfrom(t, "127.0.0.1", port, "GET /stream HTTP/1.0\r\nHost: app\r\nConnection: keep-alive\r\n\r\n")
+	body10, _ := io.ReadAll(resp.Body)
+	if string(body10) != "first,second" || !resp.Close {
+		t.Fatalf("Expected a close-delimited body but got %q (close %v)\n", body10, resp.Close)
+	}
+
+	// Upstream failures
+	resp = requestfrom(t, "127.0.0.1", port, "GET / HTTP/1.1\r\nHost: down\r\nConnection: close\r\n\r\n")
+	if resp.StatusCode != 502 {
+		t.Fatalf("Expected 502 for an unreachable upstream but got %v\n", resp.StatusCode)
+	}
+	resp = requestfrom(t, "127.0.0.1", port, "GET /slow HTTP/1.1\r\nHost: app\r\nConnection: close\r\n\r\n")
+	if resp.StatusCode != 504 {
+		t.Fatalf("Expected 504 for a slow upstream but got %v\n", resp.StatusCode)
+	}
+}
+
+func TestProxyAuthorization(t *testing.T) {
+	upstream, _ := launchupstream(t)
+	tmp := t.TempDir()
+	sha := sha1.Sum([]byte("alicepw"))
+	if err := os.WriteFile(filepath.Join(tmp, "htpasswd"), []byte("alice:{SHA}"+base64.StdEncoding.EncodeToString(sha[:])+"\n"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	config := filepath.Join(tmp, "virtual_hosts.yaml")
+	if err := os.WriteFile(config, []byte(`virtual_hosts:
+  - hostName: "app"
+    upstream: "`+upstream.Listener.Addr().String()+`"
+    auth:
+      - path: "/"
+        htpasswd: "`+filepath.Join(tmp, "htpasswd")+`"
+      - path: "/forward/"
+        htpasswd: "`+filepath.Join(tmp, "htpasswd")+`"
+        forwardAuthorization: true
+`), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	c, err := LoadConfig(config, tmp)
+	if err != nil {
+		t.Fatalf("Expected config to be valid but got %v\n", err)
+	}
+	s := &Server{}
+	if err := s.ApplyConfig(c); err != nil {
+		t.Fatal(err.Error())
+	}
+	port := launchserver(t, s)
+
+	authorization := "Basic " + base64.StdEncoding.EncodeToString([]byte("alice:alicepw"))
+	for _, tt := range []struct {
+		path          string
+		authorization string
+	}{
+		// Credentials checked by the server aren't passed on
+		{"/", ""},
+		{"/forward/", authorization},
+	} {
+		resp := fetchresponse(t, port, "GET "+tt.path+" HTTP/1.1\r\nHost: app\r\nAuthorization: "+authorization+"\r\nConnection: close\r\n\r\n")
+		if resp.StatusCode != 200 {
+			t.Fatalf("%v: expected response code of 200 but got: %v\n", tt.path, resp.StatusCode)
+		}
+		var seen upstreamrequest
+		if err := json.NewDecoder(resp.Body).Decode(&seen); err != nil {
+			t.Fatal(err.Error())
+		}
+		if got := seen.Header.Get("Authorization"); got != tt.authorization {
+			t.Fatalf("%v: expected the upstream to get Authorization %q but got %q\n", tt.path, tt.authorization, got)
+		}
+	}
+}
+
+func TestProxyRequestHeadValidation(t *testing.T) {
+	p := &reverseProxy{}
+	for _, headers := range []map[string]string{
+		{"X-A": "a\r\nContent-Length: 40"},
+		{"X-A": "a\nContent-Length: 40"},
+		{"X-A": "a\x00"},
+		{"X-A\r\nContent-Length": "40"},
+	} {
+		req := &Request{Method: GET, URL: "/", Host: "app", Headers: headers, RemoteAddr: "127.0.0.1:1234", ProtoMajor: 1, ProtoMinor: 1}
+		if _, err := p.requestHead(req, "127.0.0.1:80"); err == nil {
+			t.Fatalf("Expected %q to be refused\n", headers)
+		}
+	}
+}
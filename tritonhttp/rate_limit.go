@@ -0,0 +1,165 @@
+package tritonhttp
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often a RateLimiter drops the buckets of clients that went quiet
+const RATE_LIMIT_SWEEP_INTERVAL time.Duration = time.Minute
+
+// RateLimiter is a set of token buckets, one per client. Each bucket holds
+// up to Burst tokens and is refilled at Rate tokens per second; every
+// request takes one token.
+type RateLimiter struct {
+	Rate  float64
+	Burst int
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a RateLimiter allowing rate requests per second
+// per client, with bursts of up to burst requests. A burst below one
+// allows a single request at a time.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{Rate: rate, Burst: burst, buckets: make(map[string]*tokenBucket)}
+}
+
+// Allow takes a token from the bucket of client at time now. If the bucket
+// is empty it returns false and how long until the next token is added.
+func (l *RateLimiter) Allow(client string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastSweep) >= RATE_LIMIT_SWEEP_INTERVAL {
+		l.sweep(now)
+	}
+	b, exists := l.buckets[client]
+	if !exists {
+		b = &tokenBucket{tokens: float64(l.Burst), last: now}
+		l.buckets[client] = b
+	}
+	b.refill(now, l.Rate, l.Burst)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.Rate * float64(time.Second))
+	return false, wait
+}
+
+// Method which drops the buckets that are full again, since a new bucket
+// behaves the same. Must be called with l.mu held.
+func (l *RateLimiter) sweep(now time.Time) {
+	for client, b := range l.buckets {
+		if b.refill(now, l.Rate, l.Burst); b.tokens >= float64(l.Burst) {
+			delete(l.buckets, client)
+		}
+	}
+	l.lastSweep = now
+}
+
+// Method which adds the tokens earned since the bucket was last refilled
+func (b *tokenBucket) refill(now time.Time, rate float64, burst int) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(float64(burst), b.tokens+elapsed.Seconds()*rate)
+		b.last = now
+	}
+}
+
+// ParseCIDRs parses a list of CIDR ranges such as "10.0.0.0/8". Plain IP
+// addresses are taken as ranges holding just that address, and "all" as
+// every IPv4 and IPv6 address.
+func ParseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0)
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "all" {
+			nets = append(nets,
+				&net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 8*net.IPv4len)},
+				&net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 8*net.IPv6len)})
+			continue
+		}
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR range %q", cidr)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// Method which reports whether ip falls in any of nets
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Method which returns the IP address of the client that sent req. If the
+// connection comes from a trusted proxy, the client is the rightmost
+// X-Forwarded-For entry that isn't a trusted proxy itself.
+func (s *Server) clientIP(req *Request) string {
+	client := req.RemoteAddr
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+	ip := net.ParseIP(client)
+	if ip == nil || !containsIP(s.TrustedProxies, ip) {
+		return client
+	}
+	forwarded := strings.Split(req.Headers["X-Forwarded-For"], ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if hop == nil {
+			break
+		}
+		client = hop.String()
+		if !containsIP(s.TrustedProxies, hop) {
+			break
+		}
+	}
+	return client
+}
+
+// Method which applies the rate limit in options to req. It returns false
+// and how long the client should wait if req is over the limit.
+func (s *Server) allowRequest(options *virtualHostOptions, req *Request) (bool, time.Duration) {
+	limiter := options.rateLimiter
+	if limiter == nil {
+		return true, 0
+	}
+	allowed, retryAfter := limiter.Allow(s.clientIP(req), time.Now())
+	if !allowed {
+		s.Metrics.countRateLimited(req.VirtualHost)
+	}
+	return allowed, retryAfter
+}
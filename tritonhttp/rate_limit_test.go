@@ -0,0 +1,101 @@
+package tritonhttp
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRateLimit(t *testing.T) {
+	tmp := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmp, "index.html"), []byte("index"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	config := filepath.Join(tmp, "virtual_hosts.yaml")
+	if err := os.WriteFile(config, []byte(`server:
+  trustedProxies: ["127.0.0.2"]
+virtual_hosts:
+  - hostName: "limited"
+    aliases: ["alias"]
+    docRoot: "."
+    rateLimit:
+      requestsPerSecond: 0.1
+      burst: 2
+  - hostName: "open"
+    docRoot: "."
+`), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	c, err := LoadConfig(config, tmp)
+	if err != nil {
+		t.Fatalf("Expected config to be valid but got %v\n", err)
+	}
+	s := &Server{Metrics: NewMetrics()}
+	c.Server.Apply(s)
+	if err := s.ApplyConfig(c); err != nil {
+		t.Fatal(err.Error())
+	}
+	port := launchserver(t, s)
+
+	get := func(ip string, host string, forwardedFor string) *http.Response {
+		req := "GET / HTTP/1.1\r\nHost: " + host + "\r\nConnection: close\r\n"
+		if len(forwardedFor) > 0 {
+			req += "X-Forwarded-For: " + forwardedFor + "\r\n"
+		}
+		return requestfrom(t, ip, port, req+"\r\n")
+	}
+	tests := []struct {
+		ip           string
+		host         string
+		forwardedFor string
+		statusCode   int
+	}{
+		{"127.0.0.1", "limited", "", 200},
+		{"127.0.0.1", "limited", "", 200},
+		{"127.0.0.1", "limited", "", 429},
+		// Aliases share the bucket of their virtual host
+		{"127.0.0.1", "alias", "", 429},
+		{"127.0.0.1", "open", "", 200},
+		// Clients behind a trusted proxy get buckets of their own
+		{"127.0.0.2", "limited", "203.0.113.1", 200},
+		{"127.0.0.2", "limited", "203.0.113.1", 200},
+		{"127.0.0.2", "limited", "203.0.113.1", 429},
+		{"127.0.0.2", "limited", "198.51.100.7, 203.0.113.2, 127.0.0.2", 200},
+		// Anyone else can't dodge the limit with X-Forwarded-For
+		{"127.0.0.3", "limited", "203.0.113.3", 200},
+		{"127.0.0.3", "limited", "203.0.113.4", 200},
+		{"127.0.0.3", "limited", "203.0.113.5", 429},
+	}
+	for _, tt := range tests {
+		resp := get(tt.ip, tt.host, tt.forwardedFor)
+		if resp.StatusCode != tt.statusCode {
+			t.Fatalf("%v (%v) to %v: expected response code of %v but got %v\n", tt.ip, tt.forwardedFor, tt.host, tt.statusCode, resp.StatusCode)
+		}
+		if tt.statusCode == 429 {
+			if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err != nil || seconds < 1 || seconds > 10 {
+				t.Fatalf("Expected Retry-After between 1 and 10 seconds but got %q\n", resp.Header.Get("Retry-After"))
+			}
+		}
+	}
+
+	// Reloading an unchanged limit keeps the buckets
+	if err := s.ApplyConfig(c); err != nil {
+		t.Fatal(err.Error())
+	}
+	if resp := get("127.0.0.1", "limited", ""); resp.StatusCode != 429 {
+		t.Fatalf("Expected the bucket to survive a reload but got %v\n", resp.StatusCode)
+	}
+
+	var metrics bytes.Buffer
+	if _, err := s.Metrics.WriteTo(&metrics); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !strings.Contains(metrics.String(), `tritonhttp_rate_limited_total{vhost="limited"} 4`) ||
+		!strings.Contains(metrics.String(), `tritonhttp_rate_limited_total{vhost="alias"} 1`) {
+		t.Fatalf("Expected rate limited requests to be counted:\n%s", metrics.String())
+	}
+}
@@ -0,0 +1,172 @@
+package tritonhttp
+
+import (
+	"io/fs"
+	"log"
+	"os"
+	"time"
+)
+
+// SetVirtualHosts atomically replaces the virtual hosts served by s,
+// keeping the options of the entries. Requests that already looked up
+// their virtual host finish against the docroot they started with.
+func (s *Server) SetVirtualHosts(vhosts map[string]fs.FS) {
+	s.virtualHosts.Store(newVirtualHostIndex(vhosts, s.currentVirtualHosts().options))
+}
+
+// Method which returns the index of the virtual hosts currently served:
+// the ones last passed to SetVirtualHosts, or s.VirtualHosts if there are
+// none, which are indexed on first use
+func (s *Server) currentVirtualHosts() *virtualHostIndex {
+	if index, ok := s.virtualHosts.Load().(*virtualHostIndex); ok {
+		return index
+	}
+	// A concurrent SetVirtualHosts wins over s.VirtualHosts
+	s.virtualHosts.CompareAndSwap(nil, newVirtualHostIndex(s.VirtualHosts, nil))
+	return s.virtualHosts.Load().(*virtualHostIndex)
+}
+
+// virtualHostOptions holds the settings of a virtual host beyond its
+// docroot
+type virtualHostOptions struct {
+	rateLimiter *RateLimiter
+	accessRules []*accessRule
+	authRealms  []*authRealm
+	// rewriteRules are evaluated in order before anything else
+	rewriteRules []*rewriteRule
+	// proxy is set for virtual hosts forwarding to an upstream
+	proxy *reverseProxy
+	// cgi is set for virtual hosts with a CGI directory
+	cgi *cgiHandler
+	// fastCGI lists the paths sent to FastCGI backends
+	fastCGI []*fastCGIRoute
+	// spaFallback serves index.html for missing paths without extension
+	spaFallback bool
+	// cacheRules set the caching headers of static files, first match wins
+	cacheRules []*cacheRule
+}
+
+// Method which returns the options of the entry name. Entries without
+// options, such as the ones of a Server set up without a Config, get the
+// zero options.
+func (index *virtualHostIndex) vhostOptions(name string) *virtualHostOptions {
+	if vhostOptions, exists := index.options[name]; exists {
+		return vhostOptions
+	}
+	return &virtualHostOptions{}
+}
+
+
+// Method which returns the distinct proxies among options
+func proxies(options map[string]*virtualHostOptions) map[*reverseProxy]bool {
+	found := make(map[*reverseProxy]bool)
+	for _, vhostOptions := range options {
+		if vhostOptions.proxy != nil {
+			found[vhostOptions.proxy] = true
+		}
+	}
+	return found
+}
+
+// Method which returns the distinct FastCGI clients among options
+func fastCGIClients(options map[string]*virtualHostOptions) map[*fastCGIClient]bool {
+	found := make(map[*fastCGIClient]bool)
+	for _, vhostOptions := range options {
+		for _, route := range vhostOptions.fastCGI {
+			found[route.client] = true
+		}
+	}
+	return found
+}
+
+// ApplyConfig opens the docroots of config and swaps them in, together
+// with the per virtual host settings of config
+func (s *Server) ApplyConfig(config *Config) error {
+	vhosts, err := config.BuildVirtualHosts()
+	if err != nil {
+		return err
+	}
+	current := s.currentVirtualHosts()
+	options, err := config.buildVirtualHostOptions(current.vhostOptions)
+	if err != nil {
+		return err
+	}
+	if s.AccessLog != nil {
+		s.AccessLog.SetVirtualHostPaths(config.AccessLogPaths())
+	}
+	// Docroots and options are swapped in together. Docroots of the old
+	// config are left for the garbage collector rather than closed, since
+	// in-flight responses may still be reading them.
+	previous := current.options
+	s.virtualHosts.Store(newVirtualHostIndex(vhosts, options))
+	// Health checks follow the proxies: the replaced ones stop checking and
+	// the new ones start
+	for proxy := range proxies(previous) {
+		proxy.stop()
+	}
+	for proxy := range proxies(options) {
+		proxy.start()
+	}
+	// FastCGI backends that are gone lose their idle connections
+	clients := fastCGIClients(options)
+	for client := range fastCGIClients(previous) {
+		if !clients[client] {
+			client.closeIdle()
+		}
+	}
+	return nil
+}
+
+// ReloadVirtualHosts reads and validates the virtual hosting config file
+// and, if it is valid, applies it. On error the server keeps serving the
+// current config.
+func (s *Server) ReloadVirtualHosts(vhConfigFilePath string, docroot_dirs_path string) error {
+	config, err := LoadConfig(vhConfigFilePath, docroot_dirs_path)
+	if err != nil {
+		return err
+	}
+	return s.ApplyConfig(config)
+}
+
+// ReloadOnChange reloads the virtual hosting config whenever a signal
+// (e.g. SIGHUP) arrives on signals and, if interval is positive, whenever
+// the modification time or size of the config file changes, polling it
+// every interval. Failed reloads are logged and leave the current config
+// in place. ReloadOnChange returns once signals is closed.
+func (s *Server) ReloadOnChange(vhConfigFilePath string, docroot_dirs_path string, signals <-chan os.Signal, interval time.Duration) {
+	var ticks <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+	lastStat, _ := os.Stat(vhConfigFilePath)
+	reload := func(reason string) {
+		if err := s.ReloadVirtualHosts(vhConfigFilePath, docroot_dirs_path); err != nil {
+			log.Printf("Keeping the current virtual hosts, reload on %v failed: %v", reason, err)
+			return
+		}
+		log.Printf("Reloaded virtual hosts from %v on %v", vhConfigFilePath, reason)
+	}
+	for {
+		select {
+		case sig, ok := <-signals:
+			if !ok {
+				return
+			}
+			lastStat, _ = os.Stat(vhConfigFilePath)
+			reload(sig.String())
+		case <-ticks:
+			stat, err := os.Stat(vhConfigFilePath)
+			if err != nil || configUnchanged(lastStat, stat) {
+				continue
+			}
+			lastStat = stat
+			reload("file change")
+		}
+	}
+}
+
+func configUnchanged(before, after os.FileInfo) bool {
+	return before != nil && before.ModTime().Equal(after.ModTime()) && before.Size() == after.Size()
+}
@@ -0,0 +1,77 @@
+package tritonhttp
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestReloadVirtualHosts(t *testing.T) {
+	tmp := t.TempDir()
+	for _, site := range []string{"old", "new"} {
+		if err := os.MkdirAll(filepath.Join(tmp, site), 0755); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := os.WriteFile(filepath.Join(tmp, site, "index.html"), []byte(site), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	config := filepath.Join(tmp, "virtual_hosts.yaml")
+	modTime := time.Now().Add(-time.Hour)
+	writeconfig := func(contents string) {
+		if err := os.WriteFile(config, []byte(contents), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		// Make every write visible to the poller, even within the mtime resolution
+		modTime = modTime.Add(time.Second)
+		if err := os.Chtimes(config, modTime, modTime); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	expectbody := func(port string, host string, body string) {
+		// Reloads happen in the background, so give them some time
+		var got string
+		for i := 0; i < 50; i++ {
+			resp := fetchresponse(t, port, "GET / HTTP/1.1\r\nHost: "+host+"\r\nConnection: close\r\n\r\n")
+			b, _ := io.ReadAll(resp.Body)
+			if got = fmt.Sprintf("%v %s", resp.StatusCode, b); got == body {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("%v: expected %q but got %q\n", host, body, got)
+	}
+
+	writeconfig("virtual_hosts:\n  - hostName: site\n    docRoot: old\n")
+	virtualHosts, err := ParseVHConfigFile(config, tmp)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	s := &Server{VirtualHosts: virtualHosts}
+	port := launchserver(t, s)
+	signals := make(chan os.Signal)
+	defer close(signals)
+	go s.ReloadOnChange(config, tmp, signals, 10*time.Millisecond)
+	expectbody(port, "site", "200 old")
+
+	// Picked up on SIGHUP
+	writeconfig("virtual_hosts:\n  - hostName: site\n    docRoot: new\n  - hostName: site2\n    docRoot: old\n")
+	signals <- syscall.SIGHUP
+	expectbody(port, "site", "200 new")
+	expectbody(port, "site2", "200 old")
+
+	// An invalid config keeps the current one in place
+	writeconfig("virtual_hosts:\n  - hostName: site\n    docRoot: missing\n")
+	signals <- syscall.SIGHUP
+	time.Sleep(50 * time.Millisecond)
+	expectbody(port, "site", "200 new")
+
+	// Picked up on file change
+	writeconfig("virtual_hosts:\n  - hostName: site\n    docRoot: old\n")
+	expectbody(port, "site", "200 old")
+	expectbody(port, "site2", "404 ")
+}
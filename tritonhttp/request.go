@@ -4,27 +4,76 @@ import (
 	"fmt"
 	"strings"
 	"net"
+	"net/url"
 	"io"
 )
 
 type Request struct {
 	Method string // e.g. "GET"
-	URL    string // e.g. "/path/to/a/file"
+	URL    string // e.g. "/path/to/a/file?q=1", the request-target as sent
 	Proto  string // e.g. "HTTP/1.1"
+	ProtoMajor int // e.g. 1
+	ProtoMinor int // e.g. 1
 
-	// Headers stores the key-value HTTP headers
+	// Path, RawQuery and Fragment are parsed from URL by ParseTarget.
+	// Path is percent-decoded and has its empty and dot segments removed,
+	// while RawQuery and Fragment are kept encoded.
+	Path     string // e.g. "/path/to/a/file"
+	RawQuery string // e.g. "q=1"
+	Fragment string
+
+	// Headers stores the key-value HTTP headers, with keys in canonical
+	// form. Repeated headers are combined into a comma-separated list.
 	Headers map[string]string
 
 	Host  string // determine from the "Host" header
-	Close bool   // determine from the "Connection" header
+	Close bool   // determine from the "Connection" header and the protocol
+
+	// VirtualHost is the VirtualHosts entry serving the request, set once
+	// the request has been matched to one
+	VirtualHost string
+
+	// RemoteAddr is the address of the other end of the connection, e.g.
+	// "192.0.2.1:54321"
+	RemoteAddr string
+
+	// LocalAddr is the address the connection was accepted on, e.g.
+	// "192.0.2.2:8080"
+	LocalAddr string
+
+	// User is the name the client authenticated as, if the request falls
+	// under an auth realm
+	User string
+
+	// Body reads the request body, framed by Content-Length or the chunked
+	// transfer coding. It is nil for requests without a body. Whatever the
+	// handler doesn't read is skipped before the next request.
+	Body io.Reader
+
+	// ContentLength is the length of Body, or -1 for a chunked body
+	ContentLength int64
+
+	// cgiRedirects counts the local redirects of CGI scripts followed
+	cgiRedirects int
+
+	// rewritten is set once a rewrite rule changed Path or RawQuery, which
+	// then no longer match URL
+	rewritten bool
+
+	// stripAuthorization is set once an auth realm checked the credentials
+	// of the Authorization header, which upstreams then don't get
+	stripAuthorization bool
 }
 
 const (
 	GET = "GET"
+	HEAD = "HEAD"
 	POST = "POST"
+	CONNECT = "CONNECT"
 	HOST = "Host"
 	CONNECTION = "Connection"
 	CLOSE = "close"
+	KEEP_ALIVE = "keep-alive"
 	responseProto = "HTTP/1.1"
 	doubleCarriageReturnNewLine = "\r\n\r\n"
 	carriageReturnNewLine = "\r\n"
@@ -133,8 +182,10 @@ func HandleRequest(requestString []string) (req *Request, errors []error) {
 			break
 		}
 		line := remainingLines[0]
-		res := strings.Split(line, ":")
-		if len(res) != 2 {
+		// Split on the first colon only, values like "website1:8080" may
+		// contain colons themselves
+		res := strings.SplitN(line, ":", 2)
+		if len(res) != 2 || len(res[0]) == 0 {
 			// Not in proper form: maybe colon is missing
 			errors = append(errors, fmt.Errorf("error parsing request header"))
 			remainingLines = remainingLines[1:]
@@ -144,17 +195,36 @@ func HandleRequest(requestString []string) (req *Request, errors []error) {
 			continue
 		}
 		key, value := res[0], res[1]
+		// Only CRLF ends a header line, so a lone CR or LF, or a NUL, would
+		// reach whatever the header is passed on to
+		if !isToken(key) || !validHeaderValue(value) {
+			errors = append(errors, fmt.Errorf("invalid header field %q", key))
+			remainingLines = remainingLines[1:]
+			if len(remainingLines) == 0 {
+				break
+			}
+			continue
+		}
 		key = CanonicalHeaderKey(key)
 		// Remove all leading and trailing space from value
 		value = strings.TrimSpace(value)
 		// fmt.Println("Key value", key, value)
 		if key == HOST {
 			// fmt.Println("Setting host", value)
+			if _, exists := req.Headers[HOST]; exists {
+				errors = append(errors, fmt.Errorf("duplicate Host header"))
+			}
 			req.Host = value
 		} 
+		// Repeated headers are combined into a comma-separated list
+		if existing, exists := req.Headers[key]; exists {
+			req.Headers[key] = existing + ", " + value
+		} else {
+			req.Headers[key] = value
+		}
 		if key == CONNECTION {
 			// fmt.Println("Setting Connection", value)
-			req.Headers[CONNECTION] = value
+			req.Close = hasToken(req.Headers[CONNECTION], CLOSE)
 		}
 		remainingLines = remainingLines[1:]
 		if len(remainingLines) == 0 {
@@ -171,23 +241,271 @@ func HandleRequest(requestString []string) (req *Request, errors []error) {
 		return req, errors
 	}
 	// fmt.Println("Method: ", req.Method)
-	// Only GET method is supported and well formed URL starts with /
-	if req.Method != GET {
+	// CONNECT is only accepted in proxy mode, and methods other than GET
+	// only by proxy virtual hosts
+	if !knownMethods[req.Method] {
 		// fmt.Println("Invalid method")
 		errors = append(errors, fmt.Errorf("invalid method"))
 		return req, errors
 	}
-	if len(req.URL) == 0 || req.URL[0] != '/' {
-		// fmt.Println("URL doesnt start with slash")
-		errors = append(errors, fmt.Errorf("url doesnt start with slash"))
+	var ok bool
+	req.ProtoMajor, req.ProtoMinor, ok = parseHTTPVersion(req.Proto)
+	if !ok {
+		// fmt.Println("protocol is not HTTP/x.y")
+		errors = append(errors, fmt.Errorf("malformed protocol %q", req.Proto))
 		return req, errors
 	}
-	if req.Proto != responseProto {
-		// fmt.Println("protocol is not HTTP/1.1")
-		errors = append(errors, fmt.Errorf("protocol is not HTTP/1.1"))
+	if req.ProtoMajor != 1 {
+		errors = append(errors, errHTTPVersionNotSupported)
 		return req, errors
 	}
+	// HTTP/1.0 connections are closed after every request unless the
+	// client asks to keep them alive
+	if req.ProtoMinor == 0 && !hasToken(req.Headers[CONNECTION], KEEP_ALIVE) {
+		req.Close = true
+	}
 	return req, errors
 }
 
+// Method which reports whether s is a token as defined by RFC 9110, the
+// syntax of header names
+func isToken(s string) bool {
+	if len(s) == 0 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// Method which reports whether value can be sent as a header value, i.e.
+// contains no CR, LF or NUL
+func validHeaderValue(value string) bool {
+	return !strings.ContainsAny(value, "\r\n\x00")
+}
+
+// knownMethods are the methods requests may use. Static virtual hosts
+// only serve GET, the others are forwarded by proxy virtual hosts.
+var knownMethods = map[string]bool{
+	GET: true, HEAD: true, POST: true, "PUT": true, "DELETE": true,
+	"OPTIONS": true, "PATCH": true, "TRACE": true, CONNECT: true,
+}
+
+var errHTTPVersionNotSupported = fmt.Errorf("http version not supported")
+
+// Method which parses "HTTP/x.y" into its major and minor version
+func parseHTTPVersion(proto string) (int, int, bool) {
+	if len(proto) != len("HTTP/x.y") || !strings.HasPrefix(proto, "HTTP/") || proto[6] != '.' {
+		return 0, 0, false
+	}
+	major, minor := proto[5], proto[7]
+	if major < '0' || major > '9' || minor < '0' || minor > '9' {
+		return 0, 0, false
+	}
+	return int(major - '0'), int(minor - '0'), true
+}
+
+// ProtoAtLeast reports whether the HTTP protocol used in the request is
+// at least major.minor
+func (req *Request) ProtoAtLeast(major, minor int) bool {
+	return req.ProtoMajor > major || req.ProtoMajor == major && req.ProtoMinor >= minor
+}
+
+// Method which reports whether the comma-separated header value contains
+// token, ignoring case
+func hasToken(value string, token string) bool {
+	for _, t := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(t), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// Method which reports whether target is one of errs
+func hasError(errs []error, target error) bool {
+	for _, err := range errs {
+		if err == target {
+			return true
+		}
+	}
+	return false
+}
+
+// EncodedSlashPolicy decides how "%2F" in a request path is treated
+type EncodedSlashPolicy int
+
+const (
+	// EncodedSlashesReject answers requests containing "%2F" with 400
+	EncodedSlashesReject EncodedSlashPolicy = iota
+	// EncodedSlashesDecode decodes "%2F" into a regular path separator
+	EncodedSlashesDecode
+)
+
+// ParseTarget splits the request-target in req.URL into req.Path,
+// req.RawQuery and req.Fragment. The path is percent-decoded and normalized
+// by collapsing empty segments, as the file system does, and removing dot
+// segments as described in RFC 3986 5.2.4, so that checks on req.Path see
+// the same path that is served. Encoded control characters are always
+// rejected and encoded slashes are handled according to slashes.
+//
+// Besides the usual origin-form ("/index.html"), the absolute-form
+// ("http://website1/index.html") is accepted, in which case the authority
+// overrides the Host header as required by RFC 9112 3.2.2. CONNECT
+// requests must use the authority-form ("website1:443"), which only sets
+// req.Host.
+func (req *Request) ParseTarget(slashes EncodedSlashPolicy) error {
+	target := req.URL
+	if req.Method == CONNECT {
+		host, port, err := net.SplitHostPort(target)
+		if err != nil || len(host) == 0 || len(port) == 0 {
+			return fmt.Errorf("invalid authority-form url")
+		}
+		req.Host = target
+		return nil
+	}
+	if scheme, rest, ok := strings.Cut(target, "://"); ok && isHTTPScheme(scheme) {
+		authority := rest
+		target = "/"
+		if i := strings.IndexAny(rest, "/?#"); i != -1 {
+			authority, target = rest[:i], rest[i:]
+			if target[0] != '/' {
+				target = "/" + target
+			}
+		}
+		// Userinfo isn't allowed in http(s) URIs sent to a server
+		if len(authority) == 0 || strings.Contains(authority, "@") {
+			return fmt.Errorf("invalid authority in absolute-form url")
+		}
+		req.Host = authority
+	}
+	if i := strings.IndexByte(target, '#'); i != -1 {
+		target, req.Fragment = target[:i], target[i+1:]
+	}
+	if i := strings.IndexByte(target, '?'); i != -1 {
+		target, req.RawQuery = target[:i], target[i+1:]
+	}
+	if len(target) == 0 || target[0] != '/' {
+		return fmt.Errorf("url doesnt start with slash")
+	}
+	decoded, err := decodePath(target, slashes)
+	if err != nil {
+		return err
+	}
+	req.Path = removeDotSegments(collapseSlashes(decoded))
+	return nil
+}
+
+func isHTTPScheme(scheme string) bool {
+	return strings.EqualFold(scheme, "http") || strings.EqualFold(scheme, "https")
+}
 
+// Query parses RawQuery into its key-value pairs, ignoring malformed pairs
+func (req *Request) Query() url.Values {
+	values, _ := url.ParseQuery(req.RawQuery)
+	return values
+}
+
+// Method which percent-decodes a request path
+func decodePath(p string, slashes EncodedSlashPolicy) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if c <= ' ' || c == 0x7f {
+			return "", fmt.Errorf("invalid character in url")
+		}
+		if c != '%' {
+			b.WriteByte(c)
+			continue
+		}
+		if i+2 >= len(p) || !isHex(p[i+1]) || !isHex(p[i+2]) {
+			return "", fmt.Errorf("malformed percent-encoding in url")
+		}
+		c = unhex(p[i+1])<<4 | unhex(p[i+2])
+		i += 2
+		// Decoded line breaks would end up in headers such as Location
+		if c < ' ' || c == 0x7f {
+			return "", fmt.Errorf("encoded control character in url")
+		}
+		if c == '/' && slashes == EncodedSlashesReject {
+			return "", fmt.Errorf("encoded slash in url")
+		}
+		b.WriteByte(c)
+	}
+	return b.String(), nil
+}
+
+func isHex(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	}
+	return c - 'A' + 10
+}
+
+// Method which replaces runs of slashes in p by a single one
+func collapseSlashes(p string) string {
+	if !strings.Contains(p, "//") {
+		return p
+	}
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		if p[i] == '/' && i > 0 && p[i-1] == '/' {
+			continue
+		}
+		b.WriteByte(p[i])
+	}
+	return b.String()
+}
+
+// Method which implements the remove_dot_segments algorithm of RFC 3986
+// 5.2.4. Unlike path.Clean it keeps trailing slashes. Empty segments are
+// passed through as they are, so callers run collapseSlashes first.
+func removeDotSegments(in string) string {
+	out := make([]string, 0)
+	for len(in) > 0 {
+		switch {
+		case strings.HasPrefix(in, "../"):
+			in = in[3:]
+		case strings.HasPrefix(in, "./"):
+			in = in[2:]
+		case strings.HasPrefix(in, "/./"):
+			in = in[2:]
+		case in == "/.":
+			in = "/"
+		case strings.HasPrefix(in, "/../"):
+			in = in[3:]
+			if len(out) > 0 {
+				out = out[:len(out)-1]
+			}
+		case in == "/..":
+			in = "/"
+			if len(out) > 0 {
+				out = out[:len(out)-1]
+			}
+		case in == "." || in == "..":
+			in = ""
+		default:
+			// Move the first segment, including its leading slash, to out
+			end := strings.IndexByte(in[1:], '/')
+			if end == -1 {
+				end = len(in)
+			} else {
+				end++
+			}
+			out = append(out, in[:end])
+			in = in[end:]
+		}
+	}
+	return strings.Join(out, "")
+}
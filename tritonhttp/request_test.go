@@ -0,0 +1,227 @@
+package tritonhttp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"testing"
+	"testing/fstest"
+)
+
+func TestRequestTargetNormalization(t *testing.T) {
+	site := fstest.MapFS{
+		"index.html":         {Data: []byte("index")},
+		"kitten.jpg":         {Data: []byte("kitten")},
+		"sub dir/index.html": {Data: []byte("sub dir")},
+		"a/b/index.html":     {Data: []byte("a/b")},
+		"100%/index.html":    {Data: []byte("percent")},
+	}
+	tests := []struct {
+		slashes    EncodedSlashPolicy
+		url        string
+		statusCode int
+		body       string
+	}{
+		{EncodedSlashesReject, "/kitten%2Ejpg", 200, "kitten"},
+		{EncodedSlashesReject, "/sub%20dir/", 200, "sub dir"},
+		{EncodedSlashesReject, "/100%25/", 200, "percent"},
+		{EncodedSlashesReject, "/index.html?q=1&r=2", 200, "index"},
+		{EncodedSlashesReject, "/kitten.jpg#frag", 200, "kitten"},
+		{EncodedSlashesReject, "/a/./c/../b/", 200, "a/b"},
+		{EncodedSlashesReject, "/a/%2E%2E/a/b/", 200, "a/b"},
+		{EncodedSlashesReject, "/%2e%2e/%2e%2e/index.html", 200, "index"},
+		{EncodedSlashesReject, "/index.html%00.jpg", 400, ""},
+		{EncodedSlashesReject, "/bad%zzescape", 400, ""},
+		{EncodedSlashesReject, "/a%2Fb/", 400, ""},
+		{EncodedSlashesDecode, "/a%2Fb/", 200, "a/b"},
+		{EncodedSlashesReject, "index.html", 400, ""},
+	}
+	for _, tt := range tests {
+		s := &Server{
+			VirtualHosts:   map[string]fs.FS{"site": site},
+			EncodedSlashes: tt.slashes,
+		}
+		port := launchserver(t, s)
+		req := fmt.Sprintf("GET %s HTTP/1.1\r\nHost: site\r\nConnection: close\r\n\r\n", tt.url)
+		resp := fetchresponse(t, port, req)
+		if resp.StatusCode != tt.statusCode {
+			t.Fatalf("%v: expected response code of %v but got: %v\n", tt.url, tt.statusCode, resp.StatusCode)
+		}
+		if tt.statusCode != 200 {
+			continue
+		}
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("Error reading response body: %v\n", err.Error())
+		}
+		if string(body) != tt.body {
+			t.Fatalf("%v: expected body %q but got %q\n", tt.url, tt.body, body)
+		}
+	}
+}
+
+func TestParseTarget(t *testing.T) {
+	tests := []struct {
+		url  string
+		path string
+		ok   bool
+	}{
+		{"/a/b/", "/a/b/", true},
+		{"//hidden/empty.html", "/hidden/empty.html", true},
+		{"/x/..//hidden/empty.html", "/hidden/empty.html", true},
+		{"/a//b///", "/a/b/", true},
+		{"/a//../b", "/b", true},
+		{"/%2F%2Fhidden/", "", false},
+		{"/sub%20dir/", "/sub dir/", true},
+		{"/x%0D%0ASet-Cookie:%20evil=1", "", false},
+		{"/x%0A", "", false},
+		{"/x%09", "", false},
+		{"/x%7F", "", false},
+		{"/x%00", "", false},
+	}
+	for _, tt := range tests {
+		req := &Request{Method: GET, URL: tt.url}
+		err := req.ParseTarget(EncodedSlashesReject)
+		if (err == nil) != tt.ok || (tt.ok && req.Path != tt.path) {
+			t.Fatalf("%v: expected path %q (ok %v) but got %q (%v)\n", tt.url, tt.path, tt.ok, req.Path, err)
+		}
+	}
+}
+
+func TestAbsoluteFormTarget(t *testing.T) {
+	s := &Server{
+		VirtualHosts: map[string]fs.FS{
+			"site1": fstest.MapFS{"index.html": {Data: []byte("site1")}},
+			"site2": fstest.MapFS{"index.html": {Data: []byte("site2")}},
+		},
+	}
+	port := launchserver(t, s)
+
+	tests := []struct {
+		req        string
+		statusCode int
+		body       string
+	}{
+		{"GET http://site2/index.html HTTP/1.1\r\nHost: site1\r\nConnection: close\r\n\r\n", 200, "site2"},
+		{"GET HTTP://site2 HTTP/1.1\r\nConnection: close\r\n\r\n", 200, "site2"},
+		{"GET http://site1?q=1 HTTP/1.1\r\nHost: site2\r\nConnection: close\r\n\r\n", 200, "site1"},
+		{"GET http://user@site1/ HTTP/1.1\r\nHost: site1\r\nConnection: close\r\n\r\n", 400, ""},
+		{"GET http:///index.html HTTP/1.1\r\nHost: site1\r\nConnection: close\r\n\r\n", 400, ""},
+		{"CONNECT site1:443 HTTP/1.1\r\nHost: site1:443\r\nConnection: close\r\n\r\n", 400, ""},
+	}
+	for _, tt := range tests {
+		resp := fetchresponse(t, port, tt.req)
+		if resp.StatusCode != tt.statusCode {
+			t.Fatalf("%q: expected response code of %v but got: %v\n", tt.req, tt.statusCode, resp.StatusCode)
+		}
+		if tt.statusCode != 200 {
+			continue
+		}
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("Error reading response body: %v\n", err.Error())
+		}
+		if string(body) != tt.body {
+			t.Fatalf("%q: expected body %q but got %q\n", tt.req, tt.body, body)
+		}
+	}
+}
+
+func TestHTTP10Compatibility(t *testing.T) {
+	s := &Server{
+		VirtualHosts: map[string]fs.FS{
+			"site":             fstest.MapFS{"index.html": {Data: []byte("site")}},
+			DefaultVirtualHost: fstest.MapFS{"index.html": {Data: []byte("default")}},
+		},
+	}
+	port := launchserver(t, s)
+
+	tests := []struct {
+		req         string
+		statusCodes []int
+		body        string
+		connection  string
+	}{
+		// No Host needed, served by the default virtual host, closed by default
+		{"GET / HTTP/1.0\r\n\r\nGET / HTTP/1.0\r\n\r\n", []int{200}, "default", ""},
+		{"GET / HTTP/1.0\r\nHost: site\r\n\r\n", []int{200}, "site", ""},
+		// Kept alive on request
+		{"GET / HTTP/1.0\r\nConnection: keep-alive\r\n\r\nGET /missing HTTP/1.0\r\n\r\n", []int{200, 404}, "default", "keep-alive"},
+		// HTTP/1.1 still requires a Host
+		{"GET / HTTP/1.1\r\nConnection: close\r\n\r\n", []int{400}, "", ""},
+		// Later 1.x minor versions are served like HTTP/1.1
+		{"GET / HTTP/1.2\r\nHost: site\r\nConnection: close\r\n\r\n", []int{200}, "site", ""},
+		{"GET / HTTP/2.0\r\nHost: site\r\nConnection: close\r\n\r\n", []int{505}, "", ""},
+		{"GET / HTTP/1.10\r\nHost: site\r\nConnection: close\r\n\r\n", []int{400}, "", ""},
+		{"GET / FOO/1.1\r\nHost: site\r\nConnection: close\r\n\r\n", []int{400}, "", ""},
+	}
+	for _, tt := range tests {
+		respbytes, _, err := Fetch("localhost", port, []byte(tt.req))
+		if err != nil {
+			t.Fatalf("Error fetching request: %v\n", err.Error())
+		}
+		respreader := bufio.NewReader(bytes.NewReader(respbytes))
+		for i, statusCode := range tt.statusCodes {
+			resp, err := http.ReadResponse(respreader, nil)
+			if err != nil {
+				t.Fatalf("%q: got an error parsing response %v: %v\n", tt.req, i, err.Error())
+			}
+			if resp.StatusCode != statusCode {
+				t.Fatalf("%q: expected response code of %v but got: %v\n", tt.req, statusCode, resp.StatusCode)
+			}
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("Error reading response body: %v\n", err.Error())
+			}
+			if i == 0 && statusCode == 200 {
+				if string(body) != tt.body {
+					t.Fatalf("%q: expected body %q but got %q\n", tt.req, tt.body, body)
+				}
+				if c := resp.Header.Get("Connection"); c != tt.connection {
+					t.Fatalf("%q: expected Connection %q but got %q\n", tt.req, tt.connection, c)
+				}
+			}
+		}
+		if rest, _ := io.ReadAll(respreader); len(rest) > 0 {
+			t.Fatalf("%q: unexpected data after the last response: %q\n", tt.req, rest)
+		}
+	}
+}
+
+func TestHeaderFieldValidation(t *testing.T) {
+	s := &Server{
+		VirtualHosts: map[string]fs.FS{"site": fstest.MapFS{"index.html": {Data: []byte("index")}}},
+	}
+	port := launchserver(t, s)
+	tests := []struct {
+		header     string
+		statusCode int
+	}{
+		{"X-Ok!#$%&'*+.^_`|~: value", 200},
+		{"X-Empty:", 200},
+		// Only CRLF ends a header line, so these would be smuggled on as
+		// headers of their own
+		{"X-A: a\nContent-Length: 40", 400},
+		{"X-A: a\rContent-Length: 40", 400},
+		{"X-A: a\x00b", 400},
+		{"X-A\n: a", 400},
+		{"X A: a", 400},
+		{"X-A : a", 400},
+		{"X(A): a", 400},
+		{": a", 400},
+	}
+	for _, tt := range tests {
+		req := "GET / HTTP/1.1\r\nHost: site\r\n" + tt.header + "\r\nConnection: close\r\n\r\n"
+		resp := fetchresponse(t, port, req)
+		if resp.StatusCode != tt.statusCode {
+			t.Fatalf("%q: expected response code of %v but got: %v\n", tt.header, tt.statusCode, resp.StatusCode)
+		}
+	}
+	resp := fetchresponse(t, port, "GET /a\nX-A:b HTTP/1.1\r\nHost: site\r\nConnection: close\r\n\r\n")
+	if resp.StatusCode != 400 {
+		t.Fatalf("Expected a line break in the target to be refused but got: %v\n", resp.StatusCode)
+	}
+}
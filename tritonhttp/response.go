@@ -2,13 +2,14 @@ package tritonhttp
 
 import (
 	"bufio"
-	"errors"
 	"fmt"
 	"io"
-	"log"
+	"io/fs"
+	"net"
 	"net/http"
+	"net/http/httputil"
 	"os"
-	"path/filepath"
+	"path"
 	"sort"
 	"strconv"
 	"strings"
@@ -20,7 +21,9 @@ type Response struct {
 	StatusCode int    // e.g. 200
 	StatusText string // e.g. "OK"
 
-	// Headers stores all headers to write to the response.
+	// Headers stores all headers to write to the response. Set-Cookie
+	// may hold several values, one per line; other values must not
+	// contain line breaks.
 	Headers map[string]string
 
 	// Request is the valid request that leads to this response.
@@ -28,21 +31,80 @@ type Response struct {
 	// Hint: you might need this to handle the "Connection: Close" requirement
 	Request *Request
 
-	// FilePath is the local path to the file to serve.
+	// FilePath is the path to the file to serve, inside FS if FS is set,
+	// or the local path otherwise.
 	// It could be "", which means there is no file to serve.
 	FilePath string
+
+	// FS is the docroot file system FilePath is looked up in.
+	FS fs.FS
+
+	// Body, if set, is streamed as the body instead of FilePath. It is
+	// written with the chunked transfer coding if the Transfer-Encoding
+	// header says so. Whatever a Read returns is flushed to the client
+	// right away, so a Body producing data as it goes, such as an event
+	// stream, reaches the client as it is produced.
+	Body io.Reader
+
+	// done, if set, is called with the result once the response has been
+	// written, e.g. to release the upstream connection Body reads from
+	done func(err error)
+
+	// Hijack, if set, takes over the connection once the response has
+	// been written, e.g. after "101 Switching Protocols". It gets the
+	// connection without deadlines and whatever the client sent after the
+	// request, and has to close the connection when done.
+	Hijack func(conn net.Conn, buffered []byte)
+
+	// bodyBytes counts the body bytes Write sent, without headers or
+	// chunk framing
+	bodyBytes int64
 }
 
 const (
+	statusSwitchingProtocols = http.StatusSwitchingProtocols
 	statusOK = http.StatusOK
+	statusMovedPermanently = http.StatusMovedPermanently
+	statusFound = http.StatusFound
+	statusSeeOther = http.StatusSeeOther
+	statusTemporaryRedirect = http.StatusTemporaryRedirect
+	statusPermanentRedirect = http.StatusPermanentRedirect
 	statusBadRequest = http.StatusBadRequest
+	statusUnauthorized = http.StatusUnauthorized
+	statusForbidden = http.StatusForbidden
 	statusNotFound = http.StatusNotFound
+	statusRequestEntityTooLarge = http.StatusRequestEntityTooLarge
+	statusUpgradeRequired = http.StatusUpgradeRequired
+	statusTooManyRequests = http.StatusTooManyRequests
+	statusRequestHeaderFieldsTooLarge = http.StatusRequestHeaderFieldsTooLarge
+	statusInternalServerError = http.StatusInternalServerError
+	statusBadGateway = http.StatusBadGateway
+	statusServiceUnavailable = http.StatusServiceUnavailable
+	statusGatewayTimeout = http.StatusGatewayTimeout
+	statusHTTPVersionNotSupported = http.StatusHTTPVersionNotSupported
 )
 
 var statusText = map[int]string{
+	statusSwitchingProtocols: "Switching Protocols",
 	statusOK: "OK",
+	statusMovedPermanently: "Moved Permanently",
+	statusFound: "Found",
+	statusSeeOther: "See Other",
+	statusTemporaryRedirect: "Temporary Redirect",
+	statusPermanentRedirect: "Permanent Redirect",
 	statusBadRequest: "Bad Request",
+	statusUnauthorized: "Unauthorized",
+	statusForbidden: "Forbidden",
 	statusNotFound: "Not Found",
+	statusRequestEntityTooLarge: "Request Entity Too Large",
+	statusUpgradeRequired: "Upgrade Required",
+	statusTooManyRequests: "Too Many Requests",
+	statusRequestHeaderFieldsTooLarge: "Request Header Fields Too Large",
+	statusInternalServerError: "Internal Server Error",
+	statusBadGateway: "Bad Gateway",
+	statusServiceUnavailable: "Service Unavailable",
+	statusGatewayTimeout: "Gateway Timeout",
+	statusHTTPVersionNotSupported: "HTTP Version Not Supported",
 }
 
 func (res *Response) AddProto(proto string) {
@@ -57,6 +119,136 @@ func (res *Response) HandleStatusNotFound() {
 	res.Headers["Date"] = FormatTime(time.Now())
 }
 
+// Method which answers 401, with challenge as the WWW-Authenticate header
+func (res *Response) HandleUnauthorized(challenge string) {
+	res.AddProto(responseProto)
+	res.StatusCode = statusUnauthorized
+	res.FilePath = ""
+	res.Headers = make(map[string]string)
+	res.Headers["Date"] = FormatTime(time.Now())
+	res.Headers["WWW-Authenticate"] = challenge
+}
+
+func (res *Response) HandleForbidden() {
+	res.AddProto(responseProto)
+	res.StatusCode = statusForbidden
+	res.FilePath = ""
+	res.Headers = make(map[string]string)
+	res.Headers["Date"] = FormatTime(time.Now())
+}
+
+func (res *Response) HandleRequestEntityTooLarge() {
+	res.AddProto(responseProto)
+	res.StatusCode = statusRequestEntityTooLarge
+	res.FilePath = ""
+	res.Headers = make(map[string]string)
+	res.Headers["Date"] = FormatTime(time.Now())
+}
+
+// Method which answers with the redirect status statusCode, sending the
+// client to location
+func (res *Response) HandleRedirect(statusCode int, location string) {
+	res.AddProto(responseProto)
+	res.StatusCode = statusCode
+	res.FilePath = ""
+	res.Headers = make(map[string]string)
+	res.Headers["Date"] = FormatTime(time.Now())
+	res.Headers["Location"] = location
+	res.Headers["Content-Length"] = "0"
+}
+
+// Method which answers 101, switching the connection to protocol
+func (res *Response) HandleSwitchingProtocols(protocol string) {
+	res.AddProto(responseProto)
+	res.StatusCode = statusSwitchingProtocols
+	res.FilePath = ""
+	res.Headers = make(map[string]string)
+	res.Headers["Date"] = FormatTime(time.Now())
+	res.Headers["Upgrade"] = protocol
+	res.Headers[CONNECTION] = "Upgrade"
+}
+
+// Method which answers 426, asking the client to switch to protocol
+func (res *Response) HandleUpgradeRequired(protocol string) {
+	res.AddProto(responseProto)
+	res.StatusCode = statusUpgradeRequired
+	res.FilePath = ""
+	res.Headers = make(map[string]string)
+	res.Headers["Date"] = FormatTime(time.Now())
+	res.Headers["Upgrade"] = protocol
+	res.Headers[CONNECTION] = "Upgrade"
+}
+
+func (res *Response) HandleInternalServerError() {
+	res.AddProto(responseProto)
+	res.StatusCode = statusInternalServerError
+	res.FilePath = ""
+	res.Headers = make(map[string]string)
+	res.Headers["Date"] = FormatTime(time.Now())
+}
+
+func (res *Response) HandleBadGateway() {
+	res.AddProto(responseProto)
+	res.StatusCode = statusBadGateway
+	res.FilePath = ""
+	res.Headers = make(map[string]string)
+	res.Headers["Date"] = FormatTime(time.Now())
+}
+
+func (res *Response) HandleGatewayTimeout() {
+	res.AddProto(responseProto)
+	res.StatusCode = statusGatewayTimeout
+	res.FilePath = ""
+	res.Headers = make(map[string]string)
+	res.Headers["Date"] = FormatTime(time.Now())
+}
+
+// Method which answers 503, asking the client to retry after retryAfter
+func (res *Response) HandleServiceUnavailable(retryAfter time.Duration) {
+	res.AddProto(responseProto)
+	res.StatusCode = statusServiceUnavailable
+	res.FilePath = ""
+	res.Headers = make(map[string]string)
+	res.Headers["Date"] = FormatTime(time.Now())
+	res.Headers["Retry-After"] = retryAfterSeconds(retryAfter)
+}
+
+// Method which answers 429, asking the client to retry after retryAfter
+func (res *Response) HandleTooManyRequests(retryAfter time.Duration) {
+	res.AddProto(responseProto)
+	res.StatusCode = statusTooManyRequests
+	res.FilePath = ""
+	res.Headers = make(map[string]string)
+	res.Headers["Date"] = FormatTime(time.Now())
+	res.Headers["Retry-After"] = retryAfterSeconds(retryAfter)
+}
+
+// Method which formats d as a Retry-After value: whole seconds, rounded up
+// and at least one
+func retryAfterSeconds(d time.Duration) string {
+	seconds := int((d + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return strconv.Itoa(seconds)
+}
+
+func (res *Response) HandleHTTPVersionNotSupported() {
+	res.AddProto(responseProto)
+	res.StatusCode = statusHTTPVersionNotSupported
+	res.FilePath = ""
+	res.Headers = make(map[string]string)
+	res.Headers["Date"] = FormatTime(time.Now())
+}
+
+func (res *Response) HandleRequestHeaderFieldsTooLarge() {
+	res.AddProto(responseProto)
+	res.StatusCode = statusRequestHeaderFieldsTooLarge
+	res.FilePath = ""
+	res.Headers = make(map[string]string)
+	res.Headers["Date"] = FormatTime(time.Now())
+}
+
 func (res *Response) HandleBadRequest() {
 	res.AddProto(responseProto)
 	res.StatusCode = statusBadRequest
@@ -68,68 +260,134 @@ func (res *Response) HandleBadRequest() {
 func (s *Server) HandleGoodRequest(req *Request) (res *Response) {
 	res = &Response{}
 	res.Headers = make(map[string] string)
-	cwd, err := os.Getwd()
-	if err != nil {
-		log.Fatal(err)
-	}
-	projectDir := filepath.Join(cwd, "../../")
 	host := req.Host
-	url := req.URL
-	connection := req.Headers[CONNECTION]
-	virtualHost, exists := s.VirtualHosts[host]
+	url := req.Path
+	// The docroot and options are looked up together once, so that a
+	// reload in the middle of the request can't mix two configs
+	index := s.currentVirtualHosts()
+	vhost, docRoot, exists := index.lookup(host)
 	// fmt.Println("Exists: ", exists)
 	// fmt.Println("Url: ", url)
 	// fmt.Println("Host: ", host)
-	// fmt.Println("VirtualHost: ", virtualHost)
-	// fmt.Println("Cwd: ", cwd)
 	if !exists {
 		// fmt.Println("Host not exists in virtualHost")
 		res.HandleStatusNotFound()
-		if (req.Headers[CONNECTION] == CLOSE) {
+		if req.Close {
 			res.Headers[CONNECTION] = CLOSE
 		}
 		return res
 	}
-	reqFile := filepath.Join(cwd, virtualHost)
-	pathStats, err := os.Stat(filepath.Join(reqFile, url))
-	if errors.Is(err, os.ErrNotExist) {
-		// log.Println("Invalid path", err)
+	req.VirtualHost = vhost
+	options := index.vhostOptions(vhost)
+	// Rewrite rules come first, so that everything after them sees the
+	// rewritten path
+	if rewriteRes := s.applyRewrites(options, req); rewriteRes != nil {
+		return rewriteRes
+	}
+	url = req.Path
+	if !s.accessAllowed(options, req) {
+		res.HandleForbidden()
+		if req.Close {
+			res.Headers[CONNECTION] = CLOSE
+		}
+		return res
+	}
+	if allowed, retryAfter := s.allowRequest(options, req); !allowed {
+		res.HandleTooManyRequests(retryAfter)
+		if req.Close {
+			res.Headers[CONNECTION] = CLOSE
+		}
+		return res
+	}
+	user, challenge, authenticated := s.authenticate(options, req)
+	if !authenticated {
+		res.HandleUnauthorized(challenge)
+		if req.Close {
+			res.Headers[CONNECTION] = CLOSE
+		}
+		return res
+	}
+	req.User = user
+	// Proxy virtual hosts, WebSocket and event stream handlers, FastCGI
+	// backends and CGI scripts get every method, static files are only
+	// served for GET
+	if proxy := options.proxy; proxy != nil {
+		return proxy.serve(req, s.clientIP(req))
+	}
+	if handler, exists := s.WebSocketHandlers[req.Path]; exists {
+		return s.upgradeWebSocket(req, handler)
+	}
+	if handler, exists := s.EventStreamHandlers[req.Path]; exists {
+		return s.serveEventStream(req, handler)
+	}
+	if fastCGIRes := s.serveFastCGI(options, req); fastCGIRes != nil {
+		return fastCGIRes
+	}
+	if cgiRes := s.serveCGI(options, req); cgiRes != nil {
+		return cgiRes
+	}
+	if req.Method != GET {
+		res.HandleBadRequest()
+		if req.Close {
+			res.Headers[CONNECTION] = CLOSE
+		}
+		return res
+	}
+	// Convert the URL into a path inside the docroot file system. Cleaning
+	// the rooted URL drops any ".." segments, so the path can never point
+	// outside of the docroot
+	reqFile := strings.TrimPrefix(path.Clean(url), "/")
+	if len(reqFile) == 0 {
+		reqFile = "."
+	}
+	if !fs.ValidPath(reqFile) {
 		res.HandleStatusNotFound()
-		if (req.Headers[CONNECTION] == CLOSE) {
+		if req.Close {
 			res.Headers[CONNECTION] = CLOSE
 		}
 		return res
 	}
-	// If URL ends with /, interpret as index.html
-	if pathStats.IsDir() || url[len(url) - 1] == '/' {
-		// fmt.Println("Url ends with /")
-		reqFile = filepath.Join(reqFile, url, "index.html")
-	} else {
-		reqFile = filepath.Join(reqFile, url)
-	}
-	// fmt.Println("Before clean: ", reqFile)
-	reqFile = filepath.Clean(reqFile)
-	// fmt.Println("After clean: ", reqFile)
-	// Check if reqFile is outside the parent directory
-	// cwd must be a substring of reqFile
-	// fmt.Println("ProjectDir: ", projectDir)
-	// fmt.Println("Is prefix: ", strings.HasPrefix(reqFile, projectDir))
-	if !strings.HasPrefix(reqFile, projectDir) {
+	if isDotfile(reqFile) && s.Dotfiles != DotfilesAllow {
+		if s.Dotfiles == DotfilesDeny {
+			res.HandleForbidden()
+		} else {
+			res.HandleStatusNotFound()
+		}
+		if req.Close {
+			res.Headers[CONNECTION] = CLOSE
+		}
+		return res
+	}
+	pathStats, err := fs.Stat(docRoot, reqFile)
+	if err != nil {
+		// log.Println("Invalid path", err)
+		if fallback := s.spaFallback(options, docRoot, req); fallback != nil {
+			return fallback
+		}
 		res.HandleStatusNotFound()
-		if (req.Headers[CONNECTION] == CLOSE) {
+		if req.Close {
 			res.Headers[CONNECTION] = CLOSE
 		}
 		return res
 	}
+	// If URL ends with /, interpret as index.html
+	if pathStats.IsDir() || url[len(url) - 1] == '/' {
+		// fmt.Println("Url ends with /")
+		reqFile = path.Join(reqFile, "index.html")
+	}
+	res.FS = docRoot
 	res.FilePath = reqFile
 	// fmt.Println("ReqFile: ", reqFile)
 	// Read file
 	res.AddProto(responseProto)
-	stats, err := os.Stat(reqFile)
-	if errors.Is(err, os.ErrNotExist) {
+	stats, err := fs.Stat(docRoot, reqFile)
+	if err != nil {
 		// log.Println("No file or invalid file", err)
+		if fallback := s.spaFallback(options, docRoot, req); fallback != nil {
+			return fallback
+		}
 		res.HandleStatusNotFound()
-		if (req.Headers[CONNECTION] == CLOSE) {
+		if req.Close {
 			res.Headers[CONNECTION] = CLOSE
 		}
 		return res
@@ -137,10 +395,16 @@ func (s *Server) HandleGoodRequest(req *Request) (res *Response) {
 	res.StatusCode = 200 
 	// fmt.Println("Stats: ", stats)
 	res.Headers["Content-Length"] = strconv.FormatInt(stats.Size(), 10)
-	res.Headers["Content-Type"] = MIMETypeByExtension(filepath.Ext(reqFile))
+	res.Headers["Content-Type"] = MIMETypeByExtension(path.Ext(reqFile))
 	res.Headers["Date"] = FormatTime(time.Now())
 	res.Headers["Last-Modified"] = FormatTime(stats.ModTime())
-	if connection == CLOSE {
+	// The index.html of a single-page application isn't cached either when
+	// asked for directly, see spaFallback
+	if reqFile == "index.html" && options.spaFallback {
+		res.Headers["Cache-Control"] = "no-cache"
+	}
+	s.applyCacheRules(options, res)
+	if req.Close {
 		res.Headers[CONNECTION] = CLOSE
 	}
 	// fmt.Println("Response to be sent: ", res)
@@ -149,8 +413,22 @@ func (s *Server) HandleGoodRequest(req *Request) (res *Response) {
 
 func (res *Response) Write(w io.Writer) error {
 	bw := bufio.NewWriter(w)
-	// Write status line
-	statusLine := fmt.Sprintf("%v %v %v\r\n", res.Proto, res.StatusCode, statusText[res.StatusCode])
+	// Write status line, keeping the reason phrase of proxied responses
+	text := res.StatusText
+	if len(text) == 0 {
+		text = statusText[res.StatusCode]
+	}
+	// A line break in a header value would start a header of its own, so
+	// such responses are refused before anything is written
+	for key, value := range res.Headers {
+		if key == "Set-Cookie" {
+			value = strings.ReplaceAll(value, "\n", "")
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("line break in the value of header %s", key)
+		}
+	}
+	statusLine := fmt.Sprintf("%v %v %v\r\n", res.Proto, res.StatusCode, text)
 	// fmt.Println("Write statusLine: ",statusLine)
 	if _, err := bw.WriteString(statusLine); err != nil {
 		return err
@@ -164,9 +442,13 @@ func (res *Response) Write(w io.Writer) error {
 	sort.Strings(headerKeys)
 
 	for _, key := range headerKeys {
-		keyValue := key + ": " + headers[key] + "\r\n"
-		if _, err := bw.WriteString(keyValue); err != nil {
-			return err
+		// Headers that can't be combined into a list, such as Set-Cookie,
+		// hold one value per line
+		for _, value := range strings.Split(headers[key], "\n") {
+			keyValue := key + ": " + value + "\r\n"
+			if _, err := bw.WriteString(keyValue); err != nil {
+				return err
+			}
 		}
 		// fmt.Println("Write header: ",keyValue)
 	}
@@ -175,12 +457,30 @@ func (res *Response) Write(w io.Writer) error {
 	}
 	// Write Body
 	filePath := res.FilePath
-	if len(filePath) > 0 {
-		data, err := os.ReadFile(filePath)
+	if res.Body != nil {
+		// The headers go out before the body is produced
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+		n, err := res.writeBody(bw)
+		res.bodyBytes = n
 		if err != nil {
 			return err
 		}
-		if _, err := bw.Write(data); err != nil {
+	} else if len(filePath) > 0 {
+		var data []byte
+		var err error
+		if res.FS != nil {
+			data, err = fs.ReadFile(res.FS, filePath)
+		} else {
+			data, err = os.ReadFile(filePath)
+		}
+		if err != nil {
+			return err
+		}
+		n, err := bw.Write(data)
+		res.bodyBytes = int64(n)
+		if err != nil {
 			return err
 		}
 		// fmt.Println("Write data:", len(data))
@@ -188,7 +488,41 @@ func (res *Response) Write(w io.Writer) error {
 	// fmt.Println("Write done")
 	if err := bw.Flush(); err != nil {
 		// log.Println("Flush error: ", err)
-		return nil
+		return err
 	}
 	return nil
-}
\ No newline at end of file
+}
+
+// Method which copies res.Body to bw, chunked if the Transfer-Encoding
+// header asks for it, flushing bw after every piece of the body. It
+// returns how many body bytes were copied.
+func (res *Response) writeBody(bw *bufio.Writer) (int64, error) {
+	if !hasToken(res.Headers["Transfer-Encoding"], "chunked") {
+		return io.Copy(&flushWriter{w: bw, bw: bw}, res.Body)
+	}
+	cw := httputil.NewChunkedWriter(bw)
+	n, err := io.Copy(&flushWriter{w: cw, bw: bw}, res.Body)
+	if err != nil {
+		return n, err
+	}
+	if err := cw.Close(); err != nil {
+		return n, err
+	}
+	// Close only writes the last chunk, the empty trailer ends the body
+	_, err = io.WriteString(bw, "\r\n")
+	return n, err
+}
+
+// flushWriter writes to w and then flushes bw, the buffer underneath w
+type flushWriter struct {
+	w  io.Writer
+	bw *bufio.Writer
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, fw.bw.Flush()
+}
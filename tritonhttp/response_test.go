@@ -0,0 +1,26 @@
+package tritonhttp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestResponseWriteRefusesLineBreaks(t *testing.T) {
+	for _, value := range []string{"/new/x\r\nSet-Cookie: evil=1", "/new/x\r", "/new/x\nX-Evil: 1"} {
+		res := &Response{Proto: "HTTP/1.1", StatusCode: 301, Headers: map[string]string{"Location": value}}
+		var b bytes.Buffer
+		if err := res.Write(&b); err == nil || b.Len() > 0 {
+			t.Fatalf("Expected %q to be refused but got %q (%v)\n", value, b.String(), err)
+		}
+	}
+	// Set-Cookie holds one value per line
+	res := &Response{Proto: "HTTP/1.1", StatusCode: 200, Headers: map[string]string{"Set-Cookie": "a=1\nb=2", "Content-Length": "0"}}
+	var b bytes.Buffer
+	if err := res.Write(&b); err != nil || !bytes.Contains(b.Bytes(), []byte("Set-Cookie: a=1\r\nSet-Cookie: b=2\r\n")) {
+		t.Fatalf("Expected two Set-Cookie lines but got %q (%v)\n", b.String(), err)
+	}
+	res.Headers["Set-Cookie"] = "a=1\r\nb=2"
+	if err := res.Write(&bytes.Buffer{}); err == nil {
+		t.Fatal("Expected a CR in Set-Cookie to be refused")
+	}
+}
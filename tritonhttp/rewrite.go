@@ -0,0 +1,276 @@
+package tritonhttp
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// MAX_REWRITES is how many internal rewrites a request may go through
+// before it counts as a rewrite loop
+const MAX_REWRITES = 10
+
+// RewriteConfig is a rule of a virtual host changing request paths before
+// anything else looks at them. A rule matches by Prefix, which covers the
+// prefix and everything below it, or by the regular expression Match. To
+// is the new path, written percent-encoded like a URL: the rest of the
+// path below Prefix is appended to it, while with Match it may refer to the
+// groups of the expression as $1 or ${name}. The parts taken from the
+// request path are percent-encoded again on the way in.
+//
+// With Redirect set to 301, 302, 303, 307 or 308 the client is redirected
+// to To, which may then also be an absolute URL. Otherwise the request is
+// served as if it had asked for To, and the rules are evaluated again from
+// the top for the new path, unless the rule is Last.
+type RewriteConfig struct {
+	Prefix   string `yaml:"prefix"`
+	Match    string `yaml:"match"`
+	To       string `yaml:"to"`
+	Redirect int    `yaml:"redirect"`
+	Last     bool   `yaml:"last"`
+}
+
+// rewriteRule is the parsed form of a RewriteConfig
+type rewriteRule struct {
+	prefix   string
+	re       *regexp.Regexp
+	to       string
+	redirect int
+	last     bool
+}
+
+// Method which checks rc and builds its rule
+func (rc *RewriteConfig) parse() (*rewriteRule, error) {
+	rule := &rewriteRule{prefix: rc.Prefix, to: rc.To, redirect: rc.Redirect, last: rc.Last}
+	if (len(rc.Prefix) > 0) == (len(rc.Match) > 0) {
+		return nil, fmt.Errorf("rule needs either prefix or match")
+	}
+	if len(rc.Prefix) > 0 && !strings.HasPrefix(rc.Prefix, "/") {
+		return nil, fmt.Errorf("prefix %q must start with /", rc.Prefix)
+	}
+	if len(rc.Match) > 0 {
+		re, err := regexp.Compile(rc.Match)
+		if err != nil {
+			return nil, fmt.Errorf("invalid match %q: %v", rc.Match, err)
+		}
+		rule.re = re
+	}
+	if strings.IndexFunc(rc.To, func(r rune) bool { return r <= ' ' || r == 0x7f }) != -1 {
+		return nil, fmt.Errorf("target %q may not contain spaces or control characters", rc.To)
+	}
+	switch rc.Redirect {
+	case 0:
+		if !strings.HasPrefix(rc.To, "/") {
+			return nil, fmt.Errorf("rewrite target %q must start with /", rc.To)
+		}
+		toPath, _, _ := strings.Cut(rc.To, "?")
+		if _, err := decodePath(toPath, EncodedSlashesDecode); err != nil {
+			return nil, fmt.Errorf("rewrite target %q: %v", rc.To, err)
+		}
+	case 301, 302, 303, 307, 308:
+		if len(rc.To) == 0 {
+			return nil, fmt.Errorf("redirect needs a target")
+		}
+		if rc.Last {
+			return nil, fmt.Errorf("last only applies to rewrites")
+		}
+	default:
+		return nil, fmt.Errorf("redirect status %d is not one of 301, 302, 303, 307 and 308", rc.Redirect)
+	}
+	return rule, nil
+}
+
+// Method which returns what rule turns the decoded reqPath into, if it
+// matches. The target is percent-encoded, so that e.g. a "%3F" in reqPath
+// doesn't turn into the start of a query.
+func (rule *rewriteRule) apply(reqPath string) (string, bool) {
+	if rule.re != nil {
+		match := rule.re.FindStringSubmatchIndex(reqPath)
+		if match == nil {
+			return "", false
+		}
+		// Expand the template from the encoded groups
+		var src strings.Builder
+		encoded := make([]int, len(match))
+		for i := 0; i < len(match); i += 2 {
+			if match[i] < 0 {
+				encoded[i], encoded[i+1] = -1, -1
+				continue
+			}
+			encoded[i] = src.Len()
+			src.WriteString(escapePath(reqPath[match[i]:match[i+1]]))
+			encoded[i+1] = src.Len()
+		}
+		return string(rule.re.ExpandString(nil, rule.to, src.String(), encoded)), true
+	}
+	reqPath = cleanPath(reqPath)
+	if !pathHasPrefix(reqPath, rule.prefix) {
+		return "", false
+	}
+	target := strings.TrimSuffix(rule.to, "/") + escapePath(strings.TrimPrefix(reqPath, strings.TrimSuffix(rule.prefix, "/")))
+	if len(target) == 0 {
+		target = "/"
+	}
+	return target, true
+}
+
+// Method which percent-encodes p for use in a URL
+func escapePath(p string) string {
+	return (&url.URL{Path: p}).EscapedPath()
+}
+
+// rewriteResult is the outcome of evaluating the rewrite rules for a
+// request: either a new path and query, a redirect, a loop or a target
+// that isn't a valid path
+type rewriteResult struct {
+	path     string
+	rawQuery string
+	redirect int
+	location string
+	loop     bool
+	invalid  bool
+}
+
+// Method which evaluates rules in order on reqPath and rawQuery. trace, if
+// set, is told about every rule applied.
+func rewrite(rules []*rewriteRule, reqPath string, rawQuery string, trace func(string)) rewriteResult {
+	result := rewriteResult{path: reqPath, rawQuery: rawQuery}
+	if trace == nil {
+		trace = func(string) {}
+	}
+	for rewrites := 0; ; rewrites++ {
+		if rewrites == MAX_REWRITES {
+			trace(fmt.Sprintf("more than %d rewrites, giving up", MAX_REWRITES))
+			result.loop = true
+			return result
+		}
+		rewritten := false
+		for i, rule := range rules {
+			target, matches := rule.apply(result.path)
+			if !matches {
+				continue
+			}
+			if rule.redirect != 0 {
+				result.redirect, result.location = rule.redirect, target
+				if !strings.Contains(target, "?") && len(result.rawQuery) > 0 {
+					result.location += "?" + result.rawQuery
+				}
+				trace(fmt.Sprintf("rule %d redirects %s to %s with %d", i+1, result.path, result.location, result.redirect))
+				// Redirecting to the path that was asked for never ends
+				if result.location == joinQuery(escapePath(reqPath), rawQuery) {
+					trace("the redirect points back at the request")
+					result.loop = true
+				}
+				return result
+			}
+			targetPath, targetQuery, hasQuery := strings.Cut(target, "?")
+			if !hasQuery {
+				targetQuery = result.rawQuery
+			}
+			decoded, err := decodePath(targetPath, EncodedSlashesDecode)
+			if err != nil {
+				trace(fmt.Sprintf("rule %d rewrites %s to the invalid path %s", i+1, result.path, targetPath))
+				result.invalid = true
+				return result
+			}
+			targetPath = removeDotSegments(collapseSlashes(decoded))
+			if targetPath == result.path && targetQuery == result.rawQuery {
+				// A rule that leaves the path alone ends the evaluation
+				trace(fmt.Sprintf("rule %d leaves %s unchanged", i+1, joinQuery(result.path, result.rawQuery)))
+				return result
+			}
+			trace(fmt.Sprintf("rule %d rewrites %s to %s", i+1, joinQuery(result.path, result.rawQuery), joinQuery(targetPath, targetQuery)))
+			result.path, result.rawQuery = targetPath, targetQuery
+			if rule.last {
+				return result
+			}
+			rewritten = true
+			break
+		}
+		if !rewritten {
+			return result
+		}
+	}
+}
+
+// Method which appends rawQuery, if any, to reqPath
+func joinQuery(reqPath string, rawQuery string) string {
+	if len(rawQuery) == 0 {
+		return reqPath
+	}
+	return reqPath + "?" + rawQuery
+}
+
+// Method which applies the rewrite rules in options to req. Internal
+// rewrites change req.Path and req.RawQuery and return nil; redirects and
+// rewrite loops return the response to send instead.
+func (s *Server) applyRewrites(options *virtualHostOptions, req *Request) *Response {
+	rules := options.rewriteRules
+	if len(rules) == 0 {
+		return nil
+	}
+	result := rewrite(rules, req.Path, req.RawQuery, nil)
+	res := &Response{}
+	switch {
+	case result.loop:
+		log.Printf("Rewrite loop for %v on %v", req.URL, req.VirtualHost)
+		res.HandleInternalServerError()
+	case result.invalid:
+		log.Printf("Invalid rewrite target for %v on %v", req.URL, req.VirtualHost)
+		res.HandleInternalServerError()
+	case result.redirect != 0:
+		res.HandleRedirect(result.redirect, result.location)
+	default:
+		if result.path != req.Path || result.rawQuery != req.RawQuery {
+			req.Path, req.RawQuery = result.path, result.rawQuery
+			req.rewritten = true
+		}
+		return nil
+	}
+	if req.Close {
+		res.Headers[CONNECTION] = CLOSE
+	}
+	return res
+}
+
+// DryRunRewrites evaluates the rewrite rules of the virtual host serving
+// host on target, the way a GET request for it would be, without serving
+// anything. It returns a line for every rule applied followed by the
+// outcome.
+func (c *Config) DryRunRewrites(host string, target string) ([]string, error) {
+	vhosts, err := c.BuildVirtualHosts()
+	if err != nil {
+		return nil, err
+	}
+	options, err := c.buildVirtualHostOptions(func(string) *virtualHostOptions { return &virtualHostOptions{} })
+	if err != nil {
+		return nil, err
+	}
+	index := newVirtualHostIndex(vhosts, options)
+	vhost, _, exists := index.lookup(host)
+	if !exists {
+		return nil, fmt.Errorf("no virtual host serves %q", host)
+	}
+	req := &Request{Method: GET, URL: target}
+	if err := req.ParseTarget(EncodedSlashesReject); err != nil {
+		return nil, err
+	}
+	lines := []string{"virtual host " + vhost}
+	result := rewrite(index.vhostOptions(vhost).rewriteRules, req.Path, req.RawQuery, func(line string) {
+		lines = append(lines, line)
+	})
+	switch {
+	case result.loop:
+		lines = append(lines, "=> rewrite loop, answered with 500")
+	case result.invalid:
+		lines = append(lines, "=> invalid rewrite target, answered with 500")
+	case result.redirect != 0:
+		lines = append(lines, "=> "+strconv.Itoa(result.redirect)+" redirect to "+result.location)
+	default:
+		lines = append(lines, "=> serves "+joinQuery(result.path, result.rawQuery))
+	}
+	return lines, nil
+}
@@ -0,0 +1,156 @@
+package tritonhttp
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRewriteRules(t *testing.T) {
+	tmp := t.TempDir()
+	for name, data := range map[string]string{"index.html": "index", "new/page.html": "new page", "new/what?.html": "question", "blog/index.html": "blog"} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(tmp, "site", name)), 0755); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := os.WriteFile(filepath.Join(tmp, "site", name), []byte(data), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	config := filepath.Join(tmp, "virtual_hosts.yaml")
+	write := func(contents string) {
+		if err := os.WriteFile(config, []byte(contents), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	write(`virtual_hosts:
+  - hostName: "site"
+    docRoot: "site"
+    rewrites:
+      - prefix: "/old"
+        to: "/new"
+        redirect: 301
+      - match: "^/blog/.*"
+        to: "/blog/index.html"
+      - match: "^/external/(.*)$"
+        to: "https://example.com/${1}"
+        redirect: 308
+      - prefix: "/a"
+        to: "/b"
+      - prefix: "/b"
+        to: "/a"
+      - prefix: "/self"
+        to: "/self"
+        redirect: 302
+      - prefix: "/docs"
+        to: "/new/page.html"
+        last: true
+      - prefix: "/files"
+        to: "/new"
+      - prefix: "/new/page.html"
+        to: "/index.html"
+`)
+	c, err := LoadConfig(config, tmp)
+	if err != nil {
+		t.Fatalf("Expected config to be valid but got %v\n", err)
+	}
+	s := &Server{}
+	if err := s.ApplyConfig(c); err != nil {
+		t.Fatal(err.Error())
+	}
+	port := launchserver(t, s)
+
+	tests := []struct {
+		target     string
+		statusCode int
+		location   string
+		body       string
+	}{
+		{"/old/page.html?x=1", 301, "/new/page.html?x=1", ""},
+		{"/external/a/b", 308, "https://example.com/a/b", ""},
+		{"/blog/2024/some-post", 200, "", "blog"},
+		{"/docs", 200, "", "new page"},
+		{"/new/page.html", 200, "", "index"},
+		{"/index.html", 200, "", "index"},
+		// Decoded parts of the path are encoded again in the target
+		{"/old/a%20b.html", 301, "/new/a%20b.html", ""},
+		{"/old/a%3Fb?x=1", 301, "/new/a%3Fb?x=1", ""},
+		{"/external/a%20b", 308, "https://example.com/a%20b", ""},
+		{"/files/what%3F.html", 200, "", "question"},
+		{"/old/x%0D%0ASet-Cookie:%20evil=1", 400, "", ""},
+		// Loops
+		{"/a/x", 500, "", ""},
+		{"/self", 500, "", ""},
+	}
+	for _, tt := range tests {
+		resp := requestfrom(t, "127.0.0.1", port, "GET "+tt.target+" HTTP/1.1\r\nHost: site\r\nConnection: close\r\n\r\n")
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != tt.statusCode || resp.Header.Get("Location") != tt.location || (tt.statusCode == 200 && string(body) != tt.body) {
+			t.Fatalf("Expected %v %q %q for %v but got %v %q %q\n", tt.statusCode, tt.location, tt.body, tt.target, resp.StatusCode, resp.Header.Get("Location"), body)
+		}
+	}
+
+	// The dry run shows every rule applied
+	lines, err := c.DryRunRewrites("site", "/blog/post?page=2")
+	expected := []string{
+		"virtual host site",
+		"rule 2 rewrites /blog/post?page=2 to /blog/index.html?page=2",
+		"rule 2 leaves /blog/index.html?page=2 unchanged",
+		"=> serves /blog/index.html?page=2",
+	}
+	if err != nil || strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("Expected the dry run to show\n%v\nbut got\n%v (%v)\n", strings.Join(expected, "\n"), strings.Join(lines, "\n"), err)
+	}
+	if lines, _ := c.DryRunRewrites("site", "/a"); lines[len(lines)-1] != "=> rewrite loop, answered with 500" {
+		t.Fatalf("Expected the dry run to report the loop but got %v\n", lines)
+	}
+
+	write(`virtual_hosts:
+  - hostName: "site"
+    docRoot: "site"
+    rewrites:
+      - match: "^/(unclosed"
+        to: "/x"
+      - prefix: "/old"
+        to: "relative"
+      - prefix: "/gone"
+        to: "/new"
+        redirect: 404
+      - prefix: "/spaces"
+        to: "/a b"
+      - prefix: "/escapes"
+        to: "/a%zz"
+`)
+	_, err = LoadConfig(config, tmp)
+	if configErr, ok := err.(*ConfigError); !ok || len(configErr.Errors) != 5 {
+		t.Fatalf("Expected five invalid rules to be reported but got %v\n", err)
+	}
+}
+
+func TestRewriteTargetsEncoded(t *testing.T) {
+	prefix, err := (&RewriteConfig{Prefix: "/old", To: "/new", Redirect: 301}).parse()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	match, err := (&RewriteConfig{Match: "^/m/(.*)$", To: "/page?name=${1}"}).parse()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	tests := []struct {
+		rule    *rewriteRule
+		reqPath string
+		target  string
+	}{
+		{prefix, "/old/x\r\nSet-Cookie: evil=1", "/new/x%0D%0ASet-Cookie:%20evil=1"},
+		{prefix, "/old/a b", "/new/a%20b"},
+		{prefix, "/old/a?b", "/new/a%3Fb"},
+		{prefix, "/old/100%", "/new/100%25"},
+		{match, "/m/a?b", "/page?name=a%3Fb"},
+	}
+	for _, tt := range tests {
+		if target, matches := tt.rule.apply(tt.reqPath); !matches || target != tt.target {
+			t.Fatalf("Expected %q to become %q but got %q\n", tt.reqPath, tt.target, target)
+		}
+	}
+}
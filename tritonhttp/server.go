@@ -1,16 +1,23 @@
 package tritonhttp
 
 import (
-	// "fmt"
+	"fmt"
+	"io"
+	"io/fs"
 	"log"
 	"os"
 	"net"
+	"sync/atomic"
 	"time"
 )
 
 const (
 	TCP = "tcp"
+	// RECIEVE_TIMEOUT is the default for Server.IdleTimeout and
+	// Server.ReadHeaderTimeout
 	RECIEVE_TIMEOUT time.Duration = 5 * time.Second
+	// DefaultMaxHeaderBytes is the default for Server.MaxHeaderBytes
+	DefaultMaxHeaderBytes = 1 << 20
 )
 
 type Server struct {
@@ -19,14 +26,122 @@ type Server struct {
 	// during ListenAndServe().
 	Addr string // e.g. ":0"
 
-	// VirtualHosts contains a mapping from host name to the docRoot path
-	// (i.e. the path to the directory to serve static files from) for
-	// all virtual hosts that this server supports
-	VirtualHosts map[string]string
+	// VirtualHosts contains a mapping from host name to the docRoot file
+	// system (i.e. the file system to serve static files from) for all
+	// virtual hosts that this server supports. Any fs.FS works, e.g.
+	// os.DirFS, an embed.FS, a *zip.Reader or an fstest.MapFS.
+	VirtualHosts map[string]fs.FS
+
+	// virtualHosts holds the *virtualHostIndex of the virtual hosts and
+	// options swapped in by SetVirtualHosts or ApplyConfig, which replace
+	// VirtualHosts
+	virtualHosts atomic.Value
+
+	// Dotfiles decides how requests for dotfiles such as ".git" or ".env"
+	// are answered. By default they are hidden behind a 404.
+	Dotfiles DotfilePolicy
+
+	// EncodedSlashes decides whether "%2F" in a request path is rejected
+	// with 400 (the default) or decoded into a path separator
+	EncodedSlashes EncodedSlashPolicy
+
+	// ProxyMode makes the server accept CONNECT requests and tunnel them
+	// to the requested host:port. This turns the server into an open
+	// forward proxy, so it should only be enabled on trusted networks.
+	ProxyMode bool
+
+	// WebSocketHandlers maps request paths to the handlers of the
+	// WebSocket connections opened on them, on every virtual host that
+	// isn't a proxy. Connections that send no frame for
+	// WebSocketIdleTimeout are closed, which defaults to
+	// DEFAULT_WEBSOCKET_IDLE_TIMEOUT; handlers can keep quiet clients
+	// around with Ping.
+	WebSocketHandlers    map[string]WebSocketHandler
+	WebSocketIdleTimeout time.Duration
+
+	// EventStreamHandlers maps request paths to the handlers of the
+	// Server-Sent Events streams served on them, like WebSocketHandlers.
+	// Idle streams get a heartbeat comment every EventStreamHeartbeat,
+	// which defaults to DEFAULT_EVENT_STREAM_HEARTBEAT.
+	EventStreamHandlers  map[string]EventStreamHandler
+	EventStreamHeartbeat time.Duration
+
+	// AccessLog, if set, records every response sent
+	AccessLog *AccessLog
+
+	// Metrics, if set, collects request and connection metrics
+	Metrics *Metrics
+
+	// ReadHeaderTimeout is how long a client may take to send a request
+	// line and headers, counted from their first byte. The deadline isn't
+	// extended as more bytes arrive, so trickling a request doesn't keep
+	// the connection open. Defaults to RECIEVE_TIMEOUT.
+	ReadHeaderTimeout time.Duration
+
+	// IdleTimeout is how long a keep-alive connection waits for the next
+	// request before it is closed. Defaults to RECIEVE_TIMEOUT.
+	IdleTimeout time.Duration
+
+	// WriteTimeout limits how long writing a single response may take.
+	// Defaults to SEND_TIMEOUT.
+	WriteTimeout time.Duration
+
+	// MinWriteRate, in bytes per second, lets responses take longer than
+	// WriteTimeout as long as the client keeps reading at least that fast
+	// on average. WriteTimeout is then the grace period before the rate
+	// is enforced. Zero disables it.
+	MinWriteRate int
+
+	// MinReadRate, in bytes per second, is the rate at which a client
+	// must send a request body once ReadHeaderTimeout has passed since the
+	// body started. Zero only requires some data every ReadHeaderTimeout.
+	MinReadRate int
+
+	// MaxRequestsPerConn closes a connection after it has served that
+	// many requests. Zero means no limit.
+	MaxRequestsPerConn int
+
+	// MaxHeaderBytes limits the size of a request line plus headers,
+	// larger requests are answered with 431. Defaults to
+	// DefaultMaxHeaderBytes.
+	MaxHeaderBytes int
+
+	// MaxConns limits the number of connections served at once, and
+	// MaxConnsPerIP the number served for a single client IP. Connections
+	// over a limit are answered with 503 and closed. Zero means no limit.
+	MaxConns      int
+	MaxConnsPerIP int
+
+	// RetryAfter is sent in the Retry-After header of 503 responses.
+	// Defaults to DEFAULT_RETRY_AFTER.
+	RetryAfter time.Duration
+
+	// TrustedProxies are the proxies whose X-Forwarded-For header is
+	// believed when looking up the client IP, e.g. for rate limiting
+	TrustedProxies []*net.IPNet
+
+	// conns counts the open connections, per client IP and in total
+	conns connCounter
+	// refusing counts the connections being answered with 503
+	refusing atomic.Int32
+}
+
+func durationOr(d time.Duration, def time.Duration) time.Duration {
+	if d > 0 {
+		return d
+	}
+	return def
+}
+
+func (s *Server) maxHeaderBytes() int {
+	if s.MaxHeaderBytes > 0 {
+		return s.MaxHeaderBytes
+	}
+	return DefaultMaxHeaderBytes
 }
 
 // Method which checks the validity of the current working directory
-func (s Server) ValidateServerSetup() error {
+func (s *Server) ValidateServerSetup() error {
 	cwd, err := os.Getwd()
 	// log.Println("Validity server setup cwd: ", cwd)
 	if err != nil {
@@ -53,13 +168,42 @@ func (s *Server) ListenAndServe() error {
 	if err != nil {
 		return err
 	}
+	return s.Serve(listener)
+}
+
+// Serve accepts connections on listener and handles their requests. It
+// backs off and retries when accepting fails temporarily, e.g. because
+// the process ran out of file descriptors, and only returns on other
+// errors.
+func (s *Server) Serve(listener net.Listener) error {
 	defer listener.Close()
+	var backoff time.Duration
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			return err
+			if !isTemporaryAcceptError(err) {
+				return err
+			}
+			if backoff == 0 {
+				backoff = MIN_ACCEPT_BACKOFF
+			} else if backoff *= 2; backoff > MAX_ACCEPT_BACKOFF {
+				backoff = MAX_ACCEPT_BACKOFF
+			}
+			log.Printf("Accept error: %v; retrying in %v", err, backoff)
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+		ip := remoteIP(conn)
+		if reason := s.conns.acquire(ip, s.MaxConns, s.MaxConnsPerIP); len(reason) > 0 {
+			s.Metrics.countRejectedConn(reason)
+			s.refuseConnection(conn)
+			continue
 		}
-		go s.HandleConnection(conn)
+		go func() {
+			defer s.conns.release(ip)
+			s.HandleConnection(conn)
+		}()
 	}
 }
 
@@ -67,71 +211,169 @@ func (s *Server) HandleConnection(conn net.Conn) {
 	// Remaining is the string which contains the http request which is not
 	// yet parsed but received
 	var remaining string = ""
+	var state connState
+	defer s.Metrics.setConnState(&state, connClosed)
+	// Number of requests served on this connection
+	served := 0
+	// When the first byte of the partial request in remaining arrived
+	var headerStart time.Time
 	for {
-		// log.Println("## For loop #")
-		// Set both read and write timeout
-		if err := conn.SetReadDeadline(time.Now().Add(RECIEVE_TIMEOUT)); err != nil {
-			_ = conn.Close()
-			return
+		var err error
+		// Read more unless a complete request is already buffered, e.g.
+		// after the body of a previous one
+		if !hasFullRequest(remaining) {
+			// A connection without a partial request is waiting for the next one
+			if len(remaining) == 0 {
+				s.Metrics.setConnState(&state, connIdle)
+			} else {
+				s.Metrics.setConnState(&state, connActive)
+				if headerStart.IsZero() {
+					headerStart = time.Now()
+				}
+			}
+			// log.Println("## For loop #")
+			// Wait up to IdleTimeout for a new request, and for a partial
+			// one until ReadHeaderTimeout after its first byte. The write
+			// deadline is set for every response in writeResponse.
+			deadline := time.Now().Add(durationOr(s.IdleTimeout, RECIEVE_TIMEOUT))
+			if len(remaining) > 0 {
+				deadline = headerStart.Add(durationOr(s.ReadHeaderTimeout, RECIEVE_TIMEOUT))
+			}
+			if err := conn.SetReadDeadline(deadline); err != nil {
+				_ = conn.Close()
+				return
+			}
+
+			// Read what the client sent (it could be multiple HTTP requests)
+			err = readMore(conn, &remaining)
+			if len(remaining) > 0 && headerStart.IsZero() {
+				headerStart = time.Now()
+			}
+			if depth := countFullRequests(remaining); depth > 0 {
+				s.Metrics.setConnState(&state, connActive)
+				s.Metrics.observePipelineDepth(depth)
+			}
 		}
-		// if err := conn.SetWriteDeadline(time.Now().Add(SEND_TIMEOUT)); err != nil {
-		// 	_ = conn.Close()
-		// 	return
-		// }
-
-		// Read the requests sent by the client (it could be multiple HTTP requests)
-		allLines, err := ReadAllRequests(conn, &remaining)
-		// Handle each request sent
-		for _, singleReq := range allLines {
+		// Handle each complete request, one at a time since a request body
+		// has to be read before the next request starts
+		for {
+			singleReq, ok := nextRequest(&remaining)
+			if !ok {
+				break
+			}
+			headerStart = time.Time{}
+			start := time.Now()
+			if requestSize(singleReq) > s.maxHeaderBytes() {
+				s.refuseLargeHeaders(conn, start)
+				return
+			}
 			req, errors := HandleRequest(singleReq)
+			req.RemoteAddr = conn.RemoteAddr().String()
+			req.LocalAddr = conn.LocalAddr().String()
+			served++
+			if s.MaxRequestsPerConn > 0 && served >= s.MaxRequestsPerConn {
+				req.Close = true
+			}
+			if len(errors) == 0 {
+				if err := req.ParseTarget(s.EncodedSlashes); err != nil {
+					errors = append(errors, err)
+				} else if req.Method == CONNECT && !s.ProxyMode {
+					errors = append(errors, fmt.Errorf("CONNECT is only supported in proxy mode"))
+				} else if err := s.setupBody(conn, &remaining, req); err != nil {
+					// Without knowing where the body ends the
+					// connection can't be used for further requests
+					errors = append(errors, err)
+					req.Close = true
+				}
+			}
 			if len(errors) > 0 {
 				// log.Println("******** Handle Request Error **********")
 				// log.Println("Errors: ", errors)
+				// The body, if any, can't be skipped reliably
+				req.Close = req.Close || declaresBody(req)
 				res := &Response{}
 				res.Headers = make(map[string] string)
-				res.HandleBadRequest()
-				if (req.Headers[CONNECTION] == CLOSE) {
+				if hasError(errors, errHTTPVersionNotSupported) {
+					res.HandleHTTPVersionNotSupported()
+				} else {
+					res.HandleBadRequest()
+				}
+				if req.Close {
 					res.Headers[CONNECTION] = CLOSE
 				}
-				_ = res.Write(conn)
-				if (req.Headers[CONNECTION] == CLOSE) {
+				_ = s.writeResponse(conn, req, res, start)
+				if req.Close {
 					_ = conn.Close()
 					return
 				}
 				continue
 			}
 
-			// Host not present, send 400 client error
-			if len(req.Host) == 0 {
+			// Host not present, send 400 client error. HTTP/1.0 doesn't
+			// require a Host and falls back to the default virtual host.
+			if len(req.Host) == 0 && req.ProtoAtLeast(1, 1) {
 				// log.Println("Host not present")
 				res := &Response{}
 				res.Headers = make(map[string] string)
 				res.HandleBadRequest()
-				if (req.Headers[CONNECTION] == CLOSE) {
+				req.Close = req.Close || req.Body != nil
+				if req.Close {
 					res.Headers[CONNECTION] = CLOSE
 				}
-				_ = res.Write(conn)
-				if (req.Headers[CONNECTION] == CLOSE) {
+				_ = s.writeResponse(conn, req, res, start)
+				if req.Close {
 					_ = conn.Close()
 					return
 				}
 				continue
 			}
 
+			// CONNECT turns the connection into a tunnel to the target
+			if req.Method == CONNECT {
+				s.HandleConnect(conn, req, remaining, start)
+				return
+			}
+
 			// Handle good request
 			// log.Println("Handling good request")
 			res := s.HandleGoodRequest(req)
-			err = res.Write(conn)
+			// A body the handler didn't read is skipped, unless it is too
+			// large, in which case the connection is closed instead
+			if body, ok := req.Body.(*bodyReader); ok && !body.discard(MAX_DISCARD_BYTES) && !req.Close {
+				req.Close = true
+				res.Headers[CONNECTION] = CLOSE
+			}
+			// HTTP/1.0 closes by default, so a persistent connection
+			// has to be confirmed explicitly
+			if !req.Close && !req.ProtoAtLeast(1, 1) {
+				res.Headers[CONNECTION] = KEEP_ALIVE
+			}
+			err = s.writeResponse(conn, req, res, start)
 			if err != nil {
 				// log.Println("Res Write: ", err)
+				// The client didn't take the response within WriteTimeout
+				_ = conn.Close()
+				return
+			}
+			// The connection now belongs to another protocol
+			if res.Hijack != nil {
+				_ = conn.SetDeadline(time.Time{})
+				res.Hijack(conn, []byte(remaining))
+				return
 			}
-			if (req.Headers[CONNECTION] == CLOSE) {
+			if req.Close {
 				conn.Close()
 				// log.Println("Handle connection returned")
-				break
+				return
 			}
 		}
 	
+		// Refuse to buffer a partial request whose headers are too large
+		if len(remaining) > s.maxHeaderBytes() {
+			s.refuseLargeHeaders(conn, time.Now())
+			return
+		}
+
 		// Connection timeout
 		if (err != nil) {
 			// log.Println("********* Connection timeout **********")
@@ -139,6 +381,9 @@ func (s *Server) HandleConnection(conn net.Conn) {
 			// log.Println("Length of remaining: ", len(remaining))
 			// log.Println("Is error timeout: ", err.(net.Error).Timeout())
 			// Client hasn't send anything now, hence close the connection
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				s.Metrics.countTimeout(len(remaining) > 0)
+			}
 			if (len(remaining) == 0) {
 				_ = conn.Close()
 				return
@@ -149,7 +394,7 @@ func (s *Server) HandleConnection(conn net.Conn) {
 			res.Headers = make(map[string] string)
 			res.HandleBadRequest()
 			res.Headers[CONNECTION] = CLOSE
-			err = res.Write(conn)
+			err = s.writeResponse(conn, nil, res, time.Now())
 			if err != nil {
 				// log.Println("Res Write: ", err)
 			}
@@ -161,3 +406,51 @@ func (s *Server) HandleConnection(conn net.Conn) {
 		// responsibility to the timeout mechanism
 	}
 }
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// Method which writes res to conn within WriteTimeout, or at MinWriteRate
+// after that, and records it in the access log and metrics. Streamed bodies
+// get WriteTimeout for every write instead. req may be nil
+// when no request could be parsed.
+func (s *Server) writeResponse(conn net.Conn, req *Request, res *Response, start time.Time) error {
+	// Streamed bodies are produced as they are written, so the deadline
+	// covers every write rather than the whole response
+	cw := &countingWriter{w: newDeadlineWriter(conn, durationOr(s.WriteTimeout, SEND_TIMEOUT), s.MinWriteRate, res.Body != nil)}
+	err := res.Write(cw)
+	if res.done != nil {
+		res.done(err)
+	}
+	s.logResponse(conn, req, res, start)
+	s.Metrics.observeResponse(req, res, cw.n, time.Since(start))
+	return err
+}
+
+// Method which answers a request whose headers exceed MaxHeaderBytes with
+// 431 and closes the connection
+func (s *Server) refuseLargeHeaders(conn net.Conn, start time.Time) {
+	res := &Response{}
+	res.HandleRequestHeaderFieldsTooLarge()
+	res.Headers[CONNECTION] = CLOSE
+	_ = s.writeResponse(conn, nil, res, start)
+	_ = conn.Close()
+}
+
+// Method which returns the size of a request's lines as received
+func requestSize(lines []string) int {
+	size := 0
+	for _, line := range lines {
+		size += len(line) + len(carriageReturnNewLine)
+	}
+	return size
+}
@@ -0,0 +1,208 @@
+package tritonhttp
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// launchserver starts s on a free port and returns the port. The server
+// keeps the listener it was given, so no other test can take the port in
+// between.
+func launchserver(t *testing.T, s *Server) string {
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Error finding a free port: %v\n", err.Error())
+	}
+	t.Cleanup(func() { l.Close() })
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	go s.Serve(l)
+	return port
+}
+
+// fetchresponse sends req to the server on port and parses a single response
+func fetchresponse(t *testing.T, port string, req string) *http.Response {
+	respbytes, _, err := Fetch("localhost", port, []byte(req))
+	if err != nil {
+		t.Fatalf("Error fetching request: %v\n", err.Error())
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respbytes)), nil)
+	if err != nil {
+		t.Fatalf("got an error parsing the response: %v\n", err.Error())
+	}
+	return resp
+}
+
+// readuntilclosed reads from conn until the server closes it and returns
+// what was read, failing if that takes longer than timeout
+func readuntilclosed(t *testing.T, conn net.Conn, timeout time.Duration) []byte {
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		t.Fatal(err.Error())
+	}
+	var buf bytes.Buffer
+	_, err := io.Copy(&buf, conn)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatalf("Expected the server to close the connection within %v\n", timeout)
+	}
+	return buf.Bytes()
+}
+
+func TestMaxRequestsPerConn(t *testing.T) {
+	s := &Server{
+		VirtualHosts: map[string]fs.FS{
+			"site": fstest.MapFS{"index.html": {Data: []byte("index")}},
+		},
+		MaxRequestsPerConn: 2,
+	}
+	port := launchserver(t, s)
+
+	req := strings.Repeat("GET / HTTP/1.1\r\nHost: site\r\n\r\n", 3)
+	respbytes, _, err := Fetch("localhost", port, []byte(req))
+	if err != nil {
+		t.Fatalf("Error fetching request: %v\n", err.Error())
+	}
+	respreader := bufio.NewReader(bytes.NewReader(respbytes))
+	for i, close := range []bool{false, true} {
+		resp, err := http.ReadResponse(respreader, nil)
+		if err != nil {
+			t.Fatalf("Got an error parsing response %v: %v\n", i, err.Error())
+		}
+		if resp.StatusCode != 200 {
+			t.Fatalf("Expected response code of 200 but got %v\n", resp.StatusCode)
+		}
+		if _, err := io.ReadAll(resp.Body); err != nil {
+			t.Fatalf("Error reading response body: %v\n", err.Error())
+		}
+		// ReadResponse turns Connection: close into resp.Close
+		if resp.Close != close {
+			t.Fatalf("Expected Connection: close to be %v on response %v\n", close, i)
+		}
+	}
+	if rest, _ := io.ReadAll(respreader); len(rest) > 0 {
+		t.Fatalf("Expected the connection to be closed after two responses but got %q\n", rest)
+	}
+}
+
+func TestMaxHeaderBytes(t *testing.T) {
+	s := &Server{
+		VirtualHosts: map[string]fs.FS{
+			"site": fstest.MapFS{"index.html": {Data: []byte("index")}},
+		},
+		MaxHeaderBytes: 4096,
+	}
+	port := launchserver(t, s)
+
+	large := "X-Large: " + strings.Repeat("a", 5000) + "\r\n"
+	tests := []struct {
+		req        string
+		statusCode int
+	}{
+		{"GET / HTTP/1.1\r\nHost: site\r\n" + strings.Repeat("X-Small: a\r\n", 100) + "Connection: close\r\n\r\n", 200},
+		// Complete but too large
+		{"GET / HTTP/1.1\r\nHost: site\r\n" + large + "Connection: close\r\n\r\n", 431},
+		// Never completed, refused without waiting for the end
+		{"GET / HTTP/1.1\r\nHost: site\r\n" + large + large, 431},
+	}
+	for _, tt := range tests {
+		conn, err := net.Dial("tcp", "localhost:"+port)
+		if err != nil {
+			t.Fatalf("Error connecting to server: %v\n", err.Error())
+		}
+		if _, err := conn.Write([]byte(tt.req)); err != nil {
+			t.Fatal(err.Error())
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(readuntilclosed(t, conn, 2*time.Second))), nil)
+		conn.Close()
+		if err != nil {
+			t.Fatalf("Error parsing response: %v\n", err.Error())
+		}
+		if resp.StatusCode != tt.statusCode {
+			t.Fatalf("Expected response code of %v but got %v\n", tt.statusCode, resp.StatusCode)
+		}
+		if tt.statusCode == 431 && !resp.Close {
+			t.Fatalf("Expected 431 to close the connection\n")
+		}
+	}
+}
+
+// dialfrom connects to the server on port from the local address ip
+func dialfrom(t *testing.T, ip string, port string) net.Conn {
+	dialer := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(ip)}}
+	conn, err := dialer.Dial("tcp", "127.0.0.1:"+port)
+	if err != nil {
+		t.Fatalf("Error connecting to server from %v: %v\n", ip, err.Error())
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// requestfrom sends req from the local address ip and parses the response
+func requestfrom(t *testing.T, ip string, port string, req string) *http.Response {
+	conn := dialfrom(t, ip, port)
+	if _, err := conn.Write([]byte(req)); err != nil {
+		t.Fatal(err.Error())
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(readuntilclosed(t, conn, 5*time.Second))), nil)
+	if err != nil {
+		t.Fatalf("Error parsing response: %v\n", err.Error())
+	}
+	return resp
+}
+
+// waitforstatus repeats req from ip until it is answered with statusCode,
+// for limits that are only lifted once the server noticed a closed
+// connection
+func waitforstatus(t *testing.T, ip string, port string, req string, statusCode int) *http.Response {
+	var resp *http.Response
+	for i := 0; i < 50; i++ {
+		if resp = requestfrom(t, ip, port, req); resp.StatusCode == statusCode {
+			return resp
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected response code of %v but got %v\n", statusCode, resp.StatusCode)
+	return nil
+}
+
+func TestAcceptBackoff(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v\n", err.Error())
+	}
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	s := &Server{
+		VirtualHosts: map[string]fs.FS{
+			"site": fstest.MapFS{"index.html": {Data: []byte("index")}},
+		},
+	}
+	errs := make(chan error, 1)
+	emfile := &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.EMFILE)}
+	go func() {
+		errs <- s.Serve(&flakylistener{Listener: l, failures: 3, err: emfile})
+	}()
+
+	resp := fetchresponse(t, port, "GET / HTTP/1.1\r\nHost: site\r\nConnection: close\r\n\r\n")
+	if resp.StatusCode != 200 {
+		t.Fatalf("Expected response code of 200 but got %v\n", resp.StatusCode)
+	}
+
+	// Other errors still stop the server
+	l.Close()
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Fatalf("Expected Serve to return an error\n")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected Serve to return once the listener is closed\n")
+	}
+}
@@ -0,0 +1,41 @@
+package tritonhttp
+
+import (
+	"io/fs"
+	"path"
+	"strconv"
+	"time"
+)
+
+// Method which answers a request for a path missing from the docroot of a
+// single-page application virtual host with its index.html, so that the
+// application can route it on the client. Paths whose last segment has an
+// extension, such as a missing script or image, still get 404, as do the
+// requests of other virtual hosts: nil is returned for them.
+func (s *Server) spaFallback(options *virtualHostOptions, docRoot fs.FS, req *Request) *Response {
+	if !options.spaFallback || len(path.Ext(path.Base(req.Path))) > 0 {
+		return nil
+	}
+	stats, err := fs.Stat(docRoot, "index.html")
+	if err != nil || stats.IsDir() {
+		return nil
+	}
+	res := &Response{}
+	res.AddProto(responseProto)
+	res.StatusCode = statusOK
+	res.FS = docRoot
+	res.FilePath = "index.html"
+	res.Headers = make(map[string]string)
+	res.Headers["Content-Length"] = strconv.FormatInt(stats.Size(), 10)
+	res.Headers["Content-Type"] = MIMETypeByExtension(".html")
+	res.Headers["Date"] = FormatTime(time.Now())
+	res.Headers["Last-Modified"] = FormatTime(stats.ModTime())
+	// The same document stands in for every route and changes with each
+	// deploy of the application, so caches have to check back every time
+	res.Headers["Cache-Control"] = "no-cache"
+	s.applyCacheRules(options, res)
+	if req.Close {
+		res.Headers[CONNECTION] = CLOSE
+	}
+	return res
+}
@@ -0,0 +1,69 @@
+package tritonhttp
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSPAFallback(t *testing.T) {
+	tmp := t.TempDir()
+	for name, data := range map[string]string{"app/index.html": "<app>", "app/assets/app.js": "js", "site/index.html": "site"} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(tmp, name)), 0755); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := os.WriteFile(filepath.Join(tmp, name), []byte(data), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	config := filepath.Join(tmp, "virtual_hosts.yaml")
+	if err := os.WriteFile(config, []byte(`virtual_hosts:
+  - hostName: "app"
+    docRoot: "app"
+    spaFallback: true
+  - hostName: "site"
+    docRoot: "site"
+`), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	c, err := LoadConfig(config, tmp)
+	if err != nil {
+		t.Fatalf("Expected config to be valid but got %v\n", err)
+	}
+	s := &Server{}
+	if err := s.ApplyConfig(c); err != nil {
+		t.Fatal(err.Error())
+	}
+	port := launchserver(t, s)
+
+	tests := []struct {
+		host         string
+		target       string
+		statusCode   int
+		body         string
+		cacheControl string
+	}{
+		{"app", "/users/42/settings", 200, "<app>", "no-cache"},
+		{"app", "/assets/", 200, "<app>", "no-cache"},
+		{"app", "/", 200, "<app>", "no-cache"},
+		{"app", "/assets/app.js", 200, "js", ""},
+		{"app", "/assets/missing.js", 404, "", ""},
+		{"app", "/v1.2", 404, "", ""},
+		// Other virtual hosts keep their 404s
+		{"site", "/users/42", 404, "", ""},
+		{"site", "/", 200, "site", ""},
+	}
+	for _, tt := range tests {
+		resp := requestfrom(t, "127.0.0.1", port, "GET "+tt.target+" HTTP/1.1\r\nHost: "+tt.host+"\r\nConnection: close\r\n\r\n")
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != tt.statusCode || resp.Header.Get("Cache-Control") != tt.cacheControl || (tt.statusCode == 200 && string(body) != tt.body) {
+			t.Fatalf("Expected %v %q with Cache-Control %q for %v%v but got %v %q %v\n",
+				tt.statusCode, tt.body, tt.cacheControl, tt.host, tt.target, resp.StatusCode, body, resp.Header)
+		}
+	}
+	resp := requestfrom(t, "127.0.0.1", port, "GET /route HTTP/1.1\r\nHost: app\r\nConnection: close\r\n\r\n")
+	if resp.Header.Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Fatalf("Expected the fallback to be HTML but got %v\n", resp.Header)
+	}
+}
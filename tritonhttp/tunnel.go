@@ -0,0 +1,57 @@
+package tritonhttp
+
+import (
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// HandleConnect serves a CONNECT request in proxy mode. It dials the
+// requested host:port, answers 200 and then copies bytes in both
+// directions until either side closes. buffered holds anything the client
+// already sent after the CONNECT request, which is forwarded first, and
+// start is when the request was received.
+func (s *Server) HandleConnect(conn net.Conn, req *Request, buffered string, start time.Time) {
+	defer conn.Close()
+	res := &Response{}
+	upstream, err := net.DialTimeout(TCP, req.Host, CONNECT_TIMEOUT)
+	if err != nil {
+		res.HandleBadGateway()
+		res.Headers[CONNECTION] = CLOSE
+		_ = s.writeResponse(conn, req, res, start)
+		return
+	}
+	defer upstream.Close()
+
+	res.Headers = make(map[string]string)
+	res.AddProto(responseProto)
+	res.StatusCode = statusOK
+	res.Headers["Date"] = FormatTime(time.Now())
+	if err := s.writeResponse(conn, req, res, start); err != nil {
+		return
+	}
+
+	// The tunnel may stay idle for a long time, so drop the deadlines set
+	// for the request and its response
+	_ = conn.SetDeadline(time.Time{})
+	splice(conn, io.MultiReader(strings.NewReader(buffered), conn), upstream, upstream)
+}
+
+// Method which copies bytes between client and upstream in both
+// directions until either side closes. fromClient and fromUpstream are
+// read instead of the connections, so that bytes already buffered are
+// forwarded first.
+func splice(client net.Conn, fromClient io.Reader, upstream net.Conn, fromUpstream io.Reader) {
+	done := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(upstream, fromClient)
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(client, fromUpstream)
+		done <- struct{}{}
+	}()
+	// Once one direction is finished the tunnel is torn down
+	<-done
+}
@@ -0,0 +1,62 @@
+package tritonhttp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestConnectTunnel(t *testing.T) {
+	// Stand-in for the tunnel target: echo everything back
+	echo, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v\n", err.Error())
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+
+	s := &Server{ProxyMode: true}
+	port := launchserver(t, s)
+
+	conn, err := net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v\n", err.Error())
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", echo.Addr(), echo.Addr())
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: "CONNECT"})
+	if err != nil {
+		t.Fatalf("got an error parsing the response: %v\n", err.Error())
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("Expected response code of 200 but got: %v\n", resp.StatusCode)
+	}
+	if _, err := io.WriteString(conn, "ping"); err != nil {
+		t.Fatalf("Error writing to tunnel: %v\n", err.Error())
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(br, buf); err != nil {
+		t.Fatalf("Error reading from tunnel: %v\n", err.Error())
+	}
+	if string(buf) != "ping" {
+		t.Fatalf("Expected ping to be echoed but got %q\n", buf)
+	}
+}
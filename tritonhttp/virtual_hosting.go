@@ -1,42 +1,145 @@
 package tritonhttp
 
 import (
-	"io/ioutil"
-	"log"
+	"archive/zip"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 
-	"gopkg.in/yaml.v2"
+	"golang.org/x/net/idna"
 )
 
-type VHConfigs struct {
-	VirtualHosts []struct {
-		HostName string `yaml:"hostName"`
-		DocRoot  string `yaml:"docRoot"`
-	} `yaml:"virtual_hosts"`
-}
+// DefaultVirtualHost is the VirtualHosts entry serving requests that don't
+// name a host, such as HTTP/1.0 requests without a Host header, or that
+// name a host no other entry matches
+const DefaultVirtualHost = "*"
 
-func ParseVHConfigFile(vhConfigFilePath string, docroot_dirs_path string) map[string]string {
-	vh_map := make(map[string]string)
-	f, err := ioutil.ReadFile(vhConfigFilePath)
+// ParseVHConfigFile reads and validates the virtual hosting config and
+// returns a mapping from host name to the file system serving its docroot.
+// A docRoot naming a directory is served from disk, while a docRoot naming
+// a ".zip" archive is served straight out of the archive. See LoadConfig
+// for the errors returned.
+func ParseVHConfigFile(vhConfigFilePath string, docroot_dirs_path string) (map[string]fs.FS, error) {
+	config, err := LoadConfig(vhConfigFilePath, docroot_dirs_path)
+	if err != nil {
+		return nil, err
+	}
+	return config.BuildVirtualHosts()
+}
 
+// OpenDocRoot returns a file system for the docroot at path. Directories
+// are served from disk through a DirFS and ".zip" archives are served from
+// the archive contents.
+func OpenDocRoot(path string) (fs.FS, error) {
+	if filepath.Ext(path) == ".zip" {
+		zr, err := zip.OpenReader(path)
+		if err != nil {
+			return nil, err
+		}
+		return zr, nil
+	}
+	fi, err := os.Stat(path)
 	if err != nil {
-		log.Fatalf("could not read config file %s : %v", vhConfigFilePath, err)
+		return nil, err
 	}
+	if !fi.IsDir() {
+		return nil, &fs.PathError{Op: "open", Path: path, Err: fs.ErrInvalid}
+	}
+	return &DirFS{Root: path}, nil
+}
 
-	vhostConfigs := VHConfigs{}
-	err = yaml.Unmarshal(f, &vhostConfigs)
+// NormalizeHost turns a Host header value into the form virtual hosts are
+// matched in: without port or trailing dot, lower-cased and, for
+// internationalized names, in IDNA ASCII form. Wildcard patterns like
+// "*.example.test" are normalized the same way.
+func NormalizeHost(host string) string {
+	if strings.HasPrefix(host, "[") {
+		// IPv6 literal, optionally followed by a port
+		if end := strings.IndexByte(host, ']'); end != -1 {
+			return strings.ToLower(host[:end+1])
+		}
+	} else if strings.Count(host, ":") == 1 {
+		host = host[:strings.IndexByte(host, ':')]
+	}
+	host = strings.TrimSuffix(host, ".")
+	if strings.HasPrefix(host, "*.") {
+		return "*." + NormalizeHost(host[2:])
+	}
+	if ascii, err := idna.Lookup.ToASCII(host); err == nil {
+		return ascii
+	}
+	return strings.ToLower(host)
+}
 
-	for _, vhost := range vhostConfigs.VirtualHosts {
-		docroot_path := filepath.Join(docroot_dirs_path, vhost.DocRoot)
+// virtualHostIndex is a set of virtual hosts prepared for lookups, so that
+// only the host of the request has to be normalized for each of them.
+// Together with their options it is the config a request is served with,
+// and is never modified once published.
+type virtualHostIndex struct {
+	vhosts map[string]fs.FS
+	// options maps entries to their settings beyond the docroot
+	options map[string]*virtualHostOptions
+	// names maps the normalized name of every entry to the entry
+	names map[string]string
+	// wildcards lists the "*." entries, the longest suffix first
+	wildcards []wildcardHost
+}
 
-		// Check if the path exists
-		_, err := os.Stat(docroot_path)
-		if err != nil {
-			log.Fatalf("path to docroot %s doesn't exist : %v", docroot_path, err)
+// wildcardHost is a "*.example.test" entry with its suffix ".example.test"
+type wildcardHost struct {
+	suffix string
+	name   string
+}
+
+// Method which builds the index of vhosts with their options
+func newVirtualHostIndex(vhosts map[string]fs.FS, options map[string]*virtualHostOptions) *virtualHostIndex {
+	index := &virtualHostIndex{vhosts: vhosts, options: options, names: make(map[string]string)}
+	for name := range vhosts {
+		if name == DefaultVirtualHost {
+			continue
+		}
+		pattern := NormalizeHost(name)
+		// Entries that are already normalized win over ones that aren't
+		if existing, exists := index.names[pattern]; !exists || existing != pattern {
+			index.names[pattern] = name
+		}
+		if strings.HasPrefix(pattern, "*.") {
+			index.wildcards = append(index.wildcards, wildcardHost{suffix: pattern[1:], name: name})
 		}
-		vh_map[vhost.HostName] = docroot_path
 	}
+	sort.Slice(index.wildcards, func(i, j int) bool {
+		a, b := index.wildcards[i], index.wildcards[j]
+		if len(a.suffix) != len(b.suffix) {
+			return len(a.suffix) > len(b.suffix)
+		}
+		return a.name < b.name
+	})
+	return index
+}
+
+// Method which finds the docroot serving host in the current virtual hosts
+func (s *Server) lookupVirtualHost(host string) (string, fs.FS, bool) {
+	return s.currentVirtualHosts().lookup(host)
+}
 
-	return vh_map
+// Method which finds the docroot serving host and the name of the entry
+// it was found under. Exact matches are preferred, then the most specific
+// wildcard entry, and finally DefaultVirtualHost.
+func (index *virtualHostIndex) lookup(host string) (string, fs.FS, bool) {
+	host = NormalizeHost(host)
+	if len(host) > 0 {
+		if name, exists := index.names[host]; exists {
+			return name, index.vhosts[name], true
+		}
+		// "*.example.test" matches any subdomain of example.test
+		for _, wildcard := range index.wildcards {
+			if strings.HasSuffix(host, wildcard.suffix) {
+				return wildcard.name, index.vhosts[wildcard.name], true
+			}
+		}
+	}
+	docRoot, exists := index.vhosts[DefaultVirtualHost]
+	return DefaultVirtualHost, docRoot, exists
 }
@@ -0,0 +1,141 @@
+package tritonhttp
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+func TestVirtualHostMatching(t *testing.T) {
+	site := func(name string) fstest.MapFS {
+		return fstest.MapFS{"index.html": {Data: []byte(name)}}
+	}
+	s := &Server{
+		VirtualHosts: map[string]fs.FS{
+			"website1":           site("website1"),
+			"Website2":           site("website2"),
+			"*.example.test":     site("wildcard"),
+			"*.api.example.test": site("api wildcard"),
+			"xn--bcher-kva.test": site("buecher"),
+			DefaultVirtualHost:   site("default"),
+		},
+	}
+	port := launchserver(t, s)
+
+	tests := []struct {
+		host string
+		body string
+	}{
+		{"website1", "website1"},
+		{"website1:8080", "website1"},
+		{"WEBSITE1", "website1"},
+		{"website1.", "website1"},
+		{"website2", "website2"},
+		{"www.example.test", "wildcard"},
+		{"a.b.example.test:80", "wildcard"},
+		{"v1.api.example.test", "api wildcard"},
+		{"example.test", "default"},
+		{"bücher.test", "buecher"},
+		{"[::1]:8080", "default"},
+		{"www.website1", "default"},
+	}
+	for _, tt := range tests {
+		req := fmt.Sprintf("GET / HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", tt.host)
+		resp := fetchresponse(t, port, req)
+		if resp.StatusCode != 200 {
+			t.Fatalf("%v: expected response code of 200 but got: %v\n", tt.host, resp.StatusCode)
+		}
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("Error reading response body: %v\n", err.Error())
+		}
+		if string(body) != tt.body {
+			t.Fatalf("%v: expected to be served by %q but got %q\n", tt.host, tt.body, body)
+		}
+	}
+
+	// Without a default virtual host unknown hosts are not found
+	s = &Server{
+		VirtualHosts: map[string]fs.FS{"website1": site("website1")},
+	}
+	port = launchserver(t, s)
+	resp := fetchresponse(t, port, "GET / HTTP/1.1\r\nHost: www.website1\r\nConnection: close\r\n\r\n")
+	if resp.StatusCode != 404 {
+		t.Fatalf("Expected response code of 404 but got: %v\n", resp.StatusCode)
+	}
+}
+
+func TestVirtualHostConfigAliases(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "virtual_hosts.yaml")
+	err := os.WriteFile(config, []byte(`virtual_hosts:
+  - hostName: "website1"
+    aliases: ["www.website1", "Site1.Example"]
+    docRoot: "htdocs1"
+  - hostName: "website2"
+    docRoot: "htdocs2"
+    default: true
+`), 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	virtualHosts, err := ParseVHConfigFile(config, "../docroot_dirs")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, name := range []string{"website1", "www.website1", "site1.example", "website2", DefaultVirtualHost} {
+		if _, ok := virtualHosts[name]; !ok {
+			t.Fatalf("Expected %v to be a virtual host, got %v\n", name, virtualHosts)
+		}
+	}
+	if virtualHosts["www.website1"] != virtualHosts["website1"] {
+		t.Fatal("Expected alias to share the docroot of website1")
+	}
+	if virtualHosts[DefaultVirtualHost] != virtualHosts["website2"] {
+		t.Fatal("Expected the default virtual host to be website2")
+	}
+}
+
+func TestVirtualHostIndex(t *testing.T) {
+	index := newVirtualHostIndex(map[string]fs.FS{
+		"Website2":           nil,
+		"*.example.test":     nil,
+		"*.API.example.test": nil,
+		"*.b.example.test":   nil,
+		DefaultVirtualHost:   nil,
+	}, nil)
+	if index.names["website2"] != "Website2" {
+		t.Fatalf("Expected website2 to be indexed under its entry but got %v\n", index.names)
+	}
+	suffixes := make([]string, 0)
+	for _, wildcard := range index.wildcards {
+		suffixes = append(suffixes, wildcard.suffix)
+	}
+	if fmt.Sprint(suffixes) != "[.api.example.test .b.example.test .example.test]" {
+		t.Fatalf("Expected the wildcards most specific first but got %v\n", suffixes)
+	}
+
+	// Lookups follow SetVirtualHosts
+	s := &Server{VirtualHosts: map[string]fs.FS{"website1": nil}}
+	if name, _, exists := s.lookupVirtualHost("website1"); !exists || name != "website1" {
+		t.Fatalf("Expected website1 to be found but got %q\n", name)
+	}
+	s.SetVirtualHosts(map[string]fs.FS{"*.example.test": nil})
+	if _, _, exists := s.lookupVirtualHost("website1"); exists {
+		t.Fatal("Expected website1 to be gone after SetVirtualHosts")
+	}
+	if name, _, _ := s.lookupVirtualHost("www.Example.test."); name != "*.example.test" {
+		t.Fatalf("Expected the wildcard to match but got %q\n", name)
+	}
+
+	// The options are kept, and published together with the docroots
+	options := map[string]*virtualHostOptions{"website1": {spaFallback: true}}
+	s.virtualHosts.Store(newVirtualHostIndex(map[string]fs.FS{"*.example.test": nil}, options))
+	s.SetVirtualHosts(map[string]fs.FS{"website1": nil})
+	if !s.currentVirtualHosts().vhostOptions("website1").spaFallback {
+		t.Fatal("Expected SetVirtualHosts to keep the options")
+	}
+}
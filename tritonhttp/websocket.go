@@ -0,0 +1,402 @@
+package tritonhttp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Opcodes of WebSocket frames, see RFC 6455 5.2
+const (
+	WEBSOCKET_CONTINUATION = 0x0
+	WEBSOCKET_TEXT         = 0x1
+	WEBSOCKET_BINARY       = 0x2
+	WEBSOCKET_CLOSE        = 0x8
+	WEBSOCKET_PING         = 0x9
+	WEBSOCKET_PONG         = 0xA
+)
+
+// Status codes of WebSocket close frames, see RFC 6455 7.4.1
+const (
+	WEBSOCKET_CLOSE_NORMAL         = 1000
+	WEBSOCKET_CLOSE_GOING_AWAY     = 1001
+	WEBSOCKET_CLOSE_PROTOCOL_ERROR = 1002
+	WEBSOCKET_CLOSE_INVALID_DATA   = 1007
+	WEBSOCKET_CLOSE_TOO_BIG        = 1009
+	// Reported for close frames without a status code, never sent
+	WEBSOCKET_CLOSE_NO_STATUS = 1005
+)
+
+const (
+	// MAX_WEBSOCKET_MESSAGE_BYTES limits the size of a message received,
+	// all its fragments together. Larger ones close the connection.
+	MAX_WEBSOCKET_MESSAGE_BYTES = 16 << 20
+	// WEBSOCKET_CLOSE_TIMEOUT is how long Close waits for the client to
+	// answer the close frame
+	WEBSOCKET_CLOSE_TIMEOUT time.Duration = 5 * time.Second
+	// DEFAULT_WEBSOCKET_IDLE_TIMEOUT is the default for
+	// Server.WebSocketIdleTimeout
+	DEFAULT_WEBSOCKET_IDLE_TIMEOUT time.Duration = 60 * time.Second
+	// Messages are sent in frames of at most this many bytes
+	webSocketFrameBytes = 64 * 1024
+	// Appended to Sec-WebSocket-Key to compute Sec-WebSocket-Accept
+	webSocketGUID    = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	webSocketVersion = "13"
+)
+
+// ErrWebSocketClosed is returned when writing to a WebSocket connection
+// that sent its close frame
+var ErrWebSocketClosed = errors.New("websocket: connection closed")
+
+// WebSocketHandler serves a WebSocket connection. The connection is
+// closed once it returns.
+type WebSocketHandler func(ws *WebSocketConn)
+
+// CloseError is returned by ReadMessage once the connection has been
+// closed, either by the client or because it broke the protocol. Code is
+// the status code of the close.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket: closed with %d %s", e.Code, e.Reason)
+}
+
+// WebSocketConn is the server side of a WebSocket connection. Messages may
+// be written while another goroutine reads, but only one goroutine may
+// read at a time.
+type WebSocketConn struct {
+	// Request is the request that opened the connection
+	Request *Request
+
+	conn         net.Conn
+	br           *bufio.Reader
+	writeTimeout time.Duration
+	// idleTimeout is how long ReadMessage waits for each frame
+	idleTimeout time.Duration
+
+	// messageMu keeps the fragments of a message together, while control
+	// frames may still be sent in between
+	messageMu sync.Mutex
+	writeMu   sync.Mutex
+	closeSent bool
+}
+
+// Method which answers a WebSocket handshake request (RFC 6455 4.2) with
+// "101 Switching Protocols" and hands the connection to handler. Requests
+// that aren't a valid handshake get 400, and ones for another protocol
+// version or without Upgrade 426.
+func (s *Server) upgradeWebSocket(req *Request, handler WebSocketHandler) *Response {
+	res := &Response{}
+	key := req.Headers["Sec-Websocket-Key"]
+	switch {
+	case !hasToken(req.Headers["Upgrade"], "websocket") || !hasToken(req.Headers[CONNECTION], "upgrade"):
+		res.HandleUpgradeRequired("websocket")
+	case req.Headers["Sec-Websocket-Version"] != webSocketVersion:
+		res.HandleUpgradeRequired("websocket")
+		res.Headers["Sec-WebSocket-Version"] = webSocketVersion
+	case req.Method != GET || !req.ProtoAtLeast(1, 1) || req.Body != nil || !validWebSocketKey(key):
+		res.HandleBadRequest()
+	default:
+		res.HandleSwitchingProtocols("websocket")
+		res.Headers["Sec-WebSocket-Accept"] = webSocketAccept(key)
+		writeTimeout := durationOr(s.WriteTimeout, SEND_TIMEOUT)
+		idleTimeout := durationOr(s.WebSocketIdleTimeout, DEFAULT_WEBSOCKET_IDLE_TIMEOUT)
+		res.Hijack = func(conn net.Conn, buffered []byte) {
+			ws := &WebSocketConn{
+				Request:      req,
+				conn:         conn,
+				br:           bufio.NewReader(io.MultiReader(bytes.NewReader(buffered), conn)),
+				writeTimeout: writeTimeout,
+				idleTimeout:  idleTimeout,
+			}
+			defer conn.Close()
+			handler(ws)
+			_ = ws.Close(WEBSOCKET_CLOSE_NORMAL, "")
+		}
+		return res
+	}
+	if req.Close {
+		res.Headers[CONNECTION] = CLOSE
+	}
+	return res
+}
+
+// Method which reports whether key is a valid Sec-WebSocket-Key: 16
+// random bytes in base64
+func validWebSocketKey(key string) bool {
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	return err == nil && len(decoded) == 16
+}
+
+// Method which returns the Sec-WebSocket-Accept answering key
+func webSocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// ReadMessage returns the next text or binary message, put together from
+// its fragments. Pings are answered while waiting for it. Once the client
+// closes the connection, breaks the protocol or sends no frame for the
+// idle timeout, it returns a *CloseError.
+func (ws *WebSocketConn) ReadMessage() (opcode int, data []byte, err error) {
+	opcode = -1
+	for {
+		if err := ws.conn.SetReadDeadline(time.Now().Add(ws.idleTimeout)); err != nil {
+			return 0, nil, err
+		}
+		fin, frameOpcode, payload, err := ws.readFrame()
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return 0, nil, ws.fail(WEBSOCKET_CLOSE_GOING_AWAY, "idle timeout")
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		switch frameOpcode {
+		case WEBSOCKET_PING:
+			if err := ws.writeFrame(true, WEBSOCKET_PONG, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case WEBSOCKET_PONG:
+			continue
+		case WEBSOCKET_CLOSE:
+			return 0, nil, ws.closeReceived(payload)
+		case WEBSOCKET_CONTINUATION:
+			if opcode < 0 {
+				return 0, nil, ws.fail(WEBSOCKET_CLOSE_PROTOCOL_ERROR, "continuation without a message")
+			}
+		case WEBSOCKET_TEXT, WEBSOCKET_BINARY:
+			if opcode >= 0 {
+				return 0, nil, ws.fail(WEBSOCKET_CLOSE_PROTOCOL_ERROR, "new message before the last one ended")
+			}
+			opcode = frameOpcode
+		default:
+			return 0, nil, ws.fail(WEBSOCKET_CLOSE_PROTOCOL_ERROR, "unknown opcode "+strconv.Itoa(frameOpcode))
+		}
+		if len(data)+len(payload) > MAX_WEBSOCKET_MESSAGE_BYTES {
+			return 0, nil, ws.fail(WEBSOCKET_CLOSE_TOO_BIG, "message too big")
+		}
+		data = append(data, payload...)
+		if !fin {
+			continue
+		}
+		if opcode == WEBSOCKET_TEXT && !utf8.Valid(data) {
+			return 0, nil, ws.fail(WEBSOCKET_CLOSE_INVALID_DATA, "text is not UTF-8")
+		}
+		return opcode, data, nil
+	}
+}
+
+// Method which reads a single frame from the client, unmasking its
+// payload. Frames breaking the protocol close the connection.
+func (ws *WebSocketConn) readFrame() (fin bool, opcode int, payload []byte, err error) {
+	var header [2]byte
+	if _, err := io.ReadFull(ws.br, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin, opcode = header[0]&0x80 != 0, int(header[0]&0x0F)
+	masked, length := header[1]&0x80 != 0, uint64(header[1]&0x7F)
+	if header[0]&0x70 != 0 {
+		return false, 0, nil, ws.fail(WEBSOCKET_CLOSE_PROTOCOL_ERROR, "reserved bits set")
+	}
+	if !masked {
+		return false, 0, nil, ws.fail(WEBSOCKET_CLOSE_PROTOCOL_ERROR, "client frames must be masked")
+	}
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(ws.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(ws.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if opcode >= WEBSOCKET_CLOSE && (!fin || length > 125) {
+		return false, 0, nil, ws.fail(WEBSOCKET_CLOSE_PROTOCOL_ERROR, "control frames must be single frames of at most 125 bytes")
+	}
+	if length > MAX_WEBSOCKET_MESSAGE_BYTES {
+		return false, 0, nil, ws.fail(WEBSOCKET_CLOSE_TOO_BIG, "message too big")
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(ws.br, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	// The payload grows as it arrives rather than being allocated up front
+	// for the length the client claims
+	payload, err = io.ReadAll(io.LimitReader(ws.br, int64(length)))
+	if err != nil {
+		return false, 0, nil, err
+	}
+	if uint64(len(payload)) < length {
+		return false, 0, nil, io.ErrUnexpectedEOF
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// Method which answers the close frame of the client with one carrying the
+// same status code, and returns the matching *CloseError
+func (ws *WebSocketConn) closeReceived(payload []byte) error {
+	closeErr := &CloseError{Code: WEBSOCKET_CLOSE_NO_STATUS}
+	if len(payload) == 1 {
+		return ws.fail(WEBSOCKET_CLOSE_PROTOCOL_ERROR, "truncated close status")
+	}
+	if len(payload) >= 2 {
+		closeErr.Code = int(binary.BigEndian.Uint16(payload))
+		closeErr.Reason = string(payload[2:])
+		if !validCloseCode(closeErr.Code) {
+			return ws.fail(WEBSOCKET_CLOSE_PROTOCOL_ERROR, "invalid close status "+strconv.Itoa(closeErr.Code))
+		}
+		if !utf8.ValidString(closeErr.Reason) {
+			return ws.fail(WEBSOCKET_CLOSE_INVALID_DATA, "close reason is not UTF-8")
+		}
+	}
+	echo := payload
+	if len(echo) > 2 {
+		echo = echo[:2]
+	}
+	_ = ws.writeFrame(true, WEBSOCKET_CLOSE, echo)
+	_ = ws.conn.Close()
+	return closeErr
+}
+
+// Method which reports whether a client may send code in a close frame:
+// a code defined by RFC 6455 or registered with IANA, other than the ones
+// reserved for reporting, or one for libraries and applications
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 3000 && code <= 4999:
+		return true
+	case code >= 1000 && code <= 1014:
+		// 1004 is reserved, and 1005 and 1006 must never be sent
+		return code != 1004 && code != WEBSOCKET_CLOSE_NO_STATUS && code != 1006
+	}
+	return false
+}
+
+// Method which closes the connection with code after the client broke the
+// protocol, and returns the matching *CloseError
+func (ws *WebSocketConn) fail(code int, reason string) error {
+	_ = ws.writeFrame(true, WEBSOCKET_CLOSE, closePayload(code, reason))
+	_ = ws.conn.Close()
+	return &CloseError{Code: code, Reason: reason}
+}
+
+// WriteMessage sends data as a text or binary message. Large messages are
+// split into several frames.
+func (ws *WebSocketConn) WriteMessage(opcode int, data []byte) error {
+	if opcode != WEBSOCKET_TEXT && opcode != WEBSOCKET_BINARY {
+		return fmt.Errorf("websocket: opcode %d is not a data opcode", opcode)
+	}
+	ws.messageMu.Lock()
+	defer ws.messageMu.Unlock()
+	for {
+		fragment := data
+		if len(fragment) > webSocketFrameBytes {
+			fragment = fragment[:webSocketFrameBytes]
+		}
+		data = data[len(fragment):]
+		if err := ws.writeFrame(len(data) == 0, opcode, fragment); err != nil {
+			return err
+		}
+		if len(data) == 0 {
+			return nil
+		}
+		opcode = WEBSOCKET_CONTINUATION
+	}
+}
+
+// Ping sends a ping frame, which the client answers with a pong
+func (ws *WebSocketConn) Ping(data []byte) error {
+	if len(data) > 125 {
+		return fmt.Errorf("websocket: ping payload of %d bytes is too long", len(data))
+	}
+	return ws.writeFrame(true, WEBSOCKET_PING, data)
+}
+
+// Close sends a close frame with code and reason, waits up to
+// WEBSOCKET_CLOSE_TIMEOUT for the client's close frame and closes the
+// connection. It must not be called while another goroutine is in
+// ReadMessage.
+func (ws *WebSocketConn) Close(code int, reason string) error {
+	err := ws.writeFrame(true, WEBSOCKET_CLOSE, closePayload(code, reason))
+	if err == ErrWebSocketClosed {
+		// The close handshake already happened
+		return nil
+	}
+	if err == nil {
+		_ = ws.conn.SetReadDeadline(time.Now().Add(WEBSOCKET_CLOSE_TIMEOUT))
+		for {
+			_, opcode, _, readErr := ws.readFrame()
+			if readErr != nil || opcode == WEBSOCKET_CLOSE {
+				break
+			}
+		}
+	}
+	if closeErr := ws.conn.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Method which writes a single unmasked frame. Nothing is written after a
+// close frame.
+func (ws *WebSocketConn) writeFrame(fin bool, opcode int, payload []byte) error {
+	ws.writeMu.Lock()
+	defer ws.writeMu.Unlock()
+	if ws.closeSent {
+		return ErrWebSocketClosed
+	}
+	ws.closeSent = opcode == WEBSOCKET_CLOSE
+	frame := make([]byte, 2, 10+len(payload))
+	frame[0] = byte(opcode)
+	if fin {
+		frame[0] |= 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		frame[1] = byte(len(payload))
+	case len(payload) <= 0xFFFF:
+		frame[1] = 126
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame[1] = 127
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	frame = append(frame, payload...)
+	if err := ws.conn.SetWriteDeadline(time.Now().Add(ws.writeTimeout)); err != nil {
+		return err
+	}
+	_, err := ws.conn.Write(frame)
+	return err
+}
+
+// Method which returns the payload of a close frame
+func closePayload(code int, reason string) []byte {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	return append(payload, reason...)
+}
@@ -0,0 +1,279 @@
+package tritonhttp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// wsframe returns a masked client frame
+func wsframe(fin bool, opcode byte, payload []byte) []byte {
+	frame := []byte{opcode, 0x80}
+	if fin {
+		frame[0] |= 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		frame[1] |= byte(len(payload))
+	case len(payload) <= 0xFFFF:
+		frame[1] |= 126
+		frame = append(frame, byte(len(payload)>>8), byte(len(payload)))
+	default:
+		frame[1] |= 127
+		for shift := 56; shift >= 0; shift -= 8 {
+			frame = append(frame, byte(len(payload)>>shift))
+		}
+	}
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
+
+// readwsframe reads an unmasked server frame
+func readwsframe(t *testing.T, br *bufio.Reader) (bool, byte, []byte) {
+	t.Helper()
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(br, header); err != nil {
+		t.Fatalf("Error reading frame: %v\n", err)
+	}
+	if header[1]&0x80 != 0 {
+		t.Fatalf("Expected server frames to be unmasked\n")
+	}
+	length := int(header[1] & 0x7F)
+	if length >= 126 {
+		ext := make([]byte, 2)
+		if length == 127 {
+			ext = make([]byte, 8)
+		}
+		if _, err := io.ReadFull(br, ext); err != nil {
+			t.Fatalf("Error reading frame length: %v\n", err)
+		}
+		length = 0
+		for _, b := range ext {
+			length = length<<8 | int(b)
+		}
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(br, payload); err != nil {
+		t.Fatalf("Error reading frame payload: %v\n", err)
+	}
+	return header[0]&0x80 != 0, header[0] & 0x0F, payload
+}
+
+// wshandshake opens a WebSocket connection to path on port
+func wshandshake(t *testing.T, port string, host string, path string) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+	conn := dialfrom(t, "127.0.0.1", port)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\nConnection: keep-alive, Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n", path, host)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("Error parsing handshake response: %v\n", err)
+	}
+	if resp.StatusCode != 101 || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" ||
+		!strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") {
+		t.Fatalf("Expected the handshake to succeed but got %v %v\n", resp.StatusCode, resp.Header)
+	}
+	return conn, br, resp
+}
+
+func TestWebSocket(t *testing.T) {
+	echo := func(ws *WebSocketConn) {
+		for {
+			opcode, data, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := ws.WriteMessage(opcode, data); err != nil {
+				return
+			}
+		}
+	}
+	backend := &Server{
+		VirtualHosts:      map[string]fs.FS{"site": fstest.MapFS{"index.html": {Data: []byte("index")}}},
+		WebSocketHandlers: map[string]WebSocketHandler{"/echo": echo},
+	}
+	port := launchserver(t, backend)
+
+	conn, br, _ := wshandshake(t, port, "site", "/echo")
+	conn.Write(wsframe(true, 0x1, []byte("hello")))
+	if fin, opcode, payload := readwsframe(t, br); !fin || opcode != 0x1 || string(payload) != "hello" {
+		t.Fatalf("Expected the text message to be echoed but got %v %v %q\n", fin, opcode, payload)
+	}
+
+	// Fragments are put together, and pings in between answered
+	conn.Write(wsframe(false, 0x1, []byte("hel")))
+	conn.Write(wsframe(true, 0x9, []byte("p")))
+	conn.Write(wsframe(true, 0x0, []byte("lo")))
+	if _, opcode, payload := readwsframe(t, br); opcode != 0xA || string(payload) != "p" {
+		t.Fatalf("Expected a pong but got %v %q\n", opcode, payload)
+	}
+	if _, opcode, payload := readwsframe(t, br); opcode != 0x1 || string(payload) != "hello" {
+		t.Fatalf("Expected the fragmented message to be echoed but got %v %q\n", opcode, payload)
+	}
+
+	// Large messages are sent in several frames
+	large := bytes.Repeat([]byte("0123456789"), 20000)
+	conn.Write(wsframe(true, 0x2, large))
+	var received []byte
+	frames := 0
+	for {
+		fin, opcode, payload := readwsframe(t, br)
+		if (frames == 0 && opcode != 0x2) || (frames > 0 && opcode != 0x0) {
+			t.Fatalf("Expected a binary message continued by continuation frames but got opcode %v\n", opcode)
+		}
+		received = append(received, payload...)
+		frames++
+		if fin {
+			break
+		}
+	}
+	if frames < 2 || !bytes.Equal(received, large) {
+		t.Fatalf("Expected the large message to be echoed in several frames but got %v bytes in %v frames\n", len(received), frames)
+	}
+
+	// The close handshake ends the connection
+	conn.Write(wsframe(true, 0x8, []byte{0x03, 0xE8, 'b', 'y', 'e'}))
+	if _, opcode, payload := readwsframe(t, br); opcode != 0x8 || !bytes.Equal(payload, []byte{0x03, 0xE8}) {
+		t.Fatalf("Expected a close frame with 1000 but got %v %v\n", opcode, payload)
+	}
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Fatalf("Expected the connection to be closed but got %v\n", err)
+	}
+
+	// Unmasked frames break the protocol
+	conn, br, _ = wshandshake(t, port, "site", "/echo")
+	conn.Write([]byte{0x81, 0x02, 'h', 'i'})
+	if _, opcode, payload := readwsframe(t, br); opcode != 0x8 || !bytes.HasPrefix(payload, []byte{0x03, 0xEA}) {
+		t.Fatalf("Expected a close frame with 1002 but got %v %v\n", opcode, payload)
+	}
+
+	// Requests that aren't a valid handshake
+	tests := []struct {
+		headers    string
+		statusCode int
+	}{
+		{"", 426},
+		{"Connection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 8\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n", 426},
+		{"Connection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\n", 400},
+		{"Connection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: c2hvcnQ=\r\n", 400},
+	}
+	for _, tt := range tests {
+		resp := requestfrom(t, "127.0.0.1", port, "GET /echo HTTP/1.1\r\nHost: site\r\nConnection: close\r\n"+tt.headers+"\r\n")
+		if resp.StatusCode != tt.statusCode {
+			t.Fatalf("Expected response code of %v for %q but got %v\n", tt.statusCode, tt.headers, resp.StatusCode)
+		}
+		if tt.statusCode == 426 && resp.Header.Get("Upgrade") != "websocket" {
+			t.Fatalf("Expected 426 to ask for websocket but got %v\n", resp.Header)
+		}
+	}
+
+	// Proxy virtual hosts tunnel the connection to the upstream
+	tmp := t.TempDir()
+	config := filepath.Join(tmp, "virtual_hosts.yaml")
+	if err := os.WriteFile(config, []byte(`virtual_hosts:
+  - hostName: "site"
+    upstream: "127.0.0.1:`+port+`"
+`), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	c, err := LoadConfig(config, tmp)
+	if err != nil {
+		t.Fatalf("Expected config to be valid but got %v\n", err)
+	}
+	proxy := &Server{}
+	if err := proxy.ApplyConfig(c); err != nil {
+		t.Fatal(err.Error())
+	}
+	proxyport := launchserver(t, proxy)
+	conn, br, resp := wshandshake(t, proxyport, "site", "/echo")
+	if !strings.Contains(resp.Header.Get("Via"), "tritonhttpd") {
+		t.Fatalf("Expected the handshake response to come through the proxy but got %v\n", resp.Header)
+	}
+	conn.Write(wsframe(true, 0x1, []byte("tunnelled")))
+	if _, opcode, payload := readwsframe(t, br); opcode != 0x1 || string(payload) != "tunnelled" {
+		t.Fatalf("Expected the message to be echoed through the tunnel but got %v %q\n", opcode, payload)
+	}
+	conn.Write(wsframe(true, 0x8, []byte{0x03, 0xE8}))
+	if _, opcode, _ := readwsframe(t, br); opcode != 0x8 {
+		t.Fatalf("Expected the close frame through the tunnel but got %v\n", opcode)
+	}
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Fatalf("Expected the tunnel to be closed but got %v\n", err)
+	}
+}
+
+func TestWebSocketCloseAndIdle(t *testing.T) {
+	echo := func(ws *WebSocketConn) {
+		for {
+			opcode, data, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := ws.WriteMessage(opcode, data); err != nil {
+				return
+			}
+		}
+	}
+	s := &Server{
+		VirtualHosts:         map[string]fs.FS{"site": fstest.MapFS{"index.html": {Data: []byte("index")}}},
+		WebSocketHandlers:    map[string]WebSocketHandler{"/echo": echo},
+		WebSocketIdleTimeout: 300 * time.Millisecond,
+	}
+	port := launchserver(t, s)
+
+	// Close codes that are reserved, or must never be sent, are answered
+	// with 1002
+	tests := []struct {
+		code     uint16
+		expected uint16
+	}{
+		{1000, 1000},
+		{1011, 1011},
+		{4000, 4000},
+		{999, 1002},
+		{1004, 1002},
+		{1005, 1002},
+		{1006, 1002},
+		{1015, 1002},
+		{2000, 1002},
+		{5000, 1002},
+	}
+	for _, tt := range tests {
+		conn, br, _ := wshandshake(t, port, "site", "/echo")
+		conn.Write(wsframe(true, 0x8, []byte{byte(tt.code >> 8), byte(tt.code)}))
+		_, opcode, payload := readwsframe(t, br)
+		if opcode != 0x8 || len(payload) < 2 || uint16(payload[0])<<8|uint16(payload[1]) != tt.expected {
+			t.Fatalf("Expected close code %v to be answered with %v but got %v %v\n", tt.code, tt.expected, opcode, payload)
+		}
+	}
+
+	// Connections that send nothing, or stop in the middle of a frame
+	// claiming a large payload, are closed with 1001 after the idle timeout
+	for _, data := range [][]byte{nil, {0x82, 0xFF, 0, 0, 0, 0, 0, 0xFF, 0, 0, 1, 2, 3, 4, 'x'}} {
+		conn, br, _ := wshandshake(t, port, "site", "/echo")
+		conn.Write(data)
+		start := time.Now()
+		if _, opcode, payload := readwsframe(t, br); opcode != 0x8 || !bytes.HasPrefix(payload, []byte{0x03, 0xE9}) {
+			t.Fatalf("Expected a close frame with 1001 but got %v %v\n", opcode, payload)
+		}
+		if elapsed := time.Since(start); elapsed > 3*time.Second {
+			t.Fatalf("Expected the idle connection to be closed after the idle timeout but took %v\n", elapsed)
+		}
+	}
+}